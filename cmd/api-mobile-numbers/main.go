@@ -1,12 +1,40 @@
 package main
 
 import (
+	"flag"
+
 	log "github.com/sirupsen/logrus"
 
 	"github.com/tonyOreglia/api-mobile-numbers/internal/server"
 )
 
 func main() {
-	server := server.New()
+	cfg := server.DefaultConfig()
+	flag.Int64Var(&cfg.MaxUploadBytes, "max-upload-bytes", cfg.MaxUploadBytes, "maximum size in bytes of an upload request body, 0 for no limit")
+	flag.IntVar(&cfg.MaxRows, "max-rows", cfg.MaxRows, "maximum number of rows in an upload, 0 for no limit")
+	flag.IntVar(&cfg.MaxColumns, "max-columns", cfg.MaxColumns, "maximum number of columns in an upload, 0 for no limit")
+	flag.IntVar(&cfg.DailyRowQuota, "daily-row-quota", cfg.DailyRowQuota, "maximum number of rows each client can upload per day, 0 for no limit")
+	flag.Int64Var(&cfg.MaxDecompressedBytes, "max-decompressed-bytes", cfg.MaxDecompressedBytes, "maximum size in bytes of a compressed upload once decompressed")
+	flag.IntVar(&cfg.MaxArchiveMembers, "max-archive-members", cfg.MaxArchiveMembers, "maximum number of files in an uploaded zip archive")
+	flag.DurationVar(&cfg.IdempotencyRetention, "idempotency-retention", cfg.IdempotencyRetention, "how long upload responses are replayed for retries with the same Idempotency-Key")
+	flag.DurationVar(&cfg.IdempotencyPendingTimeout, "idempotency-pending-timeout", cfg.IdempotencyPendingTimeout, "how long an Idempotency-Key stays reserved by an upload that never answered")
+	flag.IntVar(&cfg.AsyncWorkers, "async-workers", cfg.AsyncWorkers, "number of uploads processed concurrently in the background")
+	flag.IntVar(&cfg.AsyncQueueSize, "async-queue-size", cfg.AsyncQueueSize, "maximum number of background uploads waiting to be processed")
+	flag.DurationVar(&cfg.JobRetention, "job-retention", cfg.JobRetention, "how long the state of a finished background upload is kept")
+	flag.IntVar(&cfg.ValidationWorkers, "validation-workers", cfg.ValidationWorkers, "number of goroutines validating the rows of an upload")
+	flag.IntVar(&cfg.WriteBatchSize, "write-batch-size", cfg.WriteBatchSize, "number of numbers of each category written to the database at a time")
+	flag.DurationVar(&cfg.ProcessingTimeout, "processing-timeout", cfg.ProcessingTimeout, "how long a file can be processing before it is marked as failed, 0 for no limit")
+	flag.StringVar(&cfg.UploadDir, "upload-dir", cfg.UploadDir, "directory holding the chunks of resumable uploads")
+	flag.Int64Var(&cfg.MaxChunkBytes, "max-chunk-bytes", cfg.MaxChunkBytes, "maximum size in bytes of a chunk of a resumable upload, 0 for no limit")
+	flag.DurationVar(&cfg.UploadSessionRetention, "upload-session-retention", cfg.UploadSessionRetention, "how long an unfinished resumable upload is kept")
+	flag.StringVar(&cfg.Storage, "storage", cfg.Storage, "where processed files are stored, postgres, memory or file")
+	flag.StringVar(&cfg.DatabaseURL, "database-url", cfg.DatabaseURL, "connection string of the Postgres database")
+	flag.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory holding processed files when they are stored in files")
+	flag.Parse()
+
+	server, err := server.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Fatal(server.Start())
 }
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// supported upload compressions
+const (
+	gzipCompression = "gzip"
+	zipCompression  = "zip"
+)
+
+// determines the compression of an uploaded file from its extension, falling back to its Content-Type
+// an empty string is returned for uncompressed files
+func fileCompression(filename string, contentType string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gz", ".gzip":
+		return gzipCompression
+	case ".zip":
+		return zipCompression
+	}
+	return contentTypeCompression(contentType)
+}
+
+// determines the compression of an upload from its Content-Type
+// an empty string is returned for uncompressed content types
+func contentTypeCompression(contentType string) string {
+	switch strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0])) {
+	case "application/gzip", "application/x-gzip":
+		return gzipCompression
+	case "application/zip", "application/x-zip-compressed":
+		return zipCompression
+	}
+	return ""
+}
+
+// reads the rows of an upload, decompressing it first when needed, and spools them for processing
+// rows are numbered from 1 in the order they appear in the upload, zip archive members following each other
+// a cell holding several numbers gives a row for each, sharing the row number of the cell
+// the configured limits on decompressed bytes, archive members, rows and columns are enforced while reading
+func spoolUploadRows(up *upload, cfg Config) (*uploadRows, error) {
+	rows := newUploadRows(up.country)
+	limits := &uploadLimits{maxRows: cfg.MaxRows, maxColumns: cfg.MaxColumns}
+	n := 0
+	err := readCompressedRows(up, cfg.MaxDecompressedBytes, cfg.MaxArchiveMembers, limits, func(row uploadRow) error {
+		n++
+		row.row = n
+		for _, part := range splitRow(row) {
+			if err := rows.add(part); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = rows.finish()
+	}
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+// reads the rows of an upload, decompressing it first when needed, calling emit with each row as it is read
+func readCompressedRows(up *upload, maxBytes int64, maxMembers int, limits *uploadLimits, emit func(row uploadRow) error) error {
+	switch up.compression {
+	case gzipCompression:
+		zr, err := gzip.NewReader(up.body)
+		if err != nil {
+			return decodeError(err, "invalid gzip upload: %s")
+		}
+		defer zr.Close()
+		return readRows(newDecompressedReader(zr, maxBytes), up.format, up.country, up.opts, limits, emit)
+	case zipCompression:
+		return readArchiveRows(up, maxBytes, maxMembers, limits, emit)
+	}
+	return readRows(up.body, up.format, up.country, up.opts, limits, emit)
+}
+
+// reads the rows of every file in a zip archive as one logical file
+// each row records the archive member it was read from
+func readArchiveRows(up *upload, maxBytes int64, maxMembers int, limits *uploadLimits, emit func(row uploadRow) error) error {
+	archive, cleanup, err := openArchive(up.body, maxBytes)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var members []*zip.File
+	for _, f := range archive.File {
+		name := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if fileCompression(name, "") != "" {
+			return &jsonError{Msg: fmt.Sprintf("zip member %s is an archive, nested archives are not supported", f.Name)}
+		}
+		members = append(members, f)
+	}
+	if len(members) == 0 {
+		return &jsonError{Msg: "zip upload holds no files"}
+	}
+	if maxMembers > 0 && len(members) > maxMembers {
+		return newLimitError("archive_members", int64(maxMembers), "zip upload holds %d files, the limit is %d", len(members), maxMembers)
+	}
+
+	// the limit is shared by all members, as they are processed as one file
+	remaining := newDecompressedReader(nil, maxBytes)
+	for _, f := range members {
+		if limits.sampled() {
+			break
+		}
+		if limits != nil && limits.dialect != nil {
+			limits.dialect.Members = append(limits.dialect.Members, f.Name)
+		}
+		if maxBytes > 0 && f.UncompressedSize64 > uint64(remaining.remaining) {
+			return remaining.exceeded()
+		}
+		format, err := fileFormat(f.Name, "")
+		if err != nil {
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return &jsonError{Msg: fmt.Sprintf("unable to open zip member %s: %s", f.Name, err)}
+		}
+		remaining.r = rc
+		// errors of emit are the caller's, and are returned as they are
+		var emitErr error
+		err = readRows(remaining, format, up.country, up.opts, limits, func(row uploadRow) error {
+			row.member = f.Name
+			emitErr = emit(row)
+			return emitErr
+		})
+		rc.Close()
+		if err != nil {
+			if _, ok := asStatusError(err); ok || err == emitErr {
+				return err
+			}
+			return &jsonError{Msg: fmt.Sprintf("zip member %s: %s", f.Name, err)}
+		}
+	}
+	return nil
+}
+
+// opens a zip archive held in body
+// archives need random access, so bodies that do not provide it are spooled to a temporary file
+// an archive is no larger than the data it holds, so the archive itself is limited to maxBytes, under a limit of its own
+func openArchive(body io.Reader, maxBytes int64) (*zip.Reader, func(), error) {
+	if f, ok := body.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, nil, err
+		}
+		if maxBytes > 0 && size > maxBytes {
+			return nil, nil, newArchiveReader(nil, maxBytes).exceeded()
+		}
+		archive, err := zip.NewReader(f, size)
+		if err != nil {
+			return nil, nil, &jsonError{Msg: fmt.Sprintf("invalid zip upload: %s", err)}
+		}
+		return archive, func() {}, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "upload-*.zip")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		if err := os.Remove(tmp.Name()); err != nil {
+			log.Error(err)
+		}
+	}
+	size, err := io.Copy(tmp, newArchiveReader(body, maxBytes))
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		cleanup()
+		return nil, nil, &jsonError{Msg: fmt.Sprintf("invalid zip upload: %s", err)}
+	}
+	return archive, cleanup, nil
+}
+
+// reader failing once more than limit bytes are read from it
+// unlike io.LimitReader, exceeding the limit is an error rather than a silent truncation
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+	// name of the limit, and description of the data it applies to, for error messages
+	name        string
+	description string
+}
+
+// limits the data read from r to limit bytes, describing the limit by name and description when exceeded
+// a limit of 0 means no limit
+func newLimitedReader(r io.Reader, limit int64, name string, description string) *limitedReader {
+	return &limitedReader{r: r, remaining: limit, limit: limit, name: name, description: description}
+}
+
+// limits decompressed data, protecting against decompression bombs
+func newDecompressedReader(r io.Reader, limit int64) *limitedReader {
+	return newLimitedReader(r, limit, "decompressed_bytes", "decompressed upload")
+}
+
+// limits a zip archive read before it is decompressed
+func newArchiveReader(r io.Reader, limit int64) *limitedReader {
+	return newLimitedReader(r, limit, "archive_bytes", "zip upload")
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.limit <= 0 {
+		return l.r.Read(p)
+	}
+	if l.remaining <= 0 {
+		// only an error if there is more data to read
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, l.exceeded()
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func (l *limitedReader) exceeded() error {
+	return newLimitError(l.name, l.limit, "%s exceeds the limit of %d bytes", l.description, l.limit)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func gzipData(t *testing.T, data string) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func zipData(t *testing.T, files map[string]string, order []string) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, name := range order {
+		f, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// spools the rows of an upload and reads them all back
+func readUploadRows(up *upload, cfg Config) ([]uploadRow, error) {
+	spooled, err := spoolUploadRows(up, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer spooled.Close()
+	var rows []uploadRow
+	err = spooled.each(10, func(chunk []uploadRow) error {
+		rows = append(rows, chunk...)
+		return nil
+	})
+	return rows, err
+}
+
+func TestReadGzipUploadRows(t *testing.T) {
+	up := &upload{
+		body:        ioutil.NopCloser(bytes.NewReader(gzipData(t, "id,sms_phone\n1,27717278645\n"))),
+		format:      csvFormat,
+		compression: gzipCompression,
+		country:     "rsa",
+	}
+	rows, err := readUploadRows(up, Config{MaxDecompressedBytes: 1024, MaxArchiveMembers: 10})
+	require.NoError(t, err)
+	require.Equal(t, []uploadRow{{row: 1, number: "27717278645", country: "rsa"}}, withoutCells(rows))
+}
+
+func TestReadZipUploadRows(t *testing.T) {
+	archive := zipData(t, map[string]string{
+		"march/rsa.csv":   "id,sms_phone\n1,27717278645\n2,27717278646\n",
+		"march/aus.jsonl": "{\"sms_phone\": \"61412345678\"}\n",
+		"march/":          "",
+	}, []string{"march/", "march/rsa.csv", "march/aus.jsonl"})
+
+	// raw request bodies are spooled to disk before being opened
+	up := &upload{
+		body:        ioutil.NopCloser(bytes.NewBuffer(archive)),
+		format:      csvFormat,
+		compression: zipCompression,
+		country:     "rsa",
+	}
+	rows, err := readUploadRows(up, Config{MaxDecompressedBytes: 1024, MaxArchiveMembers: 10})
+	require.NoError(t, err)
+	require.Equal(t, []uploadRow{
+		{row: 1, number: "27717278645", country: "rsa", member: "march/rsa.csv"},
+		{row: 2, number: "27717278646", country: "rsa", member: "march/rsa.csv"},
+		{row: 3, number: "61412345678", country: "rsa", member: "march/aus.jsonl"},
+	}, withoutCells(rows))
+
+	_, err = readUploadRows(&upload{
+		body:        ioutil.NopCloser(bytes.NewBuffer(archive)),
+		compression: zipCompression,
+	}, Config{MaxDecompressedBytes: 1024, MaxArchiveMembers: 1})
+	require.Error(t, err)
+	require.Equal(t, http.StatusRequestEntityTooLarge, errorStatus(err, http.StatusBadRequest))
+}
+
+func TestReadCompressedUploadExceedsLimit(t *testing.T) {
+	data := "id,sms_phone\n1,27717278645\n2,27717278646\n"
+	tests := map[string]*upload{
+		"gzip": {
+			body:        ioutil.NopCloser(bytes.NewReader(gzipData(t, data))),
+			format:      csvFormat,
+			compression: gzipCompression,
+		},
+		"zip": {
+			body:        ioutil.NopCloser(bytes.NewBuffer(zipData(t, map[string]string{"a.csv": data}, []string{"a.csv"}))),
+			format:      csvFormat,
+			compression: zipCompression,
+		},
+	}
+	for tName, up := range tests {
+		_, err := readUploadRows(up, Config{MaxDecompressedBytes: int64(len(data) - 1), MaxArchiveMembers: 10})
+		require.Error(t, err, tName)
+		require.Equal(t, http.StatusRequestEntityTooLarge, errorStatus(err, http.StatusBadRequest), tName)
+	}
+}
+
+func TestReadZipUploadLimitNames(t *testing.T) {
+	data := "id,sms_phone\n" + strings.Repeat("1,27717278645\n", 100)
+	archive := zipData(t, map[string]string{"a.csv": data}, []string{"a.csv"})
+	tests := map[string]struct {
+		maxBytes int64
+		limit    string
+		msg      string
+	}{
+		// the archive is spooled, and limited, before anything is decompressed
+		"archive": {maxBytes: int64(len(archive) - 1), limit: "archive_bytes", msg: "zip upload exceeds the limit"},
+		"decompressed": {maxBytes: int64(len(archive)), limit: "decompressed_bytes",
+			msg: "decompressed upload exceeds the limit"},
+	}
+	path := filepath.Join(t.TempDir(), "numbers.zip")
+	require.NoError(t, ioutil.WriteFile(path, archive, 0600))
+	for tName, tt := range tests {
+		// raw request bodies are spooled, while multipart files are opened where they are
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		bodies := map[string]io.ReadCloser{"spooled": ioutil.NopCloser(bytes.NewBuffer(archive)), "seekable": f}
+		for bName, body := range bodies {
+			_, err := readUploadRows(&upload{body: body, format: csvFormat, compression: zipCompression},
+				Config{MaxDecompressedBytes: tt.maxBytes, MaxArchiveMembers: 10})
+			require.Error(t, err, tName, bName)
+			errJSON := errorJSON(err)
+			require.Equal(t, tt.limit, errJSON.Limit, tName, bName)
+			require.Equal(t, tt.maxBytes, errJSON.Max, tName, bName)
+			require.Contains(t, errJSON.Msg, tt.msg, tName, bName)
+		}
+		f.Close()
+	}
+}
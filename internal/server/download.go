@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gofrs/uuid"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// number of numbers written to a download between flushes to the client
+const downloadFlushRows = 1000
+
+// writes a download to the client as its numbers are read from the store
+// output is buffered, and flushed to the client every downloadFlushRows numbers
+type downloadWriter struct {
+	w       *bufio.Writer
+	flusher http.Flusher
+	rows    int
+	sent    *sentWriter
+}
+
+func newDownloadWriter(w http.ResponseWriter) *downloadWriter {
+	flusher, _ := w.(http.Flusher)
+	sent := &sentWriter{w: w}
+	return &downloadWriter{w: bufio.NewWriterSize(sent, 32*1024), flusher: flusher, sent: sent}
+}
+
+// counts the bytes passed on to the response
+type sentWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (s *sentWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// reports whether any of the download reached the response, after which its status can no longer change
+func (d *downloadWriter) started() bool {
+	return d.sent.n > 0
+}
+
+func (d *downloadWriter) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+func (d *downloadWriter) WriteString(s string) (int, error) {
+	return d.w.WriteString(s)
+}
+
+// counts a number as written, flushing once enough were
+func (d *downloadWriter) rowWritten() error {
+	d.rows++
+	if d.rows%downloadFlushRows != 0 {
+		return nil
+	}
+	return d.Flush()
+}
+
+// sends everything written so far to the client
+func (d *downloadWriter) Flush() error {
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	if d.flusher != nil {
+		d.flusher.Flush()
+	}
+	return nil
+}
+
+// a list of the JSON download, holding the numbers of a category
+type jsonList struct {
+	name     string
+	category string
+	item     func(row store.ResultRow) interface{}
+}
+
+// the lists of the JSON download, in the layout of store.FileResults
+var jsonLists = []jsonList{
+	{"valid_numbers", store.ValidCategory, func(row store.ResultRow) interface{} { return row.Number }},
+	{"fixed_numbers", store.FixedCategory, func(row store.ResultRow) interface{} {
+		return store.FixedNumber{OriginalNumber: row.Number, Changes: row.Changes, FixedNumber: row.FixedNumber}
+	}},
+	{"rejected_numbers", store.RejectedCategory, func(row store.ResultRow) interface{} { return row.Number }},
+	{"duplicate_numbers", store.DuplicateCategory, func(row store.ResultRow) interface{} {
+		return store.DuplicateNumber{
+			Number:           row.Number,
+			NormalizedNumber: row.FixedNumber,
+			RowNumber:        row.RowNumber,
+			FirstRowNumber:   row.FirstRowNumber,
+			Part:             row.Part,
+			Passthrough:      row.Passthrough,
+		}
+	}},
+}
+
+// streams the numbers of a file as a JSON object in the layout of store.FileResults
+// each list is read from the store as it is written, so no more than a buffer of the download is held in memory
+func (s *Server) writeJSONDownload(ctx context.Context, d *downloadWriter, file *store.File) error {
+	d.WriteString("{")
+	for i, list := range jsonLists {
+		if i > 0 {
+			d.WriteString(",")
+		}
+		if err := s.writeJSONList(ctx, d, file.Ref, list); err != nil {
+			return err
+		}
+	}
+	// passthrough values are echoed with every number, in the order of the file
+	if len(file.PassthroughColumns) > 0 {
+		columns, err := json.Marshal(file.PassthroughColumns)
+		if err != nil {
+			return err
+		}
+		d.WriteString(`,"passthrough_columns":`)
+		d.Write(columns)
+		d.WriteString(",")
+		rows := jsonList{"rows", "", func(row store.ResultRow) interface{} { return row }}
+		if err := s.writeJSONList(ctx, d, file.Ref, rows); err != nil {
+			return err
+		}
+	}
+	d.WriteString("}\n")
+	return d.Flush()
+}
+
+// streams the numbers of a list of the JSON download as a named JSON array
+func (s *Server) writeJSONList(ctx context.Context, d *downloadWriter, ref uuid.UUID, list jsonList) error {
+	d.WriteString(`"` + list.name + `":[`)
+	first := true
+	err := s.db.EachFileRow(ctx, ref, list.category, func(row store.ResultRow) error {
+		item, err := json.Marshal(list.item(row))
+		if err != nil {
+			return err
+		}
+		if !first {
+			d.WriteString(",")
+		}
+		first = false
+		if _, err := d.Write(item); err != nil {
+			return err
+		}
+		return d.rowWritten()
+	})
+	if err != nil {
+		return err
+	}
+	d.WriteString("]")
+	return nil
+}
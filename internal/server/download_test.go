@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+func TestDownloadWithPassthrough(t *testing.T) {
+	s := newTestServer(t)
+	body := "id,sms_phone,name\n1,27831234567,Ann\n2,831234568,Bob\n3,123,Cy\n4,27831234567,Di\n"
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers?passthrough=name", body, &uploaded))
+
+	w := httptest.NewRecorder()
+	s.r.ServeHTTP(w, httptest.NewRequest("GET", "/numbers/"+uploaded.Ref.String(), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json; charset=UTF-8", w.Header().Get("Content-Type"))
+	require.Equal(t, "Attachment; filename="+uploaded.Ref.String()+".json", w.Header().Get("Content-Disposition"))
+	var results store.FileResults
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results), w.Body.String())
+	require.Equal(t, store.FileResults{
+		ValidNumbers:    []string{"27831234567"},
+		FixedNumbers:    []store.FixedNumber{{OriginalNumber: "831234568", Changes: "prepended number with 27", FixedNumber: "27831234568"}},
+		RejectedNumbers: []string{"123"},
+		DuplicateNumbers: []store.DuplicateNumber{{Number: "27831234567", NormalizedNumber: "27831234567", RowNumber: 4,
+			FirstRowNumber: 1, Passthrough: store.Passthrough{"name": "Di"}}},
+		PassthroughColumns: []string{"name"},
+		Rows: []store.ResultRow{
+			{SourceRow: store.SourceRow{RowNumber: 1, Passthrough: store.Passthrough{"name": "Ann"}}, Category: store.ValidCategory,
+				Number: "27831234567", FixedNumber: "27831234567"},
+			{SourceRow: store.SourceRow{RowNumber: 2, Passthrough: store.Passthrough{"name": "Bob"}}, Category: store.FixedCategory,
+				Number: "831234568", FixedNumber: "27831234568", Changes: "prepended number with 27"},
+			{SourceRow: store.SourceRow{RowNumber: 3, Passthrough: store.Passthrough{"name": "Cy"}}, Category: store.RejectedCategory,
+				Number: "123", Reason: reasonInvalidLength},
+			{SourceRow: store.SourceRow{RowNumber: 4, Passthrough: store.Passthrough{"name": "Di"}}, Category: store.DuplicateCategory,
+				Number: "27831234567", FixedNumber: "27831234567", FirstRowNumber: 1},
+		},
+	}, results)
+}
+
+func TestDownloadEmptyLists(t *testing.T) {
+	s := newTestServer(t)
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", "id,sms_phone\n1,27831234567\n", &uploaded))
+	w := httptest.NewRecorder()
+	s.r.ServeHTTP(w, httptest.NewRequest("GET", "/numbers/"+uploaded.Ref.String(), nil))
+	require.Equal(t, `{"valid_numbers":["27831234567"],"fixed_numbers":[],"rejected_numbers":[],"duplicate_numbers":[]}`+"\n",
+		w.Body.String())
+}
+
+func TestDownloadStopsWhenClientGoesAway(t *testing.T) {
+	s := newTestServer(t)
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", "id,sms_phone\n1,27831234567\n2,27831234568\n", &uploaded))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	s.r.ServeHTTP(w, httptest.NewRequest("GET", "/numbers/"+uploaded.Ref.String(), nil).WithContext(ctx))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), "27831234567")
+}
+
+// records how often a download was flushed to the client
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func TestDownloadWriterFlushes(t *testing.T) {
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	d := newDownloadWriter(w)
+	for i := 0; i < 2*downloadFlushRows+1; i++ {
+		d.WriteString("27831234567\n")
+		require.NoError(t, d.rowWritten())
+	}
+	require.Equal(t, 2, w.flushes)
+	require.Equal(t, 2*downloadFlushRows*len("27831234567\n"), w.Body.Len())
+	require.NoError(t, d.Flush())
+	require.Equal(t, 3, w.flushes)
+	require.Equal(t, 2*downloadFlushRows+1, strings.Count(w.Body.String(), "\n"))
+}
+
+func TestDownloadIncompleteFile(t *testing.T) {
+	s := newTestServer(t)
+	processing, failed := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	for _, ref := range []uuid.UUID{processing, failed} {
+		require.NoError(t, s.db.CreateFile(store.File{Ref: ref, UploadedAt: time.Now(), Status: store.FileProcessing}))
+	}
+	require.NoError(t, s.db.FailFile(failed, "connection reset"))
+
+	for _, target := range []string{"/numbers/%s", "/numbers/%s?format=csv", "/numbers/%s/rows"} {
+		var errJSON jsonError
+		require.Equal(t, http.StatusConflict, serve(t, s, "GET", fmt.Sprintf(target, processing), "", &errJSON), target)
+		require.Equal(t, jsonError{Msg: fmt.Sprintf("file %s is processing", processing), Status: store.FileProcessing}, errJSON)
+
+		errJSON = jsonError{}
+		require.Equal(t, http.StatusConflict, serve(t, s, "GET", fmt.Sprintf(target, failed), "", &errJSON), target)
+		require.Equal(t, jsonError{Msg: fmt.Sprintf("file %s is failed", failed), Status: store.FileFailed,
+			Reason: "connection reset"}, errJSON)
+	}
+}
+
+func TestProcessingTimeout(t *testing.T) {
+	s := newTestServer(t)
+	interrupted := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.db.CreateFile(store.File{Ref: interrupted, UploadedAt: time.Now().Add(-2 * time.Hour),
+		Status: store.FileProcessing}))
+
+	// a file processing for longer than the timeout was interrupted, and is reported as failed
+	var errJSON jsonError
+	require.Equal(t, http.StatusConflict, serve(t, s, "GET", "/numbers/"+interrupted.String(), "", &errJSON))
+	require.Equal(t, jsonError{Msg: fmt.Sprintf("file %s is failed", interrupted), Status: store.FileFailed,
+		Reason: processingTimedOut}, errJSON)
+	var details fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "GET", "/numbers/results/"+interrupted.String(), "", &details))
+	require.Equal(t, store.FileFailed, details.Status)
+	require.Equal(t, processingTimedOut, details.Error)
+
+	s.cfg.ProcessingTimeout = 0
+	unlimited := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.db.CreateFile(store.File{Ref: unlimited, UploadedAt: time.Now().Add(-2 * time.Hour),
+		Status: store.FileProcessing}))
+	require.Equal(t, http.StatusOK, serve(t, s, "GET", "/numbers/results/"+unlimited.String(), "", &details))
+	require.Equal(t, store.FileProcessing, details.Status)
+}
+
+// fails once a number of rows of a file have been read
+type failingRowsStorage struct {
+	store.Storage
+	rows int
+}
+
+func (s failingRowsStorage) EachFileRow(ctx context.Context, ref uuid.UUID, category string, fn func(row store.ResultRow) error) error {
+	n := 0
+	return s.Storage.EachFileRow(ctx, ref, category, func(row store.ResultRow) error {
+		if n == s.rows {
+			return errors.New("connection reset")
+		}
+		n++
+		return fn(row)
+	})
+}
+
+func TestDownloadFailure(t *testing.T) {
+	s := newTestServer(t)
+	target := uploadForDownload(t, s)
+	s.db = failingRowsStorage{Storage: s.db, rows: 2}
+
+	// a failure before anything was sent is reported with an error status
+	var errJSON jsonError
+	require.Equal(t, http.StatusInternalServerError, serve(t, s, "GET", target+"?format=csv", "", &errJSON))
+	require.Equal(t, "download of file "+strings.TrimPrefix(target, "/numbers/")+" failed: connection reset", errJSON.Msg)
+	w := httptest.NewRecorder()
+	s.r.ServeHTTP(w, httptest.NewRequest("GET", target+"?format=csv", nil))
+	require.Equal(t, "application/json; charset=UTF-8", w.Header().Get("Content-Type"))
+	require.Empty(t, w.Header().Get("Content-Disposition"))
+}
+
+func TestDownloadAbortedOnFailure(t *testing.T) {
+	s := newTestServer(t)
+	var body strings.Builder
+	body.WriteString("id,sms_phone\n")
+	for i := 0; i < downloadFlushRows+10; i++ {
+		fmt.Fprintf(&body, "%d,2783%07d\n", i+1, i)
+	}
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", body.String(), &uploaded))
+	s.db = failingRowsStorage{Storage: s.db, rows: downloadFlushRows + 5}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/numbers/"+uploaded.Ref.String()+"?format=csv", nil)
+	// once part of the download was sent, the server closes the connection rather than end the response as if
+	// the download were complete
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() { s.r.ServeHTTP(w, r) })
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "row_id,original")
+	require.NotContains(t, w.Body.String(), fmt.Sprintf("2783%07d", downloadFlushRows+6))
+}
@@ -1,10 +1,84 @@
 package server
 
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
 // helper enabling error message to be returned in JSON format
 type jsonError struct {
 	Msg string `json:"message"`
+	// name and value of the limit an upload exceeded
+	Limit string `json:"limit,omitempty"`
+	Max   int64  `json:"max,omitempty"`
+	// status of a file that cannot be read yet, and why it failed
+	Status string `json:"status,omitempty"`
+	Reason string `json:"error,omitempty"`
 }
 
 func (e *jsonError) Error() string {
 	return e.Msg
 }
+
+// error reported to the client with a specific HTTP status code
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// returns the statusError held by err, if any
+func asStatusError(err error) (*statusError, bool) {
+	var e *statusError
+	return e, errors.As(err, &e)
+}
+
+// returns the HTTP status code carried by err, or fallback if it carries none
+func errorStatus(err error, fallback int) int {
+	if e, ok := asStatusError(err); ok {
+		return e.code
+	}
+	return fallback
+}
+
+// error describing a configured limit exceeded by an upload
+type limitError struct {
+	limit string
+	max   int64
+	msg   string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// reports that an upload exceeded the named limit, as a 413 error
+func newLimitError(limit string, max int64, format string, args ...interface{}) error {
+	return &statusError{
+		code: http.StatusRequestEntityTooLarge,
+		err:  &limitError{limit: limit, max: max, msg: fmt.Sprintf(format, args...)},
+	}
+}
+
+// builds the JSON representation of err returned to the client
+func errorJSON(err error) jsonError {
+	errJSON := jsonError{Msg: err.Error()}
+	var l *limitError
+	if errors.As(err, &l) {
+		errJSON.Limit = l.limit
+		errJSON.Max = l.max
+	}
+	var j *jsonError
+	if errors.As(err, &j) {
+		errJSON.Status, errJSON.Reason = j.Status, j.Reason
+	}
+	return errJSON
+}
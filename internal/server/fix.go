@@ -3,11 +3,12 @@ package server
 import (
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/go-ozzo/ozzo-validation"
 	"github.com/go-ozzo/ozzo-validation/is"
-	log "github.com/sirupsen/logrus"
 )
 
 type requirements struct {
@@ -23,15 +24,56 @@ var lookupRequirements = map[string]requirements{
 	"usa": {countryCode: "1", length: 11},
 }
 
+// version of the rules applied by fix
+// bump this whenever fix changes how numbers are corrected or rejected
+const fixRulesVersion = 2
+
+// reasons a number is rejected for
+const (
+	reasonUnknownCountry = "unknown_country"
+	reasonInvalidLength  = "invalid_length"
+	// the number was turned into scientific notation by a spreadsheet, dropping some of its digits
+	reasonPrecisionLost = "precision_lost"
+	// the number was turned into a decimal with a fractional part
+	reasonNotWholeNumber = "not_whole_number"
+)
+
+// types of change made when fixing a number
+const (
+	changeDecimalsRemoved      = "decimals_removed"
+	changeScientificExpanded   = "scientific_notation_expanded"
+	changeDialingCodePrepended = "dialing_code_prepended"
+	changeNonDigitsRemoved     = "non_digits_removed"
+	changeShortened            = "shortened"
+)
+
+// describes the rules applied when fixing numbers of the given countries
+func fixPolicy(countries map[string]bool) string {
+	codes := make([]string, 0, len(countries))
+	for code := range countries {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	policy := fmt.Sprintf("v%d", fixRulesVersion)
+	for _, code := range codes {
+		if req, found := lookupRequirements[code]; found {
+			policy += fmt.Sprintf(";%s:%s:%d", code, req.countryCode, req.length)
+		}
+	}
+	return policy
+}
+
 // fix attempts to fix a given mobile number to adhere to the requirments for a given country
 // if it cannot fix the number, an error is returned
 func (n *mobileNumber) fix() error {
 	// if country IOC code is not found in requirements lookup, this number is rejected
 	req, found := lookupRequirements[n.countryAbbreviation]
 	if !found {
-		n.Valid = false
-		n.FixedNumber = ""
-		return &jsonError{Msg: fmt.Sprintf("country IOC code %s not found in lookup", n.countryAbbreviation)}
+		return n.reject(reasonUnknownCountry, "country IOC code %s not found in lookup", n.countryAbbreviation)
+	}
+
+	if err := n.spreadsheetNumberFix(); err != nil {
+		return err
 	}
 
 	if !n.dialingCodeIsCorrect(req.countryCode) {
@@ -51,12 +93,63 @@ func (n *mobileNumber) fix() error {
 
 	// This number is rejected if to short
 	if n.numberIsTooShort(req.length) {
-		n.Valid = false
 		n.Changes = []string{}
-		n.FixedNumber = ""
-		errString := fmt.Sprintf("invalid length %d, the length must be exactly %d", len(n.NumberProvided), req.length)
-		log.Error(&jsonError{Msg: errString})
-		return &jsonError{Msg: errString}
+		n.changeTypes = nil
+		// not logged, rejections are recorded with the file and logging every one serialises validation
+		return n.reject(reasonInvalidLength, "invalid length %d, the length must be exactly %d", len(n.NumberProvided), req.length)
+	}
+	return nil
+}
+
+// marks the number as rejected for reason, returning the error describing it
+func (n *mobileNumber) reject(reason string, format string, args ...interface{}) error {
+	n.Valid = false
+	n.FixedNumber = ""
+	n.Reason = reason
+	return &jsonError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// records a change of the given type made to the number
+func (n *mobileNumber) change(changeType string, format string, args ...interface{}) {
+	n.Changes = append(n.Changes, fmt.Sprintf(format, args...))
+	n.changeTypes = append(n.changeTypes, changeType)
+}
+
+// matches numbers a spreadsheet turned into a decimal, such as 27821234567.0,
+// or into scientific notation, such as 2.78212E+10
+// a decimal comma is accepted in scientific notation as well as a decimal point
+var spreadsheetNumber = regexp.MustCompile(`^(\d+)(?:[.,](\d*))?(?:[eE]\+?(\d+))?$`)
+
+// restores a number a spreadsheet displayed as a decimal or in scientific notation to its digits
+// scientific notation only keeps the leading digits of a number, so when digits were dropped the number is rejected
+func (n *mobileNumber) spreadsheetNumberFix() error {
+	value := strings.TrimSpace(n.FixedNumber)
+	match := spreadsheetNumber.FindStringSubmatch(value)
+	// a comma without an exponent is as likely to group digits as to start decimals
+	if match == nil || match[0] == match[1] || (match[3] == "" && strings.Contains(value, ",")) {
+		return nil
+	}
+	whole, fraction, exponent := match[1], match[2], 0
+	if match[3] != "" {
+		exponent, _ = strconv.Atoi(match[3])
+	}
+	digits := whole + fraction
+	// digits after the decimal point once the exponent moved it
+	decimals := len(fraction) - exponent
+	switch {
+	case decimals > 0 && strings.Trim(digits[len(digits)-decimals:], "0") != "":
+		return n.reject(reasonNotWholeNumber, "number %s is not a whole number", n.NumberProvided)
+	case decimals > 0:
+		digits = digits[:len(digits)-decimals]
+	case decimals < 0 && match[3] != "":
+		return n.reject(reasonPrecisionLost, "number %s is in scientific notation and lost its last %d digits", n.NumberProvided, -decimals)
+	}
+	n.Valid = false
+	n.FixedNumber = digits
+	if match[3] != "" {
+		n.change(changeScientificExpanded, "expanded scientific notation %s", value)
+	} else {
+		n.change(changeDecimalsRemoved, "removed decimals from %s", value)
 	}
 	return nil
 }
@@ -67,7 +160,7 @@ func (n *mobileNumber) dialingCodeIsCorrect(code string) bool {
 
 func (n *mobileNumber) prependDialingCodeFix(code string) {
 	n.FixedNumber = fmt.Sprintf("%s%s", code, n.FixedNumber)
-	n.Changes = append(n.Changes, fmt.Sprintf("prepended number with %s", code))
+	n.change(changeDialingCodePrepended, "prepended number with %s", code)
 }
 
 func (n *mobileNumber) onlyDigitsInNumber() bool {
@@ -78,13 +171,12 @@ func (n *mobileNumber) onlyDigitsInNumber() bool {
 	return true
 }
 
+// matches runs of non digit characters
+var nonDigits = regexp.MustCompile("[^0-9]+")
+
 func (n *mobileNumber) removeNonDigitsFix() {
-	reg, err := regexp.Compile("[^0-9]+")
-	if err != nil {
-		log.Error("unable to gererate regex")
-	}
-	n.FixedNumber = reg.ReplaceAllString(n.FixedNumber, "")
-	n.Changes = append(n.Changes, "removed non digits from number")
+	n.FixedNumber = nonDigits.ReplaceAllString(n.FixedNumber, "")
+	n.change(changeNonDigitsRemoved, "removed non digits from number")
 }
 
 func (n *mobileNumber) numberIsTooLong(requiredLength int) bool {
@@ -94,8 +186,7 @@ func (n *mobileNumber) numberIsTooLong(requiredLength int) bool {
 func (n *mobileNumber) shortenNumberFix(requiredLength int) {
 	digitsToRemove := n.FixedNumber[requiredLength:len(n.FixedNumber)]
 	n.FixedNumber = n.FixedNumber[0:requiredLength]
-	changeString := fmt.Sprintf("shortened number by removing %s", digitsToRemove)
-	n.Changes = append(n.Changes, changeString)
+	n.change(changeShortened, "shortened number by removing %s", digitsToRemove)
 }
 
 func (n *mobileNumber) numberIsTooShort(requiredLength int) bool {
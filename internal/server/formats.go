@@ -0,0 +1,388 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// Content-Type of XLSX workbooks
+const xlsxFormat = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// a format a processed file can be downloaded in
+type downloadFormat struct {
+	// value of the format parameter selecting the format, and extension of the downloaded file
+	name        string
+	contentType string
+	// starts writing records of the given columns, the numbers layout of the json format being store.FileResults instead
+	newRecordWriter func(w io.Writer, columns []string) (recordWriter, error)
+}
+
+// formats a processed file can be downloaded in, the first being the default
+var downloadFormats = []downloadFormat{
+	{"json", jsonFormat, newJSONRecordWriter},
+	{"csv", csvFormat, newCSVRecordWriter},
+	{"ndjson", ndjsonFormat, func(w io.Writer, columns []string) (recordWriter, error) {
+		return &ndjsonRecordWriter{w: w, columns: columns}, nil
+	}},
+	{"xlsx", xlsxFormat, newXLSXRecordWriter},
+}
+
+// media types accepted for a download format other than its own Content-Type, by format
+var downloadMediaTypeAliases = map[string]string{
+	"*/*":                "json",
+	"application/*":      "json",
+	"text/*":             "csv",
+	"application/csv":    "csv",
+	"application/ndjson": "ndjson",
+	"application/jsonl":  "ndjson",
+}
+
+// returns the download format of the given name, or nil if there is none
+func findDownloadFormat(name string) *downloadFormat {
+	for i := range downloadFormats {
+		if downloadFormats[i].name == name {
+			return &downloadFormats[i]
+		}
+	}
+	return nil
+}
+
+// chooses the format of a download from the format parameter, falling back to the Accept header
+// a download is in JSON when neither is given
+func negotiateDownloadFormat(r *http.Request) (*downloadFormat, error) {
+	if name := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format"))); name != "" {
+		if format := findDownloadFormat(name); format != nil {
+			return format, nil
+		}
+		return nil, &statusError{code: http.StatusBadRequest, err: &jsonError{
+			Msg: fmt.Sprintf("unsupported format %s, expected json, csv, ndjson or xlsx", name)}}
+	}
+	accept := strings.TrimSpace(r.Header.Get("Accept"))
+	if accept == "" {
+		return &downloadFormats[0], nil
+	}
+	for _, mediaType := range acceptedMediaTypes(accept) {
+		for i := range downloadFormats {
+			if downloadFormats[i].contentType == mediaType {
+				return &downloadFormats[i], nil
+			}
+		}
+		if name, found := downloadMediaTypeAliases[mediaType]; found {
+			return findDownloadFormat(name), nil
+		}
+	}
+	return nil, &statusError{code: http.StatusNotAcceptable, err: &jsonError{
+		Msg: fmt.Sprintf("cannot produce any of %s, expected %s, %s, %s or %s", accept, jsonFormat, csvFormat, ndjsonFormat, xlsxFormat)}}
+}
+
+// lists the media types of an Accept header from the most to the least preferred
+// media types with a quality of 0 are not acceptable, and left out
+func acceptedMediaTypes(accept string) []string {
+	type accepted struct {
+		mediaType string
+		quality   float64
+	}
+	var types []accepted
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, found := params["q"]; found {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			types = append(types, accepted{mediaType, quality})
+		}
+	}
+	sort.SliceStable(types, func(i, j int) bool { return types[i].quality > types[j].quality })
+	mediaTypes := make([]string, len(types))
+	for i, t := range types {
+		mediaTypes[i] = t.mediaType
+	}
+	return mediaTypes
+}
+
+// layouts of a download
+const (
+	// the numbers of a file, in the order of the file
+	numbersLayout = "numbers"
+	// the rows of the uploaded file, in its order, followed by inputColumns
+	inputLayout = "input"
+)
+
+// chooses the layout of a download of file from the layout parameter, the numbers of the file by default
+// files processed before their rows were kept can only be downloaded as numbers
+func downloadLayout(r *http.Request, file *store.File) (string, error) {
+	switch layout := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("layout"))); layout {
+	case "", numbersLayout:
+		return numbersLayout, nil
+	case inputLayout:
+		if len(file.SourceColumns) == 0 {
+			return "", &statusError{code: http.StatusConflict, err: &jsonError{
+				Msg: fmt.Sprintf("file %s was processed before its rows were kept, upload it again to use the input layout", file.Ref)}}
+		}
+		return inputLayout, nil
+	default:
+		return "", &statusError{code: http.StatusBadRequest, err: &jsonError{
+			Msg: fmt.Sprintf("unsupported layout %s, expected numbers or input", layout)}}
+	}
+}
+
+// columns of the CSV, NDJSON and XLSX downloads, followed by the passthrough columns of the file
+var downloadColumns = []string{"row_id", "original", "fixed", "status", "changes", "reason"}
+
+// a number of a download in the CSV, NDJSON or XLSX format, in the order of downloadColumns
+type downloadRecord struct {
+	// row of the uploaded file, followed by the position of the number for a cell holding several, as in 4.2
+	RowID    string
+	Original string
+	Fixed    string
+	// category of the number
+	Status  string
+	Changes string
+	Reason  string
+}
+
+func newDownloadRecord(row store.ResultRow) downloadRecord {
+	rowID := strconv.Itoa(row.RowNumber)
+	if row.Part > 0 {
+		rowID += "." + strconv.Itoa(row.Part)
+	}
+	return downloadRecord{
+		RowID:    rowID,
+		Original: row.Number,
+		Fixed:    row.FixedNumber,
+		Status:   row.Category,
+		Changes:  row.Changes,
+		Reason:   row.Reason,
+	}
+}
+
+func (r downloadRecord) values() []string {
+	return []string{r.RowID, r.Original, r.Fixed, r.Status, r.Changes, r.Reason}
+}
+
+// columns following the cells of each row of the uploaded file in the input layout
+var inputColumns = []string{"status", "normalized_number", "changes", "reason"}
+
+// the values of inputColumns for the numbers read from a row
+// the values of the numbers of a cell holding several are joined, in the order of the numbers
+func inputValues(numbers []store.ResultRow) []string {
+	fields := []func(row store.ResultRow) string{
+		func(row store.ResultRow) string { return row.Category },
+		func(row store.ResultRow) string { return row.FixedNumber },
+		func(row store.ResultRow) string { return row.Changes },
+		func(row store.ResultRow) string { return row.Reason },
+	}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		parts := make([]string, len(numbers))
+		empty := true
+		for j, row := range numbers {
+			parts[j] = field(row)
+			empty = empty && parts[j] == ""
+		}
+		if !empty {
+			values[i] = strings.Join(parts, "; ")
+		}
+	}
+	return values
+}
+
+// writes the records of a download in one of its formats
+type recordWriter interface {
+	Write(values []string) error
+	// writes anything buffered, and whatever ends the download
+	Close() error
+}
+
+// streams the numbers of a file in the order of the file, as records of downloadColumns and the passthrough columns
+func (s *Server) writeRecords(ctx context.Context, d *downloadWriter, file *store.File,
+	newRecordWriter func(w io.Writer, columns []string) (recordWriter, error)) error {
+	rw, err := newRecordWriter(d, append(append([]string{}, downloadColumns...), file.PassthroughColumns...))
+	if err != nil {
+		return err
+	}
+	err = s.db.EachFileRow(ctx, file.Ref, "", func(row store.ResultRow) error {
+		values := newDownloadRecord(row).values()
+		for _, column := range file.PassthroughColumns {
+			values = append(values, row.Passthrough[column])
+		}
+		if err := rw.Write(values); err != nil {
+			return err
+		}
+		return d.rowWritten()
+	})
+	if err != nil {
+		return err
+	}
+	if err := rw.Close(); err != nil {
+		return err
+	}
+	return d.Flush()
+}
+
+// streams the rows of the uploaded file in its order, each followed by inputColumns describing its numbers
+func (s *Server) writeInputRecords(ctx context.Context, d *downloadWriter, file *store.File,
+	newRecordWriter func(w io.Writer, columns []string) (recordWriter, error)) error {
+	rw, err := newRecordWriter(d, append(append([]string{}, file.SourceColumns...), inputColumns...))
+	if err != nil {
+		return err
+	}
+	err = s.db.EachInputRow(ctx, file.Ref, func(row store.InputRow, numbers []store.ResultRow) error {
+		values := append(make([]string, len(file.SourceColumns), len(file.SourceColumns)+len(inputColumns)), inputValues(numbers)...)
+		copy(values[:len(file.SourceColumns)], row.Cells)
+		if err := rw.Write(values); err != nil {
+			return err
+		}
+		return d.rowWritten()
+	})
+	if err != nil {
+		return err
+	}
+	if err := rw.Close(); err != nil {
+		return err
+	}
+	return d.Flush()
+}
+
+// writes records as CSV lines, after a line naming the columns
+type csvRecordWriter struct {
+	w *csv.Writer
+}
+
+func newCSVRecordWriter(w io.Writer, columns []string) (recordWriter, error) {
+	c := &csvRecordWriter{csv.NewWriter(w)}
+	return c, c.Write(columns)
+}
+
+func (c *csvRecordWriter) Write(values []string) error {
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = escapeFormula(value)
+	}
+	return c.w.Write(escaped)
+}
+
+// a phone number in international format, which a spreadsheet can only read as a number, never as a formula calling anything
+var internationalNumber = regexp.MustCompile(`^\+[\d ()-]+$`)
+
+// prefixes a value a spreadsheet would read as a formula with a quote, for a CSV download opened in a
+// spreadsheet to show the value rather than run it
+// phone numbers such as +27831234567 are left as they are, for tools reading the download to get them back
+func escapeFormula(value string) string {
+	if value == "" || !strings.ContainsRune("=+-@\t\r", rune(value[0])) || internationalNumber.MatchString(value) {
+		return value
+	}
+	return "'" + value
+}
+
+func (c *csvRecordWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// writes records as JSON objects, one per line
+type ndjsonRecordWriter struct {
+	w       io.Writer
+	columns []string
+}
+
+func (n *ndjsonRecordWriter) Write(values []string) error {
+	if err := writeJSONObject(n.w, n.columns, values); err != nil {
+		return err
+	}
+	_, err := io.WriteString(n.w, "\n")
+	return err
+}
+
+func (n *ndjsonRecordWriter) Close() error {
+	return nil
+}
+
+// writes records as a JSON array of objects
+type jsonRecordWriter struct {
+	w       io.Writer
+	columns []string
+	records int
+}
+
+func newJSONRecordWriter(w io.Writer, columns []string) (recordWriter, error) {
+	_, err := io.WriteString(w, "[")
+	return &jsonRecordWriter{w: w, columns: columns}, err
+}
+
+func (j *jsonRecordWriter) Write(values []string) error {
+	if j.records > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.records++
+	return writeJSONObject(j.w, j.columns, values)
+}
+
+func (j *jsonRecordWriter) Close() error {
+	_, err := io.WriteString(j.w, "]\n")
+	return err
+}
+
+// writes a JSON object holding values under the names of columns, keeping the order of columns
+func writeJSONObject(w io.Writer, columns []string, values []string) error {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, column := range columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(column)
+		buf.Write(name)
+		buf.WriteByte(':')
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		data, _ := json.Marshal(value)
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writes records as the rows of a workbook, each sheet starting with a row naming the columns
+type xlsxRecordWriter struct {
+	x *xlsxWriter
+}
+
+func newXLSXRecordWriter(w io.Writer, columns []string) (recordWriter, error) {
+	x, err := newXLSXWriter(w, columns)
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxRecordWriter{x}, nil
+}
+
+func (x *xlsxRecordWriter) Write(values []string) error {
+	return x.x.Write(values)
+}
+
+func (x *xlsxRecordWriter) Close() error {
+	return x.x.Close()
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+func TestNegotiateDownloadFormat(t *testing.T) {
+	tests := []struct {
+		query  string
+		accept string
+		format string
+		code   int
+	}{
+		{format: "json"},
+		{query: "format=csv", format: "csv"},
+		{query: "format=XLSX", accept: "text/csv", format: "xlsx"},
+		{query: "format=ndjson", format: "ndjson"},
+		{query: "format=xml", code: http.StatusBadRequest},
+		{accept: "text/csv", format: "csv"},
+		{accept: "application/x-ndjson", format: "ndjson"},
+		{accept: "application/ndjson", format: "ndjson"},
+		{accept: xlsxFormat, format: "xlsx"},
+		{accept: "application/json; charset=UTF-8", format: "json"},
+		{accept: "text/html, application/xhtml+xml, */*;q=0.8", format: "json"},
+		{accept: "text/csv;q=0.5, " + xlsxFormat, format: "xlsx"},
+		{accept: "text/*", format: "csv"},
+		{accept: "text/html", code: http.StatusNotAcceptable},
+		{accept: "text/csv;q=0", code: http.StatusNotAcceptable},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/numbers/ref?"+test.query, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		format, err := negotiateDownloadFormat(r)
+		if test.code != 0 {
+			require.Equal(t, test.code, errorStatus(err, 0), "%s %s", test.query, test.accept)
+			continue
+		}
+		require.NoError(t, err, "%s %s", test.query, test.accept)
+		require.Equal(t, test.format, format.name, "%s %s", test.query, test.accept)
+	}
+}
+
+// uploads numbers of every category, including a cell holding two numbers, and returns the download URL
+func uploadForDownload(t *testing.T, s *Server) string {
+	body := "id,sms_phone\n1,27831234567\n2,831234568\n3,123\n4,27831234567 / 27831234569\n"
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", body, &uploaded))
+	return "/numbers/" + uploaded.Ref.String()
+}
+
+// the records every download format holds for the numbers of uploadForDownload
+var expectedDownloadRecords = [][]string{
+	{"1", "27831234567", "27831234567", "valid", "", ""},
+	{"2", "831234568", "27831234568", "fixed", "prepended number with 27", ""},
+	{"3", "123", "", "rejected", "", reasonInvalidLength},
+	{"4.1", "27831234567", "27831234567", "duplicate", "", ""},
+	{"4.2", "27831234569", "27831234569", "valid", "", ""},
+}
+
+// downloads target, checking the headers describe the format
+func download(t *testing.T, s *Server, target string, accept string, contentType string, extension string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", target, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	s.r.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, contentType, w.Header().Get("Content-Type"))
+	ref := strings.TrimPrefix(strings.SplitN(target, "?", 2)[0], "/numbers/")
+	require.Equal(t, "Attachment; filename="+ref+"."+extension, w.Header().Get("Content-Disposition"))
+	require.Equal(t, "Accept", w.Header().Get("Vary"))
+	return w
+}
+
+func TestDownloadCSV(t *testing.T) {
+	s := newTestServer(t)
+	target := uploadForDownload(t, s)
+	for _, w := range []*httptest.ResponseRecorder{
+		download(t, s, target+"?format=csv", "", "text/csv; charset=UTF-8", "csv"),
+		download(t, s, target, "text/csv", "text/csv; charset=UTF-8", "csv"),
+	} {
+		records, err := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, err)
+		require.Equal(t, append([][]string{downloadColumns}, expectedDownloadRecords...), records)
+	}
+}
+
+func TestDownloadNDJSON(t *testing.T) {
+	s := newTestServer(t)
+	target := uploadForDownload(t, s)
+	w := download(t, s, target, "application/x-ndjson", ndjsonFormat, "ndjson")
+	var records [][]string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var record map[string]string
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		require.Len(t, record, len(downloadColumns))
+		values := make([]string, len(downloadColumns))
+		for i, column := range downloadColumns {
+			values[i] = record[column]
+		}
+		records = append(records, values)
+	}
+	require.Equal(t, expectedDownloadRecords, records)
+}
+
+func TestDownloadXLSX(t *testing.T) {
+	s := newTestServer(t)
+	target := uploadForDownload(t, s)
+	w := download(t, s, target+"?format=xlsx", "", xlsxFormat, "xlsx")
+	require.Equal(t, append([][]string{downloadColumns}, expectedDownloadRecords...), readXLSX(t, w.Body.Bytes()))
+}
+
+func TestDownloadUnsupportedFormat(t *testing.T) {
+	s := newTestServer(t)
+	target := uploadForDownload(t, s)
+	var errJSON jsonError
+	require.Equal(t, http.StatusBadRequest, serve(t, s, "GET", target+"?format=xml", "", &errJSON))
+	require.Equal(t, "unsupported format xml, expected json, csv, ndjson or xlsx", errJSON.Msg)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", target, nil)
+	r.Header.Set("Accept", "text/html")
+	s.r.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotAcceptable, w.Code)
+}
+
+// the records of the input layout of the upload of uploadForDownload, after a record naming the columns
+var expectedInputRecords = [][]string{
+	{"id", "sms_phone", "status", "normalized_number", "changes", "reason"},
+	{"1", "27831234567", "valid", "27831234567", "", ""},
+	{"2", "831234568", "fixed", "27831234568", "prepended number with 27", ""},
+	{"3", "123", "rejected", "", "", reasonInvalidLength},
+	{"4", "27831234567 / 27831234569", "duplicate; valid", "27831234567; 27831234569", "", ""},
+}
+
+func TestDownloadInputLayout(t *testing.T) {
+	s := newTestServer(t)
+	target := uploadForDownload(t, s) + "?layout=input"
+
+	w := download(t, s, target+"&format=csv", "", "text/csv; charset=UTF-8", "csv")
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, expectedInputRecords, records)
+
+	w = download(t, s, target+"&format=xlsx", "", xlsxFormat, "xlsx")
+	require.Equal(t, expectedInputRecords, readXLSX(t, w.Body.Bytes()))
+
+	// objects keep the order of the columns
+	w = download(t, s, target, "application/x-ndjson", ndjsonFormat, "ndjson")
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	require.Equal(t, `{"id":"1","sms_phone":"27831234567","status":"valid","normalized_number":"27831234567","changes":"","reason":""}`,
+		lines[0])
+
+	w = download(t, s, target, "", "application/json; charset=UTF-8", "json")
+	var objects []map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &objects), w.Body.String())
+	require.Len(t, objects, 4)
+	for i, object := range objects {
+		require.Len(t, object, len(expectedInputRecords[0]))
+		for j, column := range expectedInputRecords[0] {
+			require.Equal(t, expectedInputRecords[i+1][j], object[column])
+		}
+	}
+}
+
+func TestDownloadInputLayoutUnavailable(t *testing.T) {
+	s := newTestServer(t)
+	target := uploadForDownload(t, s)
+	var errJSON jsonError
+	require.Equal(t, http.StatusBadRequest, serve(t, s, "GET", target+"?layout=columns", "", &errJSON))
+	require.Equal(t, "unsupported layout columns, expected numbers or input", errJSON.Msg)
+
+	// files processed before their rows were kept have no source columns
+	ref, err := generateHash()
+	require.NoError(t, err)
+	require.NoError(t, s.db.CreateFile(store.File{Ref: ref, UploadedAt: time.Now(), Status: store.FileProcessing}))
+	require.NoError(t, s.db.SaveProcessedFile(ref, func(w store.FileWriter) error {
+		return w.SaveNumbers([]store.Number{{Number: "27831234567", FileRef: ref, SourceRow: store.SourceRow{RowNumber: 1}}})
+	}))
+	require.Equal(t, http.StatusConflict, serve(t, s, "GET", "/numbers/"+ref.String()+"?layout=input", "", &errJSON))
+	require.Equal(t, http.StatusOK, serve(t, s, "GET", "/numbers/"+ref.String()+"?layout=numbers&format=csv", "", nil))
+}
+
+func TestInputLayoutOfReupload(t *testing.T) {
+	s := newTestServer(t)
+	var first, second fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", "id,sms_phone,name\n1,27831234567,Ann\n", &first))
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", "id,sms_phone,name\n1,27831234567,Bob\n", &second))
+	require.False(t, second.AlreadyProcessed)
+	require.NotEqual(t, first.Ref, second.Ref)
+
+	w := download(t, s, "/numbers/"+second.Ref.String()+"?layout=input&format=csv", "", "text/csv; charset=UTF-8", "csv")
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "27831234567", "Bob", "valid", "27831234567", "", ""}, records[1])
+}
+
+func TestDownloadCSVEscapesFormulas(t *testing.T) {
+	s := newTestServer(t)
+	body := "id,sms_phone,name\n1,27831234567,=1+1\n2,=HYPERLINK(1),@SUM(A1)\n3,27831234568,-2+A1\n4,+27831234569,+A1\n" +
+		"5,27831234560,\tx\n6,+27 (83) 123-4561,+27831234562\n"
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", body, &uploaded))
+	target := "/numbers/" + uploaded.Ref.String()
+
+	w := download(t, s, target+"?layout=input&format=csv", "", "text/csv; charset=UTF-8", "csv")
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	names := []string{}
+	for _, record := range records[1:] {
+		names = append(names, record[2])
+	}
+	require.Equal(t, []string{"'=1+1", "'@SUM(A1)", "'-2+A1", "'+A1", "'\tx", "+27831234562"}, names)
+	require.Equal(t, "'=HYPERLINK(1)", records[2][1])
+	// phone numbers in international format are kept as uploaded
+	require.Equal(t, "+27831234569", records[4][1])
+	require.Equal(t, "+27 (83) 123-4561", records[6][1])
+
+	w = download(t, s, target+"?format=csv", "", "text/csv; charset=UTF-8", "csv")
+	records, err = csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "'=HYPERLINK(1)", records[2][1])
+	require.Equal(t, "+27831234569", records[4][1])
+
+	// other formats keep the values as uploaded
+	w = download(t, s, target+"?layout=input", "application/x-ndjson", ndjsonFormat, "ndjson")
+	require.Contains(t, w.Body.String(), `"name":"=1+1"`)
+}
+
+func TestDownloadPassthroughColumns(t *testing.T) {
+	s := newTestServer(t)
+	body := "id,sms_phone,name,team\n1,27831234567,Ann,red\n2,123,Bob,\n"
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers?passthrough=name,team", body, &uploaded))
+	target := "/numbers/" + uploaded.Ref.String()
+	expected := [][]string{
+		append(append([]string{}, downloadColumns...), "name", "team"),
+		{"1", "27831234567", "27831234567", "valid", "", "", "Ann", "red"},
+		{"2", "123", "", "rejected", "", reasonInvalidLength, "Bob", ""},
+	}
+
+	w := download(t, s, target+"?format=csv", "", "text/csv; charset=UTF-8", "csv")
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, expected, records)
+
+	w = download(t, s, target+"?format=xlsx", "", xlsxFormat, "xlsx")
+	require.Equal(t, expected, readXLSX(t, w.Body.Bytes()))
+
+	w = download(t, s, target+"?format=ndjson", "", ndjsonFormat, "ndjson")
+	require.Equal(t, `{"row_id":"1","original":"27831234567","fixed":"27831234567","status":"valid","changes":"","reason":"",`+
+		`"name":"Ann","team":"red"}`, strings.SplitN(w.Body.String(), "\n", 2)[0])
+}
@@ -1,10 +1,11 @@
 package server
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/mux"
@@ -13,9 +14,47 @@ import (
 )
 
 type fileData struct {
-	Ref   uuid.UUID   `json:"ref"`
-	Stats store.Stats `json:"stats"`
-	Href  string      `json:"href"`
+	Ref        uuid.UUID `json:"ref"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	Label      string    `json:"label,omitempty"`
+	Country    string    `json:"country,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	// number of rows read from the upload
+	Rows         int                 `json:"rows"`
+	FixPolicy    string              `json:"fix_policy,omitempty"`
+	RulesVersion int                 `json:"rules_version,omitempty"`
+	Stats        store.Stats         `json:"stats"`
+	Members      []store.MemberStats `json:"members,omitempty"`
+	// number of cells holding several numbers, which were split into one number each
+	SplitCells int    `json:"split_cells,omitempty"`
+	Href       string `json:"href"`
+	// set when the uploaded content matched a previously processed file, which is returned instead
+	AlreadyProcessed bool `json:"already_processed,omitempty"`
+}
+
+// describes a file record and the stats of its numbers
+// the stats of the members of a zip archive, saved with the stats of the file, are reported on their own
+func newFileData(file *store.File, stats store.Stats) *fileData {
+	members := stats.Members
+	stats.Members = nil
+	return &fileData{
+		Ref:          file.Ref,
+		Status:       file.Status,
+		Error:        file.Error,
+		Filename:     file.Filename,
+		Label:        file.Label,
+		Country:      file.Country,
+		UploadedAt:   file.UploadedAt,
+		Rows:         file.RowCount,
+		FixPolicy:    file.FixPolicy,
+		RulesVersion: file.RulesVersion,
+		Stats:        stats,
+		Members:      members,
+		SplitCells:   file.SplitCells,
+		Href:         buildHref(url, port, file.Ref.String()),
+	}
 }
 
 // Query server to generate statistical information about a previously processed file
@@ -27,20 +66,71 @@ func (s *Server) getFileDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		handleError(w, err, http.StatusInternalServerError)
 		return
 	}
-	stats, err := s.db.GetFileStats(refUUID)
+	resp, err := s.fileDetails(refUUID)
 	if err != nil {
 		handleError(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	json.NewEncoder(w).Encode(fileData{
-		Ref:   refUUID,
-		Stats: *stats,
-		Href:  buildHref(url, port, ref),
-	})
+	json.NewEncoder(w).Encode(resp)
+}
+
+// gathers the statistics and upload metadata of a previously processed file
+func (s *Server) fileDetails(ref uuid.UUID) (*fileData, error) {
+	file, err := s.getFile(ref)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := s.db.GetFileStats(ref)
+	if err != nil {
+		return nil, err
+	}
+	return newFileData(file, *stats), nil
+}
+
+// error recorded for files processing for longer than the processing timeout
+const processingTimedOut = "processing did not finish in time, it was likely interrupted by a restart of the server"
+
+// queries the record of a file, failing with a 404 error for an unknown ref
+// a file processing for longer than the processing timeout is marked as failed, as a server stopping while it processed
+// a file leaves it processing
+func (s *Server) getFile(ref uuid.UUID) (*store.File, error) {
+	file, err := s.db.GetFile(ref)
+	if err == sql.ErrNoRows {
+		return nil, &statusError{code: http.StatusNotFound, err: fmt.Errorf("file %s not found", ref)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	timeout := s.cfg.ProcessingTimeout
+	if file.Status == store.FileProcessing && timeout > 0 && time.Since(file.UploadedAt) > timeout {
+		if err := s.db.FailFile(ref, processingTimedOut); err != nil {
+			return nil, err
+		}
+		return s.db.GetFile(ref)
+	}
+	return file, nil
+}
+
+// looks up a file whose numbers can be read
+// files still being processed, or that failed, are reported with a 409 error naming their status
+func (s *Server) getCompletedFile(ref uuid.UUID) (*store.File, error) {
+	file, err := s.getFile(ref)
+	if err != nil {
+		return nil, err
+	}
+	if file.Status != store.FileCompleted {
+		return nil, &statusError{code: http.StatusConflict, err: &jsonError{
+			Msg:    fmt.Sprintf("file %s is %s", ref, file.Status),
+			Status: file.Status,
+			Reason: file.Error,
+		}}
+	}
+	return file, nil
 }
 
 // return downloadable data from previously processed file
+// the numbers are streamed to the client as they are read, and reading stops if the client goes away
 func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	ref := vars["ref"]
@@ -49,12 +139,55 @@ func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
 		handleError(w, err, http.StatusInternalServerError)
 		return
 	}
-	res, err := s.db.GetFileResults(refUUID)
+	file, err := s.getCompletedFile(refUUID)
 	if err != nil {
 		handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	format, err := negotiateDownloadFormat(r)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	layout, err := downloadLayout(r, file)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	contentType := format.contentType
+	if format.name == "json" || format.name == "csv" {
+		contentType += "; charset=UTF-8"
 	}
-	w.Header().Add("Content-Disposition", fmt.Sprintf("Attachment; filename=%s.json", ref))
-	json.NewEncoder(w).Encode(res)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Content-Disposition", fmt.Sprintf("Attachment; filename=%s.%s", ref, format.name))
+	w.Header().Set("Vary", "Accept")
+	// the status is sent with the first bytes of the download, so failures past this point cut the download short
+	d := newDownloadWriter(w)
+	switch {
+	case layout == inputLayout:
+		err = s.writeInputRecords(r.Context(), d, file, format.newRecordWriter)
+	case format.name == "json":
+		err = s.writeJSONDownload(r.Context(), d, file)
+	default:
+		err = s.writeRecords(r.Context(), d, file, format.newRecordWriter)
+	}
+	if r.Context().Err() != nil {
+		log.Infof("download of file %s cancelled by the client", ref)
+		return
+	}
+	if err == nil {
+		return
+	}
+	// nothing was sent yet, so the failure can still be reported with an error status
+	if !d.started() {
+		w.Header().Del("Content-Disposition")
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		handleError(w, fmt.Errorf("download of file %s failed: %v", ref, err), http.StatusInternalServerError)
+		return
+	}
+	log.Errorf("download of file %s failed: %v", ref, err)
+	// the download cannot be finished, so the connection is closed for the client not to take it as complete
+	panic(http.ErrAbortHandler)
 }
 
 // test validity of a single mobile number
@@ -78,82 +211,123 @@ func testNumberHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(num)
 }
 
-// process a CSV payload of mobile numbers
+// process a CSV, JSON or NDJSON payload of mobile numbers, optionally gzip or zip compressed
 func (s *Server) storeNumbersHandler(w http.ResponseWriter, r *http.Request) {
-	var (
-		numbers         []store.Number
-		fixedNumbers    []store.FixedNumber
-		rejectedNumbers []store.RejectedNumber
-	)
 	vars := mux.Vars(r)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	csvPayload, err := readCSVFromHttpRequest(r)
+	limitRequestBody(r, s.cfg.MaxUploadBytes)
+	up, err := parseUpload(r, vars["countryAbbreviation"])
 	if err != nil {
 		handleError(w, err, http.StatusBadRequest)
 		return
 	}
-	hash, err := generateHash(csvPayload)
+	defer up.Close()
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	s.ingestUpload(w, r, up)
+}
+
+// reads, validates and stores the rows of an upload, writing the usual upload response
+// uploads seen before are answered from the earlier results, and async uploads are queued as jobs
+// reports whether the upload was accepted
+func (s *Server) ingestUpload(w http.ResponseWriter, r *http.Request, up *upload) (accepted bool) {
+	rows, err := spoolUploadRows(up, s.cfg)
 	if err != nil {
-		handleError(w, err, http.StatusInternalServerError)
+		handleError(w, err, http.StatusBadRequest)
+		return false
 	}
-	fmt.Println(hash)
-	for i, row := range csvPayload {
-		if i == 0 {
-			continue // skip first row
+	// the rows of an async upload are released by its job once processed
+	queued := false
+	defer func() {
+		if !queued {
+			rows.Close()
 		}
-		num, err := newMobileNumber(vars["countryAbbreviation"], row[1])
+	}()
+	contentFingerprint := rows.fingerprint
+	key := idempotencyKey(r)
+	if key != "" {
+		replayed, err := s.reserveIdempotencyKey(w, key, contentFingerprint)
 		if err != nil {
-			rejectedNumber := store.RejectedNumber{
-				Number:  num.NumberProvided,
-				FileRef: hash,
-			}
-			rejectedNumbers = append(rejectedNumbers, rejectedNumber)
-			continue
+			handleError(w, err, http.StatusInternalServerError)
+			return false
+		}
+		if replayed {
+			return true
 		}
-		if num.Valid {
-			number := store.Number{
-				Number:         num.NumberProvided,
-				FileRef:        hash,
-				CountryIOCCode: vars["countryAbbreviation"],
+		defer func() {
+			if !accepted {
+				s.releaseIdempotencyKey(key)
 			}
-			numbers = append(numbers, number)
-			continue
+		}()
+	}
+	// content that was processed before is not processed again, unless forced
+	if !up.force {
+		existing, err := s.db.FindFileByFingerprint(contentFingerprint)
+		if err != nil && err != sql.ErrNoRows {
+			handleError(w, err, http.StatusInternalServerError)
+			return false
 		}
-		fixedNumber := store.FixedNumber{
-			OriginalNumber: num.NumberProvided,
-			FixedNumber:    num.FixedNumber,
-			Changes:        strings.Join(num.Changes, (", ")),
-			FileRef:        hash,
+		if existing != nil {
+			resp, err := s.fileDetails(existing.Ref)
+			if err != nil {
+				handleError(w, err, http.StatusInternalServerError)
+				return false
+			}
+			resp.AlreadyProcessed = true
+			s.writeUploadResponse(w, key, contentFingerprint, http.StatusOK, resp.Ref, resp)
+			return true
 		}
-		fixedNumbers = append(fixedNumbers, fixedNumber)
 	}
-
-	err = s.db.SaveNumbers(numbers)
-	if err != nil {
+	client, day := clientID(r), time.Now().UTC()
+	if err := s.reserveRowQuota(client, day, rows.count); err != nil {
 		handleError(w, err, http.StatusInternalServerError)
-		return
+		return false
+	}
+	if up.async {
+		job, err := s.jobs.submit(func(progress func(processed int)) (*fileData, error) {
+			defer rows.Close()
+			resp, err := s.processFile(up, rows, progress)
+			if err != nil {
+				s.releaseRowQuota(client, day, rows.count)
+			}
+			return resp, err
+		}, rows.count)
+		if err != nil {
+			s.releaseRowQuota(client, day, rows.count)
+			handleError(w, err, http.StatusInternalServerError)
+			return false
+		}
+		queued = true
+		w.Header().Set("Location", job.Href)
+		s.writeUploadResponse(w, key, contentFingerprint, http.StatusAccepted, uuid.Nil, job)
+		return true
 	}
-	err = s.db.SaveFixedNumbers(fixedNumbers)
+	resp, err := s.processFile(up, rows, nil)
 	if err != nil {
+		s.releaseRowQuota(client, day, rows.count)
 		handleError(w, err, http.StatusInternalServerError)
-		return
+		return false
 	}
-	err = s.db.SaveRejectedNumbers(rejectedNumbers)
+	s.writeUploadResponse(w, key, contentFingerprint, http.StatusOK, resp.Ref, resp)
+	return true
+}
+
+// report the state of an asynchronous upload job
+func (s *Server) getJobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	id, err := uuid.FromString(vars["id"])
 	if err != nil {
-		handleError(w, err, http.StatusInternalServerError)
+		handleError(w, err, http.StatusBadRequest)
 		return
 	}
-	resp := fileData{
-		Ref: hash,
-		Stats: store.Stats{
-			ValidNumbersCount:     len(numbers),
-			FixedNumbersCount:     len(fixedNumbers),
-			InvalidNumbersCount:   len(rejectedNumbers),
-			TotalNumbersProcessed: len(numbers) + len(fixedNumbers) + len(rejectedNumbers),
-		},
-		Href: buildHref(url, port, hash.String()),
+	job, found := s.jobs.get(id)
+	if !found {
+		handleError(w, &jsonError{Msg: fmt.Sprintf("job %s not found", id)}, http.StatusNotFound)
+		return
 	}
-	json.NewEncoder(w).Encode(resp)
+	json.NewEncoder(w).Encode(job)
 }
 
 // helpfer function to build URL that user can use in future call
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// header clients set to make upload requests safe to retry
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// returns the idempotency key of the request, or an empty string if none was given
+func idempotencyKey(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+}
+
+// reserves an idempotency key for the upload, before it is processed, so concurrent retries do not process it again
+// a reservation older than the pending timeout was abandoned by an upload that never answered, and is taken over
+// when the key was used within the retention window, the response recorded for it is replayed instead
+// reports whether a response was written to w
+// a key reused for a different payload, or still held by an upload being processed, is rejected with a conflict
+func (s *Server) reserveIdempotencyKey(w http.ResponseWriter, key string, fingerprint string) (bool, error) {
+	prior, err := s.db.ReserveIdempotencyKey(store.IdempotencyKey{Key: key, Fingerprint: fingerprint},
+		time.Now().Add(-s.cfg.IdempotencyRetention), time.Now().Add(-s.cfg.IdempotencyPendingTimeout))
+	if err != nil {
+		return false, err
+	}
+	if prior == nil {
+		return false, nil
+	}
+	if prior.Fingerprint != fingerprint {
+		return false, &statusError{
+			code: http.StatusConflict,
+			err:  fmt.Errorf("%s %s was already used for a different payload", idempotencyKeyHeader, key),
+		}
+	}
+	if prior.StatusCode == 0 {
+		return false, &statusError{
+			code: http.StatusConflict,
+			err:  fmt.Errorf("an upload with %s %s is still being processed, retry later", idempotencyKeyHeader, key),
+		}
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(prior.StatusCode)
+	w.Write(prior.Response)
+	return true, nil
+}
+
+// writes an upload response, recording it against the idempotency key so retries can replay it
+// ref is the file the upload was stored as, or uuid.Nil if it is still being processed
+func (s *Server) writeUploadResponse(w http.ResponseWriter, key string, fingerprint string, code int, ref uuid.UUID, resp interface{}) {
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(resp); err != nil {
+		handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if key != "" {
+		err := s.db.SaveIdempotencyKey(store.IdempotencyKey{
+			Key:         key,
+			Fingerprint: fingerprint,
+			FileRef:     ref,
+			StatusCode:  code,
+			Response:    body.Bytes(),
+		})
+		// the upload itself succeeded, so a failure to record the key only prevents replays
+		if err != nil {
+			log.Error(err)
+			s.releaseIdempotencyKey(key)
+		}
+	}
+	w.WriteHeader(code)
+	w.Write(body.Bytes())
+}
+
+// releases the reservation of an idempotency key whose upload failed, so that it can be retried
+func (s *Server) releaseIdempotencyKey(key string) {
+	if err := s.db.ReleaseIdempotencyKey(key); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// sends an upload with an idempotency key
+func uploadWithKey(s *Server, key string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/rsa/numbers", strings.NewReader(body))
+	r.Header.Set(idempotencyKeyHeader, key)
+	s.r.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotencyKeyReplay(t *testing.T) {
+	s := newTestServer(t)
+	body := "id,sms_phone\n1,27831234567\n"
+	first := uploadWithKey(s, "retry-1", body)
+	require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+	replayed := uploadWithKey(s, "retry-1", body)
+	require.Equal(t, http.StatusOK, replayed.Code)
+	require.Equal(t, "true", replayed.Header().Get("Idempotent-Replayed"))
+	require.Equal(t, first.Body.String(), replayed.Body.String())
+
+	w := uploadWithKey(s, "retry-1", "id,sms_phone\n1,27831234568\n")
+	require.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestIdempotencyKeyPending(t *testing.T) {
+	s := newTestServer(t)
+	body := "id,sms_phone\n1,27831234567\n"
+	rows, err := readUploadRows(&upload{body: ioutil.NopCloser(strings.NewReader(body)), format: csvFormat, country: "rsa"}, Config{})
+	require.NoError(t, err)
+
+	// a retry sent while the first attempt is processed is turned away, rather than processing the upload twice
+	prior, err := s.db.ReserveIdempotencyKey(store.IdempotencyKey{Key: "retry-1", Fingerprint: fingerprint(rows, "rsa")},
+		time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Nil(t, prior)
+	w := uploadWithKey(s, "retry-1", body)
+	require.Equal(t, http.StatusConflict, w.Code)
+	require.Contains(t, w.Body.String(), "still being processed")
+
+	// a reservation left by an upload that never answered, as when the server stopped, is taken over by a retry
+	s.cfg.IdempotencyPendingTimeout = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	w = uploadWithKey(s, "retry-1", body)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Empty(t, w.Header().Get("Idempotent-Replayed"))
+	w = uploadWithKey(s, "retry-1", body)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+}
+
+func TestIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.DailyRowQuota = 1
+	w := uploadWithKey(s, "retry-1", "id,sms_phone\n1,27831234567\n2,27831234568\n")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// the failed upload does not hold the key, so a retry is processed
+	s.cfg.DailyRowQuota = 0
+	w = uploadWithKey(s, "retry-1", "id,sms_phone\n1,27831234567\n2,27831234568\n")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Empty(t, w.Header().Get("Idempotent-Replayed"))
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// validates, fixes and stores the rows of an upload under a new file ref
+// rows are read back from the spool in chunks, validated concurrently and written to the store in batches as
+// validation proceeds, all within a single transaction
+// progress, if not nil, is called with the number of rows processed so far
+func (s *Server) processFile(up *upload, rows *uploadRows, progress func(processed int)) (*fileData, error) {
+	var (
+		numbers         []store.Number
+		fixedNumbers    []store.FixedNumber
+		rejectedNumbers []store.RejectedNumber
+		duplicates      []store.DuplicateNumber
+		inputs          []store.InputRow
+		seen            = duplicateTracker{}
+		stats           store.Stats
+		members         []store.MemberStats
+		processed       int
+	)
+	hash, err := generateHash()
+	if err != nil {
+		return nil, err
+	}
+	columns := rows.columns
+	file := store.File{
+		Ref:                hash,
+		Filename:           up.filename,
+		Label:              up.label,
+		UploadedAt:         time.Now(),
+		Fingerprint:        rows.fingerprint,
+		SplitCells:         rows.splitCells,
+		PassthroughColumns: up.opts.passthrough,
+		Country:            up.country,
+		RowCount:           rows.sourceRows,
+		FixPolicy:          fixPolicy(rows.countries),
+		RulesVersion:       fixRulesVersion,
+		Status:             store.FileProcessing,
+		SourceColumns:      columns.names,
+	}
+	if err := s.db.CreateFile(file); err != nil {
+		return nil, err
+	}
+	// the numbers are saved in one transaction, so a failure part way leaves none of them behind
+	err = s.db.SaveProcessedFile(hash, func(w store.FileWriter) error {
+		// writes whichever categories have filled a batch, or everything that is left when final is set
+		flush := func(final bool) error {
+			batchSize := s.cfg.WriteBatchSize
+			if final || len(numbers) >= batchSize {
+				if err := w.SaveNumbers(numbers); err != nil {
+					return err
+				}
+				numbers = numbers[:0]
+			}
+			if final || len(fixedNumbers) >= batchSize {
+				if err := w.SaveFixedNumbers(fixedNumbers); err != nil {
+					return err
+				}
+				fixedNumbers = fixedNumbers[:0]
+			}
+			if final || len(rejectedNumbers) >= batchSize {
+				if err := w.SaveRejectedNumbers(rejectedNumbers); err != nil {
+					return err
+				}
+				rejectedNumbers = rejectedNumbers[:0]
+			}
+			if final || len(duplicates) >= batchSize {
+				if err := w.SaveDuplicateNumbers(duplicates); err != nil {
+					return err
+				}
+				duplicates = duplicates[:0]
+			}
+			if final || len(inputs) >= batchSize {
+				if err := w.SaveInputRows(inputs); err != nil {
+					return err
+				}
+				inputs = inputs[:0]
+			}
+			return nil
+		}
+		emit := func(batch []validatedRow) error {
+			for _, result := range batch {
+				row, num := result.row, result.num
+				category, firstRow := classifyRow(seen, result)
+				source := store.SourceRow{RowNumber: row.row, Part: row.part, Passthrough: row.passthrough}
+				switch category {
+				case store.DuplicateCategory:
+					duplicate := store.DuplicateNumber{
+						Number:         num.NumberProvided,
+						RowNumber:      row.row,
+						FirstRowNumber: firstRow,
+						Part:           row.part,
+						CountryIOCCode: row.country,
+						FileRef:        hash,
+						Passthrough:    row.passthrough,
+					}
+					if result.err == nil {
+						duplicate.NormalizedNumber = num.FixedNumber
+					}
+					duplicates = append(duplicates, duplicate)
+				case store.RejectedCategory:
+					rejectedNumbers = append(rejectedNumbers, store.RejectedNumber{
+						Number:         num.NumberProvided,
+						CountryIOCCode: row.country,
+						FileRef:        hash,
+						Reason:         num.Reason,
+						SourceRow:      source,
+					})
+				case store.ValidCategory:
+					numbers = append(numbers, store.Number{
+						Number:         num.NumberProvided,
+						FileRef:        hash,
+						CountryIOCCode: row.country,
+						SourceRow:      source,
+					})
+				default:
+					fixedNumbers = append(fixedNumbers, store.FixedNumber{
+						OriginalNumber: num.NumberProvided,
+						FixedNumber:    num.FixedNumber,
+						Changes:        strings.Join(num.Changes, (", ")),
+						CountryIOCCode: row.country,
+						FileRef:        hash,
+						SourceRow:      source,
+					})
+				}
+				// the numbers of a split cell share the row they were read from, which is saved once
+				if row.part <= 1 && len(columns.names) > 0 {
+					inputs = append(inputs, store.InputRow{FileRef: hash, RowNumber: row.row, Cells: columns.align(row)})
+				}
+				addRowStats(&stats, result, category)
+				if row.member != "" {
+					members = addMemberStats(members, row.member, row.country, category)
+				}
+			}
+			processed += len(batch)
+			if progress != nil {
+				progress(processed)
+			}
+			return flush(false)
+		}
+		// each chunk gives every worker a batch to validate
+		workers := s.cfg.ValidationWorkers
+		if workers < 1 {
+			workers = 1
+		}
+		err := rows.each(s.cfg.WriteBatchSize*workers, func(chunk []uploadRow) error {
+			return validateRows(chunk, workers, s.cfg.WriteBatchSize, emit)
+		})
+		if err != nil {
+			return err
+		}
+		if err := flush(true); err != nil {
+			return err
+		}
+		stats.Members = members
+		return w.SaveStats(stats)
+	})
+	if err != nil {
+		if ferr := s.db.FailFile(hash, err.Error()); ferr != nil {
+			log.Error(ferr)
+		}
+		return nil, err
+	}
+	file.Status = store.FileCompleted
+	return newFileData(&file, stats), nil
+}
+
+// determines the category a validated row is stored under, recording its number in seen
+// for a duplicate, the row the number first occurred at is returned too
+func classifyRow(seen duplicateTracker, result validatedRow) (string, int) {
+	if firstRow, found := seen.check(result); found {
+		return store.DuplicateCategory, firstRow
+	}
+	switch {
+	case result.err != nil:
+		return store.RejectedCategory, 0
+	case result.num.Valid:
+		return store.ValidCategory, 0
+	}
+	return store.FixedCategory, 0
+}
+
+// counts a validated row of the given category towards stats
+func addRowStats(stats *store.Stats, result validatedRow, category string) {
+	stats.Add(result.row.country, category, 1)
+	switch category {
+	case store.FixedCategory:
+		stats.AddChanges(result.num.changeTypes)
+	case store.RejectedCategory:
+		stats.AddReason(result.num.Reason, 1)
+	}
+}
+
+// records the numbers seen so far in a file, so only the first occurrence of a number is kept
+// numbers are compared after fixing, as each table holds a number at most once per file
+type duplicateTracker map[string]int
+
+// reports the row at which the number of result first occurred, if it did
+// otherwise the number is recorded as occurring at the row of result
+func (d duplicateTracker) check(result validatedRow) (int, bool) {
+	var keys []string
+	if result.err != nil {
+		keys = append(keys, "rejected\t"+result.num.NumberProvided)
+	} else {
+		keys = append(keys, "number\t"+result.num.FixedNumber)
+		// the same original number fixed differently for another country would repeat it in fixed_numbers
+		if !result.num.Valid {
+			keys = append(keys, "original\t"+result.num.NumberProvided)
+		}
+	}
+	for _, key := range keys {
+		if firstRow, found := d[key]; found {
+			return firstRow, true
+		}
+	}
+	for _, key := range keys {
+		d[key] = result.row.row
+	}
+	return 0, false
+}
+
+// counts a number of the given category towards the stats of the zip archive member it was read from
+// rows of a member are contiguous, so only the last member needs checking
+func addMemberStats(members []store.MemberStats, member string, country string, category string) []store.MemberStats {
+	if len(members) == 0 || members[len(members)-1].Name != member {
+		members = append(members, store.MemberStats{Name: member})
+	}
+	members[len(members)-1].Stats.Add(country, category, 1)
+	return members
+}
+
+// the columns of an upload, in the order they first appear
+// the members of a zip archive, and the objects of a JSON upload, may each have columns of their own
+type sourceColumns struct {
+	names []string
+	// positions of the columns of each name, a header may repeat a name
+	positions map[string][]int
+	// columns of the last row aligned, and where their cells go, as the rows of a CSV file share their header
+	last      []string
+	lastAlign []int
+}
+
+// returns columns to be collected from the rows of an upload with positionsOf
+func newSourceColumns() *sourceColumns {
+	return &sourceColumns{positions: map[string][]int{}}
+}
+
+// returns the position of each of columns among the columns of the upload, adding those not seen before
+func (c *sourceColumns) positionsOf(columns []string) []int {
+	if len(columns) == 0 {
+		return nil
+	}
+	if len(c.last) == len(columns) && &c.last[0] == &columns[0] {
+		return c.lastAlign
+	}
+	align := make([]int, len(columns))
+	seen := map[string]int{}
+	for i, name := range columns {
+		n := seen[name]
+		seen[name]++
+		if n == len(c.positions[name]) {
+			c.positions[name] = append(c.positions[name], len(c.names))
+			c.names = append(c.names, name)
+		}
+		align[i] = c.positions[name][n]
+	}
+	c.last, c.lastAlign = columns, align
+	return align
+}
+
+// returns the cells of row in the order of the columns of the upload, columns the row lacks being empty
+func (c *sourceColumns) align(row uploadRow) []string {
+	cells := make([]string, len(c.names))
+	for i, position := range c.positionsOf(row.columns) {
+		if i < len(row.cells) {
+			cells[position] = row.cells[i]
+		}
+	}
+	return cells
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateTracker(t *testing.T) {
+	rows := []uploadRow{
+		{row: 1, number: "717278645", country: "rsa"},
+		{row: 2, number: "27717278645", country: "rsa"}, // duplicate of row 1 once fixed
+		{row: 3, number: "27717278645", country: "rsa"},
+		{row: 4, number: "271", country: "rsa"},
+		{row: 5, number: "271", country: "rsa"},       // rejected twice
+		{row: 6, number: "717278645", country: "aus"}, // fixed differently for another country
+		{row: 7, number: "61717278645", country: "aus"},
+		{row: 8, number: "617172786", country: "aus"}, // row 7 once fixed
+	}
+	expected := map[int]int{2: 1, 3: 1, 5: 4, 6: 1, 8: 7}
+
+	seen := duplicateTracker{}
+	for _, row := range rows {
+		num, err := newMobileNumber(row.country, row.number)
+		firstRow, found := seen.check(validatedRow{row: row, num: num, err: err})
+		expectedFirst, duplicate := expected[row.row]
+		require.Equal(t, duplicate, found, "row %d", row.row)
+		require.Equal(t, expectedFirst, firstRow, "row %d", row.row)
+	}
+}
+
+// collects the columns of the rows of an upload
+func uploadColumns(rows []uploadRow) *sourceColumns {
+	c := newSourceColumns()
+	for _, row := range rows {
+		c.positionsOf(row.columns)
+	}
+	return c
+}
+
+func TestUploadColumns(t *testing.T) {
+	header := []string{"id", "phone", "id"}
+	rows := []uploadRow{
+		{row: 1, columns: header, cells: []string{"1", "27717278645", "a"}},
+		{row: 2, columns: header, cells: []string{"2", "27717278646", "b"}},
+		// the rows of another zip archive member, or another JSON object, may have other columns
+		{row: 3, columns: []string{"name", "phone"}, cells: []string{"Cy", "27717278647"}},
+		{row: 4},
+	}
+	columns := uploadColumns(rows)
+	require.Equal(t, []string{"id", "phone", "id", "name"}, columns.names)
+	require.Equal(t, []string{"2", "27717278646", "b", ""}, columns.align(rows[1]))
+	require.Equal(t, []string{"", "27717278647", "", "Cy"}, columns.align(rows[2]))
+	require.Equal(t, []string{"", "", "", ""}, columns.align(rows[3]))
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// states of an asynchronous upload job
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// processes an upload, reporting the number of rows processed so far to progress
+type jobFunc func(progress func(processed int)) (*fileData, error)
+
+// state of an upload processed in the background
+type job struct {
+	ID            uuid.UUID  `json:"id"`
+	State         string     `json:"state"`
+	TotalRows     int        `json:"total_rows"`
+	ProcessedRows int        `json:"processed_rows"`
+	FileRef       *uuid.UUID `json:"file_ref,omitempty"`
+	Result        *fileData  `json:"result,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	Href          string     `json:"href"`
+	CreatedAt     time.Time  `json:"created_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+}
+
+type queuedJob struct {
+	id      uuid.UUID
+	process jobFunc
+}
+
+// runs upload jobs on a fixed number of workers and tracks their state
+// finished jobs are forgotten once they are older than the retention period
+type jobQueue struct {
+	mu        sync.Mutex
+	jobs      map[uuid.UUID]*job
+	queue     chan queuedJob
+	retention time.Duration
+}
+
+// starts a job queue with the given number of workers
+// at most size jobs can wait for a worker
+func newJobQueue(workers int, size int, retention time.Duration) *jobQueue {
+	q := &jobQueue{
+		jobs:      map[uuid.UUID]*job{},
+		queue:     make(chan queuedJob, size),
+		retention: retention,
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// queues process to run in the background and returns the state of the new job
+func (q *jobQueue) submit(process jobFunc, totalRows int) (job, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return job{}, err
+	}
+	j := &job{
+		ID:        id,
+		State:     jobQueued,
+		TotalRows: totalRows,
+		Href:      buildJobHref(url, port, id.String()),
+		CreatedAt: time.Now(),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+	select {
+	case q.queue <- queuedJob{id: id, process: process}:
+	default:
+		return job{}, &statusError{
+			code: http.StatusServiceUnavailable,
+			err:  fmt.Errorf("too many uploads are waiting to be processed, try again later"),
+		}
+	}
+	q.jobs[id] = j
+	return *j, nil
+}
+
+// returns the state of a job
+func (q *jobQueue) get(id uuid.UUID) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, found := q.jobs[id]
+	if !found {
+		return job{}, false
+	}
+	return *j, true
+}
+
+func (q *jobQueue) work() {
+	for qj := range q.queue {
+		q.run(qj)
+	}
+}
+
+func (q *jobQueue) run(qj queuedJob) {
+	q.update(qj.id, func(j *job) {
+		j.State = jobRunning
+	})
+	resp, err := qj.process(func(processed int) {
+		q.update(qj.id, func(j *job) {
+			j.ProcessedRows = processed
+		})
+	})
+	now := time.Now()
+	q.update(qj.id, func(j *job) {
+		j.FinishedAt = &now
+		if err != nil {
+			log.Error(err)
+			j.State = jobFailed
+			j.Error = err.Error()
+			return
+		}
+		j.State = jobDone
+		j.FileRef = &resp.Ref
+		j.Result = resp
+	})
+}
+
+func (q *jobQueue) update(id uuid.UUID, fn func(j *job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, found := q.jobs[id]; found {
+		fn(j)
+	}
+}
+
+// forgets finished jobs older than the retention period
+// the caller must hold q.mu
+func (q *jobQueue) prune() {
+	cutoff := time.Now().Add(-q.retention)
+	for id, j := range q.jobs {
+		if j.FinishedAt != nil && j.FinishedAt.Before(cutoff) {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// builds the URL a client polls for the state of a job
+func buildJobHref(url string, port int, id string) string {
+	return fmt.Sprintf("%s:%d/jobs/%s", url, port, id)
+}
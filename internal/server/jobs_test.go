@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// waits for a job to finish and returns its final state
+func waitForJob(t *testing.T, q *jobQueue, id uuid.UUID) job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		j, found := q.get(id)
+		require.True(t, found)
+		if j.State == jobDone || j.State == jobFailed {
+			return j
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return job{}
+}
+
+func TestJobQueue(t *testing.T) {
+	q := newJobQueue(1, 10, time.Hour)
+	ref, err := uuid.NewV4()
+	require.NoError(t, err)
+
+	done, err := q.submit(func(progress func(processed int)) (*fileData, error) {
+		progress(3)
+		return &fileData{Ref: ref}, nil
+	}, 3)
+	require.NoError(t, err)
+	require.Equal(t, jobQueued, done.State)
+	require.Equal(t, 3, done.TotalRows)
+
+	failed, err := q.submit(func(progress func(processed int)) (*fileData, error) {
+		return nil, errors.New("unable to save numbers")
+	}, 2)
+	require.NoError(t, err)
+
+	j := waitForJob(t, q, done.ID)
+	require.Equal(t, jobDone, j.State)
+	require.Equal(t, 3, j.ProcessedRows)
+	require.Equal(t, &ref, j.FileRef)
+	require.NotNil(t, j.FinishedAt)
+
+	j = waitForJob(t, q, failed.ID)
+	require.Equal(t, jobFailed, j.State)
+	require.Equal(t, "unable to save numbers", j.Error)
+	require.Nil(t, j.FileRef)
+
+	_, found := q.get(uuid.Nil)
+	require.False(t, found)
+}
+
+func TestJobQueueFull(t *testing.T) {
+	// no workers, so submitted jobs stay queued
+	q := newJobQueue(0, 1, time.Hour)
+	noop := func(progress func(processed int)) (*fileData, error) { return &fileData{}, nil }
+	_, err := q.submit(noop, 1)
+	require.NoError(t, err)
+	_, err = q.submit(noop, 1)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, errorStatus(err, http.StatusInternalServerError))
+}
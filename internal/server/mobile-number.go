@@ -7,6 +7,10 @@ type mobileNumber struct {
 	countryAbbreviation string
 	Valid               bool     `json:"valid"`
 	Changes             []string `json:"changes"`
+	// type of each change, in the order of Changes
+	changeTypes []string
+	// why the number was rejected, empty unless it was
+	Reason string `json:"reason,omitempty"`
 }
 
 // Generates a mobile number data object after validating and attempting to fix
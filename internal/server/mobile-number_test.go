@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -25,6 +26,69 @@ func TestNewMobileNumber(t *testing.T) {
 			},
 			err: nil,
 		},
+		"number with spreadsheet decimals": {
+			number: "27717278645.0",
+			code:   "rsa",
+			expected: &mobileNumber{
+				NumberProvided:      "27717278645.0",
+				FixedNumber:         "27717278645",
+				countryAbbreviation: "rsa",
+				Valid:               false,
+				Changes:             []string{"removed decimals from 27717278645.0"},
+				changeTypes:         []string{changeDecimalsRemoved},
+			},
+			err: nil,
+		},
+		"exact number in scientific notation": {
+			number: "2.7717278645E+10",
+			code:   "rsa",
+			expected: &mobileNumber{
+				NumberProvided:      "2.7717278645E+10",
+				FixedNumber:         "27717278645",
+				countryAbbreviation: "rsa",
+				Valid:               false,
+				Changes:             []string{"expanded scientific notation 2.7717278645E+10"},
+				changeTypes:         []string{changeScientificExpanded},
+			},
+			err: nil,
+		},
+		"number in scientific notation missing digits": {
+			number: "2.77173E+10",
+			code:   "rsa",
+			expected: &mobileNumber{
+				NumberProvided:      "2.77173E+10",
+				FixedNumber:         "",
+				countryAbbreviation: "rsa",
+				Valid:               false,
+				Reason:              reasonPrecisionLost,
+			},
+			err: fmt.Errorf("number 2.77173E+10 is in scientific notation and lost its last 5 digits"),
+		},
+		"decimal number": {
+			number: "2771727864.5",
+			code:   "rsa",
+			expected: &mobileNumber{
+				NumberProvided:      "2771727864.5",
+				FixedNumber:         "",
+				countryAbbreviation: "rsa",
+				Valid:               false,
+				Reason:              reasonNotWholeNumber,
+			},
+			err: fmt.Errorf("number 2771727864.5 is not a whole number"),
+		},
+		"number too short": {
+			number: "277",
+			code:   "rsa",
+			expected: &mobileNumber{
+				NumberProvided:      "277",
+				FixedNumber:         "",
+				countryAbbreviation: "rsa",
+				Valid:               false,
+				Changes:             []string{},
+				Reason:              reasonInvalidLength,
+			},
+			err: fmt.Errorf("invalid length 3, the length must be exactly 11"),
+		},
 		// "fixable number by shortening": {
 		// 	number: "277172786457",
 		// 	code:   "rsa",
@@ -79,7 +143,7 @@ func TestNewMobileNumber(t *testing.T) {
 		if test.err == nil {
 			require.NoError(t, err, tName)
 		} else {
-			require.Error(t, err, test.err.Error(), tName)
+			require.EqualError(t, err, test.err.Error(), tName)
 		}
 		require.Equal(t, test.expected, actual, tName)
 	}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// number of numbers in a page when no limit parameter is given, and the most that can be asked for
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// a page of the numbers of a processed file
+type rowsPage struct {
+	Ref      uuid.UUID         `json:"ref"`
+	Category string            `json:"category,omitempty"`
+	Rows     []store.ResultRow `json:"rows"`
+	// cursor and URL of the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	Next       string `json:"next,omitempty"`
+}
+
+// encodes the position of a number as an opaque cursor
+func encodeCursor(c store.RowCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodes a cursor returned with an earlier page
+func decodeCursor(s string) (*store.RowCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	var c store.RowCursor
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || !validCategory(c.Category) {
+		return nil, &jsonError{Msg: fmt.Sprintf("invalid cursor %s", s)}
+	}
+	return &c, nil
+}
+
+// reports whether category is one of the number categories
+func validCategory(category string) bool {
+	switch category {
+	case store.ValidCategory, store.FixedCategory, store.RejectedCategory, store.DuplicateCategory:
+		return true
+	}
+	return false
+}
+
+// reads the category, cursor and limit parameters of a page request
+func parsePage(r *http.Request) (store.RowPage, error) {
+	query := r.URL.Query()
+	page := store.RowPage{Category: query.Get("category"), Limit: defaultPageSize}
+	if page.Category != "" && !validCategory(page.Category) {
+		return page, &jsonError{Msg: fmt.Sprintf("category must be one of %s, %s, %s or %s",
+			store.ValidCategory, store.FixedCategory, store.RejectedCategory, store.DuplicateCategory)}
+	}
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if page.Limit, err = strconv.Atoi(v); err != nil || page.Limit < 1 || page.Limit > maxPageSize {
+			return page, &jsonError{Msg: fmt.Sprintf("limit must be a number between 1 and %d", maxPageSize)}
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		var err error
+		if page.After, err = decodeCursor(v); err != nil {
+			return page, err
+		}
+	}
+	return page, nil
+}
+
+// return a page of the numbers of a previously processed file, in the order of the file
+// the cursor returned with a page is passed back to fetch the page after it
+func (s *Server) rowsPageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	ref, err := uuid.FromString(vars["ref"])
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	if _, err := s.getCompletedFile(ref); err != nil {
+		handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// one more number than asked for tells whether there is a next page
+	limit := page.Limit
+	page.Limit++
+	rows, err := s.db.GetFileRowsPage(ref, page)
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	resp := rowsPage{Ref: ref, Category: page.Category, Rows: []store.ResultRow{}}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		resp.NextCursor = encodeCursor(rows[limit-1].Cursor())
+		query := r.URL.Query()
+		query.Set("cursor", resp.NextCursor)
+		resp.Next = buildHref(url, port, ref.String()) + "/rows?" + query.Encode()
+	}
+	resp.Rows = append(resp.Rows, rows...)
+	json.NewEncoder(w).Encode(resp)
+}
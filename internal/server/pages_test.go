@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+func TestRowsPages(t *testing.T) {
+	s := newTestServer(t)
+	body := "id,sms_phone\n1,27831234567\n2,831234568\n3,123\n4,27831234567\n5,27831234569\n"
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", body, &uploaded))
+	path := "/numbers/" + uploaded.Ref.String() + "/rows"
+
+	var all rowsPage
+	require.Equal(t, http.StatusOK, serve(t, s, "GET", path, "", &all))
+	require.Empty(t, all.NextCursor)
+	require.Len(t, all.Rows, 5)
+	var categories []string
+	for _, row := range all.Rows {
+		categories = append(categories, row.Category)
+	}
+	require.Equal(t, []string{store.ValidCategory, store.FixedCategory, store.RejectedCategory, store.DuplicateCategory,
+		store.ValidCategory}, categories)
+
+	// following the cursors returns every number once
+	var paged []store.ResultRow
+	target := path + "?limit=2"
+	for {
+		var page rowsPage
+		require.Equal(t, http.StatusOK, serve(t, s, "GET", target, "", &page))
+		paged = append(paged, page.Rows...)
+		if page.NextCursor == "" {
+			require.Empty(t, page.Next)
+			break
+		}
+		require.Len(t, page.Rows, 2)
+		require.True(t, strings.HasSuffix(page.Next, path+"?cursor="+page.NextCursor+"&limit=2"), page.Next)
+		target = path + "?limit=2&cursor=" + page.NextCursor
+	}
+	require.Equal(t, all.Rows, paged)
+
+	var valid rowsPage
+	require.Equal(t, http.StatusOK, serve(t, s, "GET", path+"?category=valid&limit=1", "", &valid))
+	require.Equal(t, store.ValidCategory, valid.Category)
+	require.Equal(t, all.Rows[:1], valid.Rows)
+	var next rowsPage
+	require.Equal(t, http.StatusOK, serve(t, s, "GET", path+"?category=valid&limit=1&cursor="+valid.NextCursor, "", &next))
+	require.Equal(t, all.Rows[4:], next.Rows)
+	require.Empty(t, next.NextCursor)
+}
+
+func TestRowsPagesBadRequests(t *testing.T) {
+	s := newTestServer(t)
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", "id,sms_phone\n1,27831234567\n", &uploaded))
+	path := "/numbers/" + uploaded.Ref.String() + "/rows"
+
+	for query, msg := range map[string]string{
+		"?category=invalid": "category must be one of valid, fixed, rejected or duplicate",
+		"?limit=0":          "limit must be a number between 1 and 1000",
+		"?limit=1001":       "limit must be a number between 1 and 1000",
+		"?limit=ten":        "limit must be a number between 1 and 1000",
+		"?cursor=abc":       "invalid cursor abc",
+	} {
+		var errJSON jsonError
+		require.Equal(t, http.StatusBadRequest, serve(t, s, "GET", path+query, "", &errJSON), query)
+		require.Equal(t, msg, errJSON.Msg, query)
+	}
+
+	ref := uuid.Must(uuid.NewV4()).String()
+	var errJSON jsonError
+	require.Equal(t, http.StatusNotFound, serve(t, s, "GET", "/numbers/"+ref+"/rows", "", &errJSON))
+	require.Equal(t, "file "+ref+" not found", errJSON.Msg)
+}
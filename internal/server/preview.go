@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// number of rows previewed when no rows parameter is given, and the most that can be asked for
+const (
+	defaultPreviewRows = 20
+	maxPreviewRows     = 1000
+)
+
+// outcome of fixing a single row of a preview
+type previewRow struct {
+	Row            int      `json:"row"`
+	Part           int      `json:"part,omitempty"`
+	Member         string   `json:"member,omitempty"`
+	Country        string   `json:"country"`
+	NumberProvided string   `json:"number_provided"`
+	FixedNumber    string   `json:"number_fixed,omitempty"`
+	Category       string   `json:"category"`
+	Changes        []string `json:"changes,omitempty"`
+	// row the number first occurred at, for duplicates
+	FirstRow int    `json:"first_row,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+
+	Passthrough store.Passthrough `json:"passthrough,omitempty"`
+}
+
+// result of previewing the first rows of an upload
+type previewData struct {
+	Dialect    dialect `json:"dialect"`
+	SampleRows int     `json:"sample_rows"`
+	SplitCells int     `json:"split_cells"`
+	// set when the sample holds every row of the upload, making the stats those of the whole upload
+	Complete bool `json:"complete"`
+	// counts of the sample rows only, not scaled to the rest of the upload, whose size is unknown until it is read
+	Stats store.Stats  `json:"sample_stats"`
+	Rows  []previewRow `json:"rows"`
+}
+
+// reads at most n rows of an upload, recording how it was interpreted
+// reports whether the upload holds more rows than were read
+func readUploadSample(up *upload, cfg Config, n int) ([]uploadRow, dialect, bool, error) {
+	d := dialect{Format: up.format, Compression: up.compression}
+	// one more row than needed tells whether the sample is the whole upload
+	limits := &uploadLimits{maxRows: cfg.MaxRows, maxColumns: cfg.MaxColumns, sample: n + 1, dialect: &d}
+	var rows []uploadRow
+	err := readCompressedRows(up, cfg.MaxDecompressedBytes, cfg.MaxArchiveMembers, limits, func(row uploadRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, d, false, err
+	}
+	truncated := len(rows) > n
+	if truncated {
+		rows = rows[:n]
+	}
+	for i := range rows {
+		rows[i].row = i + 1
+	}
+	return splitRows(rows), d, truncated, nil
+}
+
+// fixes the first rows of an upload and reports how each would be stored, without storing anything
+func (s *Server) previewNumbersHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	limitRequestBody(r, s.cfg.MaxUploadBytes)
+	up, err := parseUpload(r, vars["countryAbbreviation"])
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	defer up.Close()
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	n := defaultPreviewRows
+	if v := formValue(r, "rows"); v != "" {
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxPreviewRows {
+			handleError(w, &jsonError{Msg: fmt.Sprintf("rows must be a number between 1 and %d", maxPreviewRows)}, http.StatusBadRequest)
+			return
+		}
+	}
+	rows, d, truncated, err := readUploadSample(up, s.cfg, n)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	preview := previewData{
+		Dialect:    d,
+		SampleRows: len(rows),
+		SplitCells: splitCellCount(rows),
+		Complete:   !truncated,
+		Rows:       []previewRow{},
+	}
+	seen := duplicateTracker{}
+	validateRows(rows, s.cfg.ValidationWorkers, s.cfg.WriteBatchSize, func(batch []validatedRow) error {
+		for _, result := range batch {
+			category, firstRow := classifyRow(seen, result)
+			row := previewRow{
+				Row:            result.row.row,
+				Part:           result.row.part,
+				Member:         result.row.member,
+				Country:        result.row.country,
+				NumberProvided: result.num.NumberProvided,
+				Category:       category,
+				Changes:        result.num.Changes,
+				FirstRow:       firstRow,
+				Passthrough:    result.row.passthrough,
+			}
+			if result.err != nil {
+				row.Error = result.err.Error()
+				row.Reason = result.num.Reason
+			} else {
+				row.FixedNumber = result.num.FixedNumber
+			}
+			addRowStats(&preview.Stats, result, category)
+			preview.Rows = append(preview.Rows, row)
+		}
+		return nil
+	})
+	json.NewEncoder(w).Encode(preview)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+func previewRequest(t *testing.T, target string, body string) (int, previewData) {
+	s := &Server{cfg: DefaultConfig()}
+	router := mux.NewRouter()
+	router.HandleFunc("/{countryAbbreviation}/numbers/preview", s.previewNumbersHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", target, strings.NewReader(body)))
+	var preview previewData
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&preview))
+	}
+	return w.Code, preview
+}
+
+func TestPreview(t *testing.T) {
+	body := "id;phone\n1;27831234567\n2;831234569\n3;_DELETED_\n4;27831234567\n5;27831234568\n"
+	code, preview := previewRequest(t, "/rsa/numbers/preview?rows=4&number_column=phone", body)
+	require.Equal(t, http.StatusOK, code)
+
+	require.Equal(t, dialect{Format: csvFormat, Delimiter: ";", Header: []string{"id", "phone"}, NumberColumn: "phone"}, preview.Dialect)
+	require.Equal(t, 4, preview.SampleRows)
+	require.False(t, preview.Complete)
+	require.Len(t, preview.Rows, 4)
+	require.Equal(t, previewRow{Row: 1, Country: "rsa", NumberProvided: "27831234567", FixedNumber: "27831234567", Category: store.ValidCategory}, preview.Rows[0])
+	require.Equal(t, store.FixedCategory, preview.Rows[1].Category)
+	require.Equal(t, "27831234569", preview.Rows[1].FixedNumber)
+	require.NotEmpty(t, preview.Rows[1].Changes)
+	require.Equal(t, store.RejectedCategory, preview.Rows[2].Category)
+	require.NotEmpty(t, preview.Rows[2].Error)
+	require.Empty(t, preview.Rows[2].FixedNumber)
+	require.Equal(t, store.DuplicateCategory, preview.Rows[3].Category)
+	require.Equal(t, 1, preview.Rows[3].FirstRow)
+
+	// stats count the sample, not the rest of the upload
+	require.Equal(t, 4, preview.Stats.TotalNumbersProcessed)
+	require.Equal(t, 1, preview.Stats.ValidNumbersCount)
+	require.Equal(t, 1, preview.Stats.FixedNumbersCount)
+	require.Equal(t, 1, preview.Stats.InvalidNumbersCount)
+	require.Equal(t, 1, preview.Stats.DuplicateNumbersCount)
+	require.Equal(t, map[string]int{changeDialingCodePrepended: 1}, preview.Stats.Changes)
+	require.Equal(t, map[string]int{reasonInvalidLength: 1}, preview.Stats.Reasons)
+
+	// a sample holding the whole upload is complete
+	code, preview = previewRequest(t, "/rsa/numbers/preview?number_column=phone", body)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 5, preview.SampleRows)
+	require.True(t, preview.Complete)
+}
+
+func TestPreviewInvalidRows(t *testing.T) {
+	for _, rows := range []string{"0", "abc", "1001"} {
+		code, _ := previewRequest(t, "/rsa/numbers/preview?rows="+rows, "id,sms_phone\n1,27831234567\n")
+		require.Equal(t, http.StatusBadRequest, code, rows)
+	}
+}
+
+func TestSniffDelimiter(t *testing.T) {
+	tests := map[string]rune{
+		"id,sms_phone":              ',',
+		"id;sms_phone":              ';',
+		"id\tsms_phone":             '\t',
+		"id|sms_phone":              '|',
+		"sms_phone":                 ',',
+		`"a;b",sms_phone`:           ',',
+		"id;sms_phone;name,surname": ';',
+	}
+	for line, expected := range tests {
+		require.Equal(t, string(expected), string(sniffDelimiter([]byte(line))), line)
+	}
+}
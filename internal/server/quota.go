@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// header identifying the API client making a request
+// the header is not authenticated, so it only identifies clients that send it honestly
+const clientIDHeader = "X-Client-ID"
+
+// client that requests without a client ID are counted against
+const anonymousClient = "anonymous"
+
+// returns the ID of the client making the request
+func clientID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get(clientIDHeader)); id != "" {
+		return id
+	}
+	return anonymousClient
+}
+
+// counts rows against the client's quota for the given UTC day
+// an upload that would take the client over its quota is rejected with a 429 error, and not counted
+func (s *Server) reserveRowQuota(client string, day time.Time, rows int) error {
+	quota := s.cfg.DailyRowQuota
+	if quota <= 0 {
+		return nil
+	}
+	reserved := false
+	if rows <= quota {
+		var err error
+		reserved, err = s.db.ReserveRowQuota(client, day, rows, quota)
+		if err != nil {
+			return err
+		}
+	}
+	if reserved {
+		return nil
+	}
+	used, err := s.db.GetRowQuotaUsage(client, day)
+	if err != nil {
+		return err
+	}
+	return &statusError{
+		code: http.StatusTooManyRequests,
+		err: &limitError{
+			limit: "daily_rows",
+			max:   int64(quota),
+			msg:   fmt.Sprintf("client %s has used %d of its %d daily rows, the upload has %d rows", client, used, quota, rows),
+		},
+	}
+}
+
+// gives back rows reserved by reserveRowQuota for an upload that failed to be processed
+// a failure is only logged, the rows then staying counted
+func (s *Server) releaseRowQuota(client string, day time.Time, rows int) {
+	if s.cfg.DailyRowQuota <= 0 {
+		return
+	}
+	if err := s.db.ReleaseRowQuota(client, day, rows); err != nil {
+		log.Errorf("unable to give back %d rows of client %s: %v", rows, client, err)
+	}
+}
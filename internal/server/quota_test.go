@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// fails to save the numbers of every file
+type failingSaveStorage struct {
+	store.Storage
+}
+
+func (s failingSaveStorage) SaveProcessedFile(ref uuid.UUID, write func(w store.FileWriter) error) error {
+	return errors.New("unable to save numbers")
+}
+
+func TestRowQuotaReleasedOnFailure(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.DailyRowQuota = 10
+	s.db = failingSaveStorage{s.db}
+	upload := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", target, strings.NewReader("id,sms_phone\n1,27831234567\n2,27831234568\n"))
+		r.Header.Set(clientIDHeader, "billing")
+		s.r.ServeHTTP(w, r)
+		return w
+	}
+	used := func() int {
+		used, err := s.db.GetRowQuotaUsage("billing", time.Now().UTC())
+		require.NoError(t, err)
+		return used
+	}
+
+	w := upload("/rsa/numbers")
+	require.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+	require.Equal(t, 0, used())
+
+	// rows of an asynchronous upload are given back once its job fails
+	var accepted job
+	w = upload("/rsa/numbers?async=true&force=true")
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &accepted))
+	require.Equal(t, jobFailed, waitForJob(t, s.jobs, accepted.ID).State)
+	require.Equal(t, 0, used())
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// returns a server storing processed files in memory
+func newTestServer(t *testing.T) *Server {
+	return newTestServerWithStorage(t, memoryStorage)
+}
+
+// returns a server storing processed files in the given storage, which cannot be postgres
+func newTestServerWithStorage(t *testing.T, storage string) *Server {
+	cfg := DefaultConfig()
+	cfg.Storage = storage
+	cfg.UploadDir = t.TempDir()
+	cfg.DataDir = t.TempDir()
+	s, err := New(cfg)
+	require.NoError(t, err)
+	t.Cleanup(s.db.Close)
+	return s
+}
+
+// sends a request to the server, decoding the JSON response into v unless v is nil
+func serve(t *testing.T, s *Server, method string, target string, body string, v interface{}) int {
+	w := httptest.NewRecorder()
+	s.r.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if v != nil {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(v), w.Body.String())
+	}
+	return w.Code
+}
+
+func TestStoreAndGetNumbers(t *testing.T) {
+	for _, storage := range []string{memoryStorage, fileStorage} {
+		t.Run(storage, func(t *testing.T) {
+			testStoreAndGetNumbers(t, newTestServerWithStorage(t, storage))
+		})
+	}
+}
+
+func testStoreAndGetNumbers(t *testing.T, s *Server) {
+	body := "id,sms_phone\n1,27831234567\n2,831234568\n3,123\n4,27831234567\n"
+	var uploaded fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", body, &uploaded))
+	require.Equal(t, store.FileCompleted, uploaded.Status)
+	require.Equal(t, 4, uploaded.Rows)
+
+	var details fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "GET", "/numbers/results/"+uploaded.Ref.String(), "", &details))
+	require.Equal(t, uploaded.Ref, details.Ref)
+	require.Equal(t, store.FileCompleted, details.Status)
+	require.Equal(t, "rsa", details.Country)
+	require.Equal(t, 4, details.Rows)
+	require.Equal(t, fixRulesVersion, details.RulesVersion)
+	require.Equal(t, uploaded.Stats, details.Stats)
+	require.Equal(t, 1, details.Stats.ValidNumbersCount)
+	require.Equal(t, map[string]int{changeDialingCodePrepended: 1}, details.Stats.Changes)
+	require.Equal(t, map[string]int{reasonInvalidLength: 1}, details.Stats.Reasons)
+
+	var results store.FileResults
+	require.Equal(t, http.StatusOK, serve(t, s, "GET", "/numbers/"+uploaded.Ref.String(), "", &results))
+	require.Equal(t, []string{"27831234567"}, results.ValidNumbers)
+	require.Equal(t, []string{"123"}, results.RejectedNumbers)
+	require.Len(t, results.FixedNumbers, 1)
+	require.Len(t, results.DuplicateNumbers, 1)
+
+	// the same content is not processed again
+	var again fileData
+	require.Equal(t, http.StatusOK, serve(t, s, "POST", "/rsa/numbers", body, &again))
+	require.True(t, again.AlreadyProcessed)
+	require.Equal(t, uploaded.Ref, again.Ref)
+}
+
+func TestZipMemberStats(t *testing.T) {
+	for _, storage := range []string{memoryStorage, fileStorage} {
+		t.Run(storage, func(t *testing.T) {
+			s := newTestServerWithStorage(t, storage)
+			archive := zipData(t, map[string]string{
+				"march.csv": "id,sms_phone\n1,27831234567\n2,123\n",
+				"april.csv": "id,sms_phone\n1,831234568\n",
+			}, []string{"march.csv", "april.csv"})
+			upload := func(v interface{}) int {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("POST", "/rsa/numbers", bytes.NewReader(archive))
+				r.Header.Set("Content-Type", "application/zip")
+				s.r.ServeHTTP(w, r)
+				require.NoError(t, json.NewDecoder(w.Body).Decode(v), w.Body.String())
+				return w.Code
+			}
+			var uploaded fileData
+			require.Equal(t, http.StatusOK, upload(&uploaded))
+			require.Len(t, uploaded.Members, 2)
+			require.Equal(t, "march.csv", uploaded.Members[0].Name)
+			require.Equal(t, 1, uploaded.Members[0].Stats.ValidNumbersCount)
+			require.Equal(t, 1, uploaded.Members[0].Stats.InvalidNumbersCount)
+			require.Equal(t, "april.csv", uploaded.Members[1].Name)
+			require.Equal(t, 1, uploaded.Members[1].Stats.FixedNumbersCount)
+			require.Empty(t, uploaded.Stats.Members)
+
+			// the stats of each member are saved with the stats of the file
+			var details fileData
+			require.Equal(t, http.StatusOK, serve(t, s, "GET", "/numbers/results/"+uploaded.Ref.String(), "", &details))
+			require.Equal(t, uploaded.Members, details.Members)
+			require.Equal(t, uploaded.Stats, details.Stats)
+			var again fileData
+			require.Equal(t, http.StatusOK, upload(&again))
+			require.True(t, again.AlreadyProcessed)
+			require.Equal(t, uploaded.Members, again.Members)
+		})
+	}
+}
+
+func TestUnknownFile(t *testing.T) {
+	s := newTestServer(t)
+	ref := uuid.Must(uuid.NewV4()).String()
+	var errJSON jsonError
+	require.Equal(t, http.StatusNotFound, serve(t, s, "GET", "/numbers/results/"+ref, "", &errJSON))
+	require.Equal(t, "file "+ref+" not found", errJSON.Msg)
+	require.Equal(t, http.StatusNotFound, serve(t, s, "GET", "/numbers/"+ref, "", nil))
+}
+
+func TestUnknownStorage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Storage = "mysql"
+	_, err := New(cfg)
+	require.EqualError(t, err, `unknown storage "mysql", must be postgres, memory or file`)
+}
+
+func TestUnreachablePostgres(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Storage = "postgres"
+	cfg.DatabaseURL = "postgres://localhost:1/numbers?sslmode=disable&connect_timeout=1"
+	_, err := New(cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "[New] unable to connect to postgres")
+}
@@ -0,0 +1,509 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// chunks of an upload session are numbered from 1 up to this limit
+const maxUploadChunks = 100000
+
+const (
+	sessionFile = "session.json"
+	chunkSuffix = ".chunk"
+)
+
+// a chunked upload in progress
+// the options given when the session is created apply to the file assembled from its chunks
+type uploadSession struct {
+	ID            uuid.UUID `json:"id"`
+	Country       string    `json:"country"`
+	Filename      string    `json:"filename,omitempty"`
+	Label         string    `json:"label,omitempty"`
+	Format        string    `json:"format"`
+	Compression   string    `json:"compression,omitempty"`
+	NumberColumn  string    `json:"number_column,omitempty"`
+	CountryColumn string    `json:"country_column,omitempty"`
+	Passthrough   []string  `json:"passthrough,omitempty"`
+	Force         bool      `json:"force,omitempty"`
+	Async         bool      `json:"async,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	// reported with the session, not stored
+	Chunks        []chunkInfo `json:"chunks"`
+	ReceivedBytes int64       `json:"received_bytes"`
+	Href          string      `json:"href"`
+}
+
+// a chunk received for an upload session
+type chunkInfo struct {
+	Number int   `json:"number"`
+	Size   int64 `json:"size"`
+}
+
+// upload returns the upload described by the session, reading its body from body
+func (u *uploadSession) upload(body io.ReadCloser) *upload {
+	return &upload{
+		body:        body,
+		format:      u.Format,
+		compression: u.Compression,
+		country:     u.Country,
+		opts:        uploadOptions{numberColumn: u.NumberColumn, countryColumn: u.CountryColumn, passthrough: u.Passthrough},
+		filename:    u.Filename,
+		label:       u.Label,
+		force:       u.Force,
+		async:       u.Async,
+	}
+}
+
+// keeps upload sessions on disk, one directory per session holding its options and chunks
+// sessions older than the retention period are removed
+type sessionStore struct {
+	dir       string
+	retention time.Duration
+	mu        sync.Mutex
+	// signalled when a chunk of a session is no longer being written
+	written *sync.Cond
+	// sessions being completed, which no longer accept chunks
+	completing map[uuid.UUID]bool
+	// number of chunks of each session being written, which a completion waits for
+	writing map[uuid.UUID]int
+}
+
+func newSessionStore(dir string, retention time.Duration) *sessionStore {
+	s := &sessionStore{dir: dir, retention: retention, completing: map[uuid.UUID]bool{}, writing: map[uuid.UUID]int{}}
+	s.written = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *sessionStore) sessionDir(id uuid.UUID) string {
+	return filepath.Join(s.dir, id.String())
+}
+
+func (s *sessionStore) chunkPath(id uuid.UUID, n int) string {
+	return filepath.Join(s.sessionDir(id), fmt.Sprintf("%08d%s", n, chunkSuffix))
+}
+
+// creates a new session with the options of session
+func (s *sessionStore) create(session uploadSession) (*uploadSession, error) {
+	s.prune()
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	session.ID = id
+	session.CreatedAt = time.Now().UTC()
+	if err := os.MkdirAll(s.sessionDir(id), 0700); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(s.sessionDir(id), sessionFile), bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return s.get(id)
+}
+
+// returns the session along with the chunks received so far
+func (s *sessionStore) get(id uuid.UUID) (*uploadSession, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.sessionDir(id), sessionFile))
+	if os.IsNotExist(err) {
+		return nil, &statusError{code: http.StatusNotFound, err: &jsonError{Msg: fmt.Sprintf("upload session %s not found", id)}}
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &uploadSession{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+	session.Chunks, err = s.chunks(id)
+	if err != nil {
+		return nil, err
+	}
+	session.ReceivedBytes = 0
+	for _, c := range session.Chunks {
+		session.ReceivedBytes += c.Size
+	}
+	session.Href = buildSessionHref(url, port, id.String())
+	return session, nil
+}
+
+// lists the chunks received for a session, by number
+func (s *sessionStore) chunks(id uuid.UUID) ([]chunkInfo, error) {
+	entries, err := ioutil.ReadDir(s.sessionDir(id))
+	if err != nil {
+		return nil, err
+	}
+	chunks := []chunkInfo{}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), chunkSuffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), chunkSuffix))
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, chunkInfo{Number: n, Size: e.Size()})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Number < chunks[j].Number })
+	return chunks, nil
+}
+
+// stores chunk n of a session, replacing any chunk received before with the same number
+// so that a chunk whose upload failed can be sent again
+// when maxBytes is positive, a chunk taking the chunks of the session past maxBytes is rejected, keeping the chunk it would replace
+func (s *sessionStore) putChunk(id uuid.UUID, n int, body io.Reader, maxBytes int64) error {
+	if n < 1 || n > maxUploadChunks {
+		return &jsonError{Msg: fmt.Sprintf("chunk number must be between 1 and %d", maxUploadChunks)}
+	}
+	if _, err := s.get(id); err != nil {
+		return err
+	}
+	// the session cannot be completed until the chunk is written
+	s.mu.Lock()
+	if s.completing[id] {
+		s.mu.Unlock()
+		return &statusError{code: http.StatusConflict, err: &jsonError{Msg: fmt.Sprintf("upload session %s is being completed", id)}}
+	}
+	s.writing[id]++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.writing[id]--; s.writing[id] == 0 {
+			delete(s.writing, id)
+		}
+		s.written.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	tmp, size, err := writeTempFile(s.sessionDir(id), body)
+	if err != nil {
+		return err
+	}
+	// chunks written at the same time are checked against the limit one at a time
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if maxBytes > 0 {
+		chunks, err := s.chunks(id)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		for _, c := range chunks {
+			if c.Number != n {
+				size += c.Size
+			}
+		}
+		if size > maxBytes {
+			os.Remove(tmp)
+			return newLimitError("body_bytes", maxBytes, "upload chunks exceed the limit of %d bytes", maxBytes)
+		}
+	}
+	return os.Rename(tmp, s.chunkPath(id, n))
+}
+
+// claims a session for completion, returning its chunks as one body
+// chunks must be numbered contiguously from 1, and when expected is positive there must be that many of them
+// the session must be released once processed, removing it when it was completed
+func (s *sessionStore) assemble(id uuid.UUID, expected int) (*uploadSession, io.ReadCloser, error) {
+	// claim the session before listing its chunks, waiting for chunks being written
+	s.mu.Lock()
+	if s.completing[id] {
+		s.mu.Unlock()
+		return nil, nil, &statusError{code: http.StatusConflict, err: &jsonError{Msg: fmt.Sprintf("upload session %s is being completed", id)}}
+	}
+	s.completing[id] = true
+	for s.writing[id] > 0 {
+		s.written.Wait()
+	}
+	s.mu.Unlock()
+	session, body, err := s.chunkBody(id, expected)
+	if err != nil {
+		s.release(id, false)
+		return nil, nil, err
+	}
+	return session, body, nil
+}
+
+// returns a session along with its chunks as one body, checking none is missing
+func (s *sessionStore) chunkBody(id uuid.UUID, expected int) (*uploadSession, io.ReadCloser, error) {
+	session, err := s.get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	var missing []string
+	last := expected
+	if n := len(session.Chunks); n > 0 && session.Chunks[n-1].Number > last {
+		last = session.Chunks[n-1].Number
+	}
+	received := map[int]bool{}
+	for _, c := range session.Chunks {
+		received[c.Number] = true
+	}
+	for n := 1; n <= last; n++ {
+		if !received[n] {
+			missing = append(missing, strconv.Itoa(n))
+		}
+	}
+	if len(session.Chunks) == 0 {
+		return nil, nil, &jsonError{Msg: fmt.Sprintf("upload session %s has no chunks", id)}
+	}
+	if len(missing) > 0 {
+		return nil, nil, &jsonError{Msg: fmt.Sprintf("upload session %s is missing chunks %s", id, strings.Join(missing, ", "))}
+	}
+	if expected > 0 && len(session.Chunks) != expected {
+		return nil, nil, &jsonError{Msg: fmt.Sprintf("upload session %s has %d chunks, %d expected", id, len(session.Chunks), expected)}
+	}
+
+	paths := make([]string, len(session.Chunks))
+	for i, c := range session.Chunks {
+		paths[i] = s.chunkPath(id, c.Number)
+	}
+	return session, &chunkReader{paths: paths}, nil
+}
+
+// ends the completion of a session, removing it when it was completed
+// a session that failed to complete keeps its chunks, so that it can be corrected and completed again
+func (s *sessionStore) release(id uuid.UUID, completed bool) {
+	if completed {
+		if err := os.RemoveAll(s.sessionDir(id)); err != nil {
+			log.Error(err)
+		}
+	}
+	s.mu.Lock()
+	delete(s.completing, id)
+	s.mu.Unlock()
+}
+
+// removes sessions older than the retention period
+func (s *sessionStore) prune() {
+	if s.retention <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-s.retention)
+	for _, e := range entries {
+		id, err := uuid.FromString(e.Name())
+		if err != nil || !e.IsDir() || e.ModTime().After(cutoff) {
+			continue
+		}
+		s.mu.Lock()
+		completing := s.completing[id]
+		s.mu.Unlock()
+		if completing {
+			continue
+		}
+		if err := os.RemoveAll(s.sessionDir(id)); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// writes the contents of r to path through a temporary file
+// so that a failed write never leaves a partial file behind
+func writeFileAtomic(path string, r io.Reader) error {
+	tmp, _, err := writeTempFile(filepath.Dir(path), r)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writes the contents of r to a new temporary file of dir, returning its path and size
+// the file is removed if the write fails
+func writeTempFile(dir string, r io.Reader) (string, int64, error) {
+	tmp, err := ioutil.TempFile(dir, ".tmp-*")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return tmp.Name(), size, nil
+}
+
+// reads a sequence of files as one, opening each only once the previous one is exhausted
+type chunkReader struct {
+	paths   []string
+	current *os.File
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.paths) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(c.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			c.current, c.paths = f, c.paths[1:]
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close closes the file being read
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	err := c.current.Close()
+	c.current = nil
+	return err
+}
+
+func buildSessionHref(url string, port int, id string) string {
+	return fmt.Sprintf("%s:%d/uploads/%s", url, port, id)
+}
+
+func sessionID(r *http.Request) (uuid.UUID, error) {
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		return uuid.Nil, &jsonError{Msg: fmt.Sprintf("invalid upload session id %s", mux.Vars(r)["id"])}
+	}
+	return id, nil
+}
+
+// start a chunked upload
+// the file name, or the Content-Type and Content-Encoding headers, describe the file the chunks make up
+func (s *Server) createUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	filename := formValue(r, "filename")
+	format, compression, err := describeFile(filename, r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding"))
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	if filename != "" {
+		filename = filepath.Base(filename)
+	}
+	opts := uploadOptionsFromRequest(r)
+	session, err := s.sessions.create(uploadSession{
+		Country:       strings.ToLower(vars["countryAbbreviation"]),
+		Filename:      filename,
+		Label:         formValue(r, "label"),
+		Format:        format,
+		Compression:   compression,
+		NumberColumn:  opts.numberColumn,
+		CountryColumn: opts.countryColumn,
+		Passthrough:   opts.passthrough,
+		Force:         formBool(r, "force"),
+		Async:         formBool(r, "async"),
+	})
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", session.Href)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+// report an upload session, listing the chunks received so far
+func (s *Server) getUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	id, err := sessionID(r)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	session, err := s.sessions.get(id)
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(session)
+}
+
+// store a numbered chunk of an upload session
+func (s *Server) putUploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	id, err := sessionID(r)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	n, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil {
+		handleError(w, &jsonError{Msg: fmt.Sprintf("invalid chunk number %s", mux.Vars(r)["n"])}, http.StatusBadRequest)
+		return
+	}
+	body := newLimitedReader(r.Body, s.cfg.MaxChunkBytes, "chunk_bytes", "upload chunk")
+	// the chunks together make up the upload, so their total size is bound by the upload limit
+	if err := s.sessions.putChunk(id, n, body, s.cfg.MaxUploadBytes); err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	session, err := s.sessions.get(id)
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(session)
+}
+
+// assemble the chunks of an upload session and process them as a single upload
+// an optional chunks parameter gives the number of chunks expected
+func (s *Server) completeUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	id, err := sessionID(r)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	expected := 0
+	if v := formValue(r, "chunks"); v != "" {
+		if expected, err = strconv.Atoi(v); err != nil || expected < 1 {
+			handleError(w, &jsonError{Msg: fmt.Sprintf("invalid chunks %s", v)}, http.StatusBadRequest)
+			return
+		}
+	}
+	session, body, err := s.sessions.assemble(id, expected)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	up := session.upload(body)
+	completed := s.ingestUpload(w, r, up)
+	up.Close()
+	s.sessions.release(id, completed)
+}
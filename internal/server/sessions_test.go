@@ -0,0 +1,186 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadSession(t *testing.T) {
+	s := newSessionStore(t.TempDir(), time.Hour)
+	session, err := s.create(uploadSession{Country: "rsa", Format: csvFormat, NumberColumn: "phone"})
+	require.NoError(t, err)
+	require.Empty(t, session.Chunks)
+
+	// chunks may arrive in any order, and a chunk sent again replaces the earlier one
+	require.NoError(t, s.putChunk(session.ID, 2, strings.NewReader("1,27831234567\n"), 0))
+	require.NoError(t, s.putChunk(session.ID, 3, strings.NewReader("2,2783"), 0))
+	require.NoError(t, s.putChunk(session.ID, 1, strings.NewReader("id,phone\n"), 0))
+	require.NoError(t, s.putChunk(session.ID, 3, strings.NewReader("2,27831234568\n"), 0))
+
+	session, err = s.get(session.ID)
+	require.NoError(t, err)
+	require.Equal(t, []chunkInfo{{Number: 1, Size: 9}, {Number: 2, Size: 14}, {Number: 3, Size: 14}}, session.Chunks)
+	require.Equal(t, int64(37), session.ReceivedBytes)
+
+	_, _, err = s.assemble(session.ID, 4)
+	require.EqualError(t, err, "upload session "+session.ID.String()+" is missing chunks 4")
+
+	assembled, body, err := s.assemble(session.ID, 3)
+	require.NoError(t, err)
+	up := assembled.upload(body)
+	require.Equal(t, "phone", up.opts.numberColumn)
+
+	// chunks cannot change while the session is being completed
+	err = s.putChunk(session.ID, 4, strings.NewReader(""), 0)
+	status, ok := asStatusError(err)
+	require.True(t, ok)
+	require.Equal(t, http.StatusConflict, status.code)
+
+	rows, err := readUploadRows(up, DefaultConfig())
+	require.NoError(t, err)
+	require.NoError(t, up.Close())
+	require.Equal(t, []uploadRow{
+		{row: 1, number: "27831234567", country: "rsa"},
+		{row: 2, number: "27831234568", country: "rsa"},
+	}, withoutCells(rows))
+
+	s.release(session.ID, true)
+	_, err = s.get(session.ID)
+	status, ok = asStatusError(err)
+	require.True(t, ok)
+	require.Equal(t, http.StatusNotFound, status.code)
+}
+
+func TestUploadSessionMissingChunks(t *testing.T) {
+	s := newSessionStore(t.TempDir(), time.Hour)
+	session, err := s.create(uploadSession{Country: "rsa", Format: csvFormat})
+	require.NoError(t, err)
+
+	_, _, err = s.assemble(session.ID, 0)
+	require.EqualError(t, err, "upload session "+session.ID.String()+" has no chunks")
+
+	require.NoError(t, s.putChunk(session.ID, 1, strings.NewReader("a"), 0))
+	require.NoError(t, s.putChunk(session.ID, 4, strings.NewReader("d"), 0))
+	_, _, err = s.assemble(session.ID, 0)
+	require.EqualError(t, err, "upload session "+session.ID.String()+" is missing chunks 2, 3")
+
+	require.Error(t, s.putChunk(session.ID, 0, strings.NewReader(""), 0))
+
+	// a session that failed to complete keeps its chunks
+	require.NoError(t, s.putChunk(session.ID, 2, strings.NewReader("b"), 0))
+	require.NoError(t, s.putChunk(session.ID, 3, strings.NewReader("c"), 0))
+	_, body, err := s.assemble(session.ID, 4)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	require.Equal(t, "abcd", string(data))
+	require.NoError(t, body.Close())
+	s.release(session.ID, false)
+	_, err = s.get(session.ID)
+	require.NoError(t, err)
+}
+
+func TestUploadSessionPrune(t *testing.T) {
+	s := newSessionStore(t.TempDir(), time.Hour)
+	stale, err := s.create(uploadSession{Country: "rsa", Format: csvFormat})
+	require.NoError(t, err)
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(s.sessionDir(stale.ID), old, old))
+
+	fresh, err := s.create(uploadSession{Country: "rsa", Format: csvFormat})
+	require.NoError(t, err)
+	_, err = s.get(stale.ID)
+	require.Error(t, err)
+	_, err = s.get(fresh.ID)
+	require.NoError(t, err)
+
+	_, err = s.get(uuid.Must(uuid.NewV4()))
+	require.Error(t, err)
+}
+
+func TestUploadSessionLimit(t *testing.T) {
+	s := newSessionStore(t.TempDir(), time.Hour)
+	session, err := s.create(uploadSession{Country: "rsa", Format: csvFormat})
+	require.NoError(t, err)
+	require.NoError(t, s.putChunk(session.ID, 1, strings.NewReader("abcd"), 6))
+	require.NoError(t, s.putChunk(session.ID, 2, strings.NewReader("ef"), 6))
+
+	// a chunk sent again counts instead of the one it replaces, which is kept when it is rejected
+	require.NoError(t, s.putChunk(session.ID, 2, strings.NewReader("gh"), 6))
+	err = s.putChunk(session.ID, 2, strings.NewReader("ijk"), 6)
+	require.EqualError(t, err, "upload chunks exceed the limit of 6 bytes")
+	session, err = s.get(session.ID)
+	require.NoError(t, err)
+	require.Equal(t, []chunkInfo{{Number: 1, Size: 4}, {Number: 2, Size: 2}}, session.Chunks)
+	data, err := ioutil.ReadFile(s.chunkPath(session.ID, 2))
+	require.NoError(t, err)
+	require.Equal(t, "gh", string(data))
+
+	// nothing is left of the rejected chunk
+	entries, err := ioutil.ReadDir(s.sessionDir(session.ID))
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+}
+
+// a reader blocking until it is released
+type blockingReader struct {
+	started  chan struct{}
+	released chan struct{}
+	data     string
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	if b.started != nil {
+		close(b.started)
+		b.started = nil
+		<-b.released
+	}
+	if b.data == "" {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func TestUploadSessionCompletionWaitsForChunks(t *testing.T) {
+	s := newSessionStore(t.TempDir(), time.Hour)
+	session, err := s.create(uploadSession{Country: "rsa", Format: csvFormat})
+	require.NoError(t, err)
+	require.NoError(t, s.putChunk(session.ID, 1, strings.NewReader("a"), 0))
+
+	chunk := &blockingReader{started: make(chan struct{}), released: make(chan struct{}), data: "b"}
+	started := chunk.started
+	written := make(chan error)
+	go func() { written <- s.putChunk(session.ID, 2, chunk, 0) }()
+	<-started
+
+	var assembled *uploadSession
+	done := make(chan error)
+	go func() {
+		var body io.ReadCloser
+		assembled, body, err = s.assemble(session.ID, 0)
+		if err == nil {
+			err = body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("the session was completed while a chunk was being written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(chunk.released)
+	require.NoError(t, <-written)
+	require.NoError(t, <-done)
+	require.Equal(t, []chunkInfo{{Number: 1, Size: 1}, {Number: 2, Size: 1}}, assembled.Chunks)
+}
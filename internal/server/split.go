@@ -0,0 +1,104 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+)
+
+// separators found between the numbers of a cell holding several
+var cellSeparators = regexp.MustCompile(`(?i)\s*(?:[/;|&,\n]|\bor\b|\band\b)\s*`)
+
+// fewest digits each part of a cell must have for the cell to be split
+// shorter parts are taken to be pieces of a single number, such as a dialing code or digit groups
+const minSplitDigits = 8
+
+// splits a cell holding several mobile numbers into one string per number
+// nil is returned when the cell holds a single number
+func splitCell(cell string) []string {
+	cell = strings.TrimSpace(cell)
+	parts := cellSeparators.Split(cell, -1)
+	if len(parts) < 2 {
+		// without a separator, only whitespace can set numbers apart
+		parts = strings.Fields(cell)
+	}
+	if len(parts) < 2 {
+		return nil
+	}
+	for _, part := range parts {
+		if countDigits(part) < minSplitDigits {
+			return nil
+		}
+	}
+	return parts
+}
+
+func countDigits(s string) int {
+	digits := 0
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	return digits
+}
+
+// replaces each row whose cell holds several numbers with one row per number
+// the rows keep the row number of the cell, and are told apart by their part, counted from 1
+func splitRows(rows []uploadRow) []uploadRow {
+	var split []uploadRow
+	for i, row := range rows {
+		parts := splitRow(row)
+		if parts[0].part == 0 {
+			if split != nil {
+				split = append(split, row)
+			}
+			continue
+		}
+		// rows are only copied once a cell is split
+		if split == nil {
+			split = append(make([]uploadRow, 0, len(rows)+len(parts)), rows[:i]...)
+		}
+		split = append(split, parts...)
+	}
+	if split == nil {
+		return rows
+	}
+	return split
+}
+
+// returns a row for each number of the cell of row, or row itself for a cell holding one number
+func splitRow(row uploadRow) []uploadRow {
+	parts := splitCell(row.number)
+	if parts == nil {
+		return []uploadRow{row}
+	}
+	split := make([]uploadRow, len(parts))
+	for p, number := range parts {
+		split[p] = row
+		split[p].number = number
+		split[p].part = p + 1
+	}
+	return split
+}
+
+// counts the cells that were split into several rows
+func splitCellCount(rows []uploadRow) int {
+	count := 0
+	for _, row := range rows {
+		if row.part == 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// counts the rows read from the upload, the parts of a split cell sharing its row
+func sourceRowCount(rows []uploadRow) int {
+	count := 0
+	for _, row := range rows {
+		if row.part <= 1 {
+			count++
+		}
+	}
+	return count
+}
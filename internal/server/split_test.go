@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitCell(t *testing.T) {
+	tests := map[string][]string{
+		"0821234567 / 0831234567":          {"0821234567", "0831234567"},
+		"0821234567, 0831234567":           {"0821234567", "0831234567"},
+		"0821234567;0831234567;0841234567": {"0821234567", "0831234567", "0841234567"},
+		"0821234567 or 0831234567":         {"0821234567", "0831234567"},
+		"0821234567 AND 0831234567":        {"0821234567", "0831234567"},
+		"(082) 123-4567 | (083) 123-4567":  {"(082) 123-4567", "(083) 123-4567"},
+		"0821234567 0831234567":            {"0821234567", "0831234567"},
+		"27821234567":                      nil,
+		"082 123 4567":                     nil,
+		"+27 821234567":                    nil,
+		"27,821,234,567":                   nil,
+		"2,78212E+10":                      nil,
+		"0821234567 /":                     nil,
+		"0821234567 ext 12":                nil,
+		"_DELETED_1488996550 / 0831234567": {"_DELETED_1488996550", "0831234567"},
+		" 0821234567  /  0831234567 \n":    {"0821234567", "0831234567"},
+	}
+	for cell, expected := range tests {
+		require.Equal(t, expected, splitCell(cell), cell)
+	}
+}
+
+func TestSplitRows(t *testing.T) {
+	rows := []uploadRow{
+		{row: 1, number: "27821234567", country: "rsa"},
+		{row: 2, number: "0821234567 / 0831234567", country: "rsa", member: "a.csv"},
+		{row: 3, number: "27841234567", country: "rsa"},
+	}
+	split := splitRows(rows)
+	require.Equal(t, []uploadRow{
+		{row: 1, number: "27821234567", country: "rsa"},
+		{row: 2, number: "0821234567", country: "rsa", member: "a.csv", part: 1},
+		{row: 2, number: "0831234567", country: "rsa", member: "a.csv", part: 2},
+		{row: 3, number: "27841234567", country: "rsa"},
+	}, split)
+	require.Equal(t, 1, splitCellCount(split))
+	require.Equal(t, 3, sourceRowCount(split))
+
+	// rows without split cells are returned as they are
+	unsplit := []uploadRow{{row: 1, number: "27821234567", country: "rsa"}}
+	require.Equal(t, unsplit, splitRows(unsplit))
+	require.Equal(t, 0, splitCellCount(unsplit))
+}
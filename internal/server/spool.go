@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// rows of an upload held in memory, beyond which they are spilled to a temporary file
+const maxBufferedRows = 10000
+
+// the rows of an upload, read once to fingerprint and describe them, then read again in chunks to process them
+// the upload must be fingerprinted before it is processed, as content processed before is not processed again,
+// so rows are spooled rather than held in memory past maxBufferedRows
+type uploadRows struct {
+	// number of rows, each number of a split cell counting as a row, and of rows read from the upload
+	count      int
+	sourceRows int
+	splitCells int
+	columns    *sourceColumns
+	// fingerprint of the rows, and the countries whose rules apply to them, set once every row is added
+	fingerprint string
+	countries   map[string]bool
+	fp          *fingerprinter
+
+	buffered []uploadRow
+	spill    *os.File
+	w        *bufio.Writer
+	enc      *gob.Encoder
+	// columns of spilled rows, each different set of columns spilled once and referred to by position
+	columnSets [][]string
+	columnIDs  map[string]int
+}
+
+// a row as it is spilled, its columns referring to a set of columns kept in memory
+type spilledRow struct {
+	Row         int
+	Part        int
+	Number      string
+	Country     string
+	Member      string
+	Passthrough store.Passthrough
+	// position of the columns of the row in columnSets, 0 for a row without columns
+	Columns int
+	Cells   []string
+}
+
+func newUploadRows(country string) *uploadRows {
+	return &uploadRows{
+		columns:    newSourceColumns(),
+		fp:         newFingerprinter(country),
+		columnSets: [][]string{nil},
+		columnIDs:  map[string]int{},
+	}
+}
+
+// adds a row read from the upload, in file order
+func (u *uploadRows) add(row uploadRow) error {
+	u.count++
+	u.sourceRows += sourceRowCount([]uploadRow{row})
+	u.splitCells += splitCellCount([]uploadRow{row})
+	u.columns.positionsOf(row.columns)
+	u.fp.add(row)
+	if u.spill == nil && len(u.buffered) < maxBufferedRows {
+		u.buffered = append(u.buffered, row)
+		return nil
+	}
+	if u.spill == nil {
+		if err := u.startSpill(); err != nil {
+			return err
+		}
+	}
+	return u.encode(row)
+}
+
+// moves the rows held in memory to a temporary file, where the rows that follow are added
+func (u *uploadRows) startSpill() error {
+	f, err := ioutil.TempFile("", "upload-rows-*")
+	if err != nil {
+		return err
+	}
+	u.spill = f
+	u.w = bufio.NewWriter(f)
+	u.enc = gob.NewEncoder(u.w)
+	for _, row := range u.buffered {
+		if err := u.encode(row); err != nil {
+			return err
+		}
+	}
+	u.buffered = nil
+	return nil
+}
+
+func (u *uploadRows) encode(row uploadRow) error {
+	return u.enc.Encode(spilledRow{Row: row.row, Part: row.part, Number: row.number, Country: row.country, Member: row.member,
+		Passthrough: row.passthrough, Columns: u.columnSet(row.columns), Cells: row.cells})
+}
+
+// returns the position of columns among the sets of columns spilled, adding it if it was not spilled before
+func (u *uploadRows) columnSet(columns []string) int {
+	if columns == nil {
+		return 0
+	}
+	key := strconv.Itoa(len(columns)) + "\x00" + strings.Join(columns, "\x00")
+	id, found := u.columnIDs[key]
+	if !found {
+		id = len(u.columnSets)
+		u.columnSets = append(u.columnSets, columns)
+		u.columnIDs[key] = id
+	}
+	return id
+}
+
+// completes the rows once every row of the upload is added
+func (u *uploadRows) finish() error {
+	u.fingerprint = u.fp.sum()
+	u.countries = u.fp.countries
+	if u.spill == nil {
+		return nil
+	}
+	return u.w.Flush()
+}
+
+// calls fn with the rows in file order, at most size rows at a time
+// the rows of a chunk are only valid until fn returns
+func (u *uploadRows) each(size int, fn func(chunk []uploadRow) error) error {
+	if size < 1 {
+		size = 1
+	}
+	if u.spill == nil {
+		for start := 0; start < len(u.buffered); start += size {
+			end := start + size
+			if end > len(u.buffered) {
+				end = len(u.buffered)
+			}
+			if err := fn(u.buffered[start:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, err := u.spill.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dec := gob.NewDecoder(bufio.NewReader(u.spill))
+	chunk := make([]uploadRow, 0, size)
+	for read := 0; read < u.count; read++ {
+		var row spilledRow
+		if err := dec.Decode(&row); err != nil {
+			return err
+		}
+		chunk = append(chunk, uploadRow{row: row.Row, part: row.Part, number: row.Number, country: row.Country,
+			member: row.Member, passthrough: row.Passthrough, columns: u.columnSets[row.Columns], cells: row.Cells})
+		if len(chunk) == size {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+		}
+	}
+	if len(chunk) > 0 {
+		return fn(chunk)
+	}
+	return nil
+}
+
+// removes the temporary file the rows were spilled to, if any
+func (u *uploadRows) Close() error {
+	if u.spill == nil {
+		return nil
+	}
+	u.spill.Close()
+	if err := os.Remove(u.spill.Name()); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolUploadRows(t *testing.T) {
+	body := &strings.Builder{}
+	body.WriteString("id,sms_phone,name\n")
+	for i := 1; i <= maxBufferedRows+5; i++ {
+		number := fmt.Sprintf("2771%07d", i)
+		if i == 3 {
+			// a cell holding two numbers gives two rows
+			number = "27710000001 / 27710000002"
+		}
+		fmt.Fprintf(body, "%d,%s,name %d\n", i, number, i)
+	}
+	up := func() *upload {
+		return &upload{body: ioutil.NopCloser(strings.NewReader(body.String())), format: csvFormat, country: "rsa",
+			opts: uploadOptions{passthrough: []string{"name"}}}
+	}
+	expected, err := collectRows(up().body, csvFormat, "rsa", uploadOptions{passthrough: []string{"name"}}, nil)
+	require.NoError(t, err)
+	for i := range expected {
+		expected[i].row = i + 1
+	}
+	expected = splitRows(expected)
+
+	rows, err := spoolUploadRows(up(), DefaultConfig())
+	require.NoError(t, err)
+	// rows past those held in memory are spilled to disk
+	require.NotNil(t, rows.spill)
+	require.Equal(t, maxBufferedRows+6, rows.count)
+	require.Equal(t, maxBufferedRows+5, rows.sourceRows)
+	require.Equal(t, 1, rows.splitCells)
+	require.Equal(t, []string{"id", "sms_phone", "name"}, rows.columns.names)
+	require.Equal(t, fingerprint(expected, "rsa"), rows.fingerprint)
+
+	// rows are read back in file order, in chunks, as many times as needed
+	for pass := 0; pass < 2; pass++ {
+		var read []uploadRow
+		err = rows.each(999, func(chunk []uploadRow) error {
+			require.True(t, len(chunk) <= 999)
+			read = append(read, chunk...)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, expected, read)
+	}
+
+	// the spilled rows are removed once released
+	require.NoError(t, rows.Close())
+	_, err = os.Stat(rows.spill.Name())
+	require.True(t, os.IsNotExist(err))
+
+	// small uploads are kept in memory
+	rows, err = spoolUploadRows(&upload{body: ioutil.NopCloser(strings.NewReader("id,sms_phone\n1,27717278645\n")),
+		format: csvFormat, country: "rsa"}, DefaultConfig())
+	require.NoError(t, err)
+	require.Nil(t, rows.spill)
+	require.Equal(t, 1, rows.count)
+	require.NoError(t, rows.Close())
+}
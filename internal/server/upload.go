@@ -0,0 +1,617 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// supported upload body formats, by Content-Type
+const (
+	csvFormat    = "text/csv"
+	jsonFormat   = "application/json"
+	ndjsonFormat = "application/x-ndjson"
+)
+
+// column holding the mobile number when no number_column option is given
+const defaultNumberColumn = "sms_phone"
+
+// options controlling how the rows of an uploaded file are interpreted
+type uploadOptions struct {
+	// header column or object field holding the mobile number
+	// when empty, sms_phone is used, falling back to the second CSV column
+	numberColumn string
+	// header column or object field supplying each row's country IOC code
+	// when empty, every row uses the country given in the URL
+	countryColumn string
+	// header columns or object fields kept with each number and echoed in downloads
+	passthrough []string
+}
+
+// reads upload options from the request query string, or from the form fields of a multipart upload
+func uploadOptionsFromRequest(r *http.Request) uploadOptions {
+	return uploadOptions{
+		numberColumn:  formValue(r, "number_column"),
+		countryColumn: formValue(r, "country_column"),
+		passthrough:   passthroughColumns(formValue(r, "passthrough")),
+	}
+}
+
+// parses a comma separated list of passthrough columns
+func passthroughColumns(value string) []string {
+	var columns []string
+	for _, column := range strings.Split(value, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+func (o uploadOptions) numberField() string {
+	if o.numberColumn == "" {
+		return defaultNumberColumn
+	}
+	return o.numberColumn
+}
+
+// a single mobile number extracted from an uploaded file
+type uploadRow struct {
+	// position of the row in the upload, starting from 1 and excluding any header
+	row     int
+	number  string
+	country string
+	// zip archive member the row was read from
+	member string
+	// numbers the numbers of a cell holding several, 0 for a cell holding one
+	part int
+	// values of the passthrough columns, by column
+	passthrough store.Passthrough
+	// columns of the row, the header of a CSV file or the sorted fields of a JSON object, naming its cells
+	columns []string
+	// every cell of the row, shared by the numbers of a split cell
+	cells []string
+}
+
+// memory used to hold a multipart upload before spilling the file to disk
+const maxMultipartMemory = 32 << 20
+
+// form field holding the file in a multipart upload
+const multipartFileField = "file"
+
+// an upload request body along with how it should be interpreted
+type upload struct {
+	body        io.ReadCloser
+	format      string
+	compression string
+	country     string
+	opts        uploadOptions
+	filename    string
+	label       string
+	// process the upload even if the same content was processed before
+	force bool
+	// process the upload in the background
+	async bool
+}
+
+// Close releases the upload body
+func (u *upload) Close() error {
+	return u.body.Close()
+}
+
+// limits the size of the request body to maxBytes, 0 for no limit
+// reading beyond the limit fails with a 413 error
+func limitRequestBody(r *http.Request, maxBytes int64) {
+	if maxBytes <= 0 {
+		return
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{newLimitedReader(r.Body, maxBytes, "body_bytes", "upload body"), r.Body}
+}
+
+// reads an upload from the request
+// the body is either the file itself, or a multipart form holding the file and its options
+func parseUpload(r *http.Request, country string) (*upload, error) {
+	contentType := r.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/form-data" {
+		up := &upload{
+			body:    r.Body,
+			format:  csvFormat,
+			country: country,
+			opts:    uploadOptionsFromRequest(r),
+			label:   formValue(r, "label"),
+			force:   formBool(r, "force"),
+			async:   formBool(r, "async"),
+		}
+		format, compression, err := describeFile("", contentType, r.Header.Get("Content-Encoding"))
+		if err != nil {
+			return nil, err
+		}
+		up.format, up.compression = format, compression
+		return up, nil
+	}
+
+	if err := r.ParseMultipartForm(maxMultipartMemory); err != nil {
+		return nil, decodeError(err, "invalid multipart upload: %s")
+	}
+	file, header, err := r.FormFile(multipartFileField)
+	if err != nil {
+		return nil, &jsonError{Msg: fmt.Sprintf("multipart upload has no %s part: %s", multipartFileField, err)}
+	}
+	format, compression, err := describeFile(header.Filename, header.Header.Get("Content-Type"), "")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if c := strings.ToLower(formValue(r, "country")); c != "" {
+		country = c
+	}
+	return &upload{
+		body:        file,
+		format:      format,
+		compression: compression,
+		country:     country,
+		opts:        uploadOptionsFromRequest(r),
+		filename:    filepath.Base(header.Filename),
+		label:       formValue(r, "label"),
+		force:       formBool(r, "force"),
+		async:       formBool(r, "async"),
+	}, nil
+}
+
+// determines the format and compression of an uploaded file from its name, Content-Type and Content-Encoding
+// the format of a compressed file is given by the extension under the compression extension,
+// as in numbers.csv.gz, and a gzip or zip content type holds CSV, zip archive members are identified individually
+func describeFile(filename string, contentType string, contentEncoding string) (string, string, error) {
+	compression := fileCompression(filename, contentType)
+	format := csvFormat
+	var err error
+	switch compression {
+	case gzipCompression:
+		format, err = fileFormat(strings.TrimSuffix(filename, filepath.Ext(filename)), "")
+	case "":
+		if strings.EqualFold(strings.TrimSpace(contentEncoding), gzipCompression) {
+			compression = gzipCompression
+		}
+		format, err = fileFormat(filename, contentType)
+	}
+	if err != nil {
+		return "", "", &statusError{code: http.StatusUnsupportedMediaType, err: err}
+	}
+	return format, compression, nil
+}
+
+// returns the named multipart form field, falling back to the query string
+func formValue(r *http.Request, name string) string {
+	if r.MultipartForm != nil {
+		if values := r.MultipartForm.Value[name]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+	}
+	return strings.TrimSpace(r.URL.Query().Get(name))
+}
+
+// reports whether the named form field or query parameter is set to true
+func formBool(r *http.Request, name string) bool {
+	b, err := strconv.ParseBool(formValue(r, name))
+	return err == nil && b
+}
+
+// determines the format of an uploaded file from its extension, falling back to its Content-Type
+func fileFormat(filename string, contentType string) (string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return csvFormat, nil
+	case ".json":
+		return jsonFormat, nil
+	case ".ndjson", ".jsonl":
+		return ndjsonFormat, nil
+	}
+	if contentType == "application/octet-stream" {
+		return csvFormat, nil
+	}
+	return uploadFormat(contentType)
+}
+
+// determines the upload format from a Content-Type header
+// an empty Content-Type is treated as CSV
+func uploadFormat(contentType string) (string, error) {
+	if contentType == "" {
+		return csvFormat, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", &jsonError{Msg: fmt.Sprintf("invalid Content-Type %s", contentType)}
+	}
+	switch mediaType {
+	case csvFormat, "application/csv", "text/plain":
+		return csvFormat, nil
+	case jsonFormat:
+		return jsonFormat, nil
+	case ndjsonFormat, "application/ndjson", "application/jsonl":
+		return ndjsonFormat, nil
+	}
+	return "", &jsonError{Msg: fmt.Sprintf("unsupported Content-Type %s, expected %s, %s or %s", mediaType, csvFormat, jsonFormat, ndjsonFormat)}
+}
+
+// bounds on the shape of an upload, enforced while it is read
+// zero values mean no limit, as does a nil *uploadLimits
+type uploadLimits struct {
+	maxRows    int
+	maxColumns int
+	// rows read so far, across all files of a zip archive
+	rows int
+	// reading stops once this many rows were read, 0 to read every row
+	sample int
+	// when set, filled in with how the upload was interpreted
+	dialect *dialect
+}
+
+// how an upload was interpreted
+type dialect struct {
+	Format      string `json:"format"`
+	Compression string `json:"compression,omitempty"`
+	// field delimiter and header columns of a CSV upload
+	Delimiter     string   `json:"delimiter,omitempty"`
+	Header        []string `json:"header,omitempty"`
+	NumberColumn  string   `json:"number_column"`
+	CountryColumn string   `json:"country_column,omitempty"`
+	Passthrough   []string `json:"passthrough,omitempty"`
+	// zip archive members read
+	Members []string `json:"members,omitempty"`
+}
+
+// records how the upload was interpreted, unless an earlier zip archive member already did
+func (l *uploadLimits) detected(d dialect) {
+	if l == nil || l.dialect == nil || l.dialect.NumberColumn != "" {
+		return
+	}
+	d.Format, d.Compression, d.Members = l.dialect.Format, l.dialect.Compression, l.dialect.Members
+	*l.dialect = d
+}
+
+// reports whether enough rows were read for a sample of the upload
+func (l *uploadLimits) sampled() bool {
+	return l != nil && l.sample > 0 && l.rows >= l.sample
+}
+
+// counts a row read from the upload
+func (l *uploadLimits) addRow() error {
+	if l == nil {
+		return nil
+	}
+	l.rows++
+	if l.maxRows > 0 && l.rows > l.maxRows {
+		return newLimitError("rows", int64(l.maxRows), "upload has more than %d rows", l.maxRows)
+	}
+	return nil
+}
+
+// checks the number of columns of a CSV header or fields of a JSON object
+func (l *uploadLimits) checkColumns(columns int) error {
+	if l == nil || l.maxColumns <= 0 || columns <= l.maxColumns {
+		return nil
+	}
+	return newLimitError("columns", int64(l.maxColumns), "upload has %d columns, the limit is %d", columns, l.maxColumns)
+}
+
+// reads the mobile numbers held in body, which is in the given upload format, calling emit with each row as it is read
+// rows without a country fall back to defaultCountry
+func readRows(body io.Reader, format string, defaultCountry string, opts uploadOptions, limits *uploadLimits,
+	emit func(row uploadRow) error) error {
+	switch format {
+	case jsonFormat:
+		return readJSONRows(body, defaultCountry, opts, limits, emit)
+	case ndjsonFormat:
+		return readNDJSONRows(body, defaultCountry, opts, limits, emit)
+	}
+	return readCSVRows(body, defaultCountry, opts, limits, emit)
+}
+
+// reads the number and country of each CSV record, using the header row to locate the columns
+// rows with an empty country cell fall back to defaultCountry
+func readCSVRows(body io.Reader, defaultCountry string, opts uploadOptions, limits *uploadLimits, emit func(row uploadRow) error) error {
+	br := bufio.NewReader(body)
+	firstLine, err := br.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	r := csv.NewReader(io.MultiReader(bytes.NewReader(firstLine), br))
+	r.Comma = sniffDelimiter(firstLine)
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := limits.checkColumns(len(header)); err != nil {
+		return err
+	}
+	numberIdx := columnIndex(header, opts.numberField())
+	if numberIdx < 0 {
+		if opts.numberColumn != "" {
+			return &jsonError{Msg: fmt.Sprintf("number column %s not found in header", opts.numberColumn)}
+		}
+		numberIdx = 1
+	}
+	countryIdx := -1
+	if opts.countryColumn != "" {
+		countryIdx = columnIndex(header, opts.countryColumn)
+		if countryIdx < 0 {
+			return &jsonError{Msg: fmt.Sprintf("country column %s not found in header", opts.countryColumn)}
+		}
+	}
+	passthroughIdx := make([]int, len(opts.passthrough))
+	for i, column := range opts.passthrough {
+		if passthroughIdx[i] = columnIndex(header, column); passthroughIdx[i] < 0 {
+			return &jsonError{Msg: fmt.Sprintf("passthrough column %s not found in header", column)}
+		}
+	}
+	d := dialect{Delimiter: string(r.Comma), Header: header, CountryColumn: opts.countryColumn, Passthrough: opts.passthrough}
+	if numberIdx < len(header) {
+		d.NumberColumn = header[numberIdx]
+	}
+	limits.detected(d)
+
+	for n := 1; !limits.sampled(); n++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := limits.addRow(); err != nil {
+			return err
+		}
+		if len(record) <= numberIdx {
+			return &jsonError{Msg: fmt.Sprintf("row %d has no %s column", n, opts.numberField())}
+		}
+		row := uploadRow{number: record[numberIdx], country: defaultCountry, columns: header, cells: record}
+		if countryIdx >= 0 {
+			row.country = rowCountry(record[countryIdx], defaultCountry)
+		}
+		if len(passthroughIdx) > 0 {
+			row.passthrough = store.Passthrough{}
+			for i, idx := range passthroughIdx {
+				if idx < len(record) {
+					row.passthrough[opts.passthrough[i]] = record[idx]
+				} else {
+					row.passthrough[opts.passthrough[i]] = ""
+				}
+			}
+		}
+		if err := emit(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CSV field delimiters recognised in uploads, as exported by spreadsheets in different locales
+var csvDelimiters = []rune{',', ';', '\t', '|'}
+
+// guesses the field delimiter of CSV data from its first line, as the most frequent delimiter outside quotes
+// a comma is assumed when no delimiter occurs
+func sniffDelimiter(firstLine []byte) rune {
+	counts := map[rune]int{}
+	quoted := false
+	for _, c := range string(firstLine) {
+		if c == '"' {
+			quoted = !quoted
+		} else if !quoted {
+			counts[c]++
+		}
+	}
+	delimiter := ','
+	for _, c := range csvDelimiters {
+		if counts[c] > counts[delimiter] {
+			delimiter = c
+		}
+	}
+	return delimiter
+}
+
+// reads a JSON array of objects, one object per mobile number
+func readJSONRows(body io.Reader, defaultCountry string, opts uploadOptions, limits *uploadLimits, emit func(row uploadRow) error) error {
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return decodeError(err, "invalid JSON body: %s")
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return &jsonError{Msg: "JSON body must be an array of objects"}
+	}
+	limits.detected(dialect{NumberColumn: opts.numberField(), CountryColumn: opts.countryColumn, Passthrough: opts.passthrough})
+	for n := 1; !limits.sampled() && dec.More(); n++ {
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil {
+			return decodeError(err, "invalid JSON object %d: %s", n)
+		}
+		row, err := objectRow(obj, n, defaultCountry, opts, limits)
+		if err != nil {
+			return err
+		}
+		if err := emit(row); err != nil {
+			return err
+		}
+	}
+	if limits.sampled() {
+		return nil
+	}
+	if _, err := dec.Token(); err != nil {
+		return decodeError(err, "invalid JSON body: %s")
+	}
+	return nil
+}
+
+// reads newline delimited JSON, one object per line
+// blank lines are ignored
+func readNDJSONRows(body io.Reader, defaultCountry string, opts uploadOptions, limits *uploadLimits,
+	emit func(row uploadRow) error) error {
+	limits.detected(dialect{NumberColumn: opts.numberField(), CountryColumn: opts.countryColumn, Passthrough: opts.passthrough})
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for !limits.sampled() && scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil {
+			return decodeError(err, "invalid JSON on line %d: %s", line)
+		}
+		row, err := objectRow(obj, line, defaultCountry, opts, limits)
+		if err != nil {
+			return err
+		}
+		if err := emit(row); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// describes a failure to decode the upload body
+// errors raised by the body reader itself, such as an exceeded size limit, are returned as is
+func decodeError(err error, format string, args ...interface{}) error {
+	if _, ok := asStatusError(err); ok {
+		return err
+	}
+	return &jsonError{Msg: fmt.Sprintf(format, append(args, err)...)}
+}
+
+// maps the fields of a JSON object onto an upload row
+// pos identifies the object in error messages
+func objectRow(obj map[string]interface{}, pos int, defaultCountry string, opts uploadOptions, limits *uploadLimits) (uploadRow, error) {
+	if err := limits.checkColumns(len(obj)); err != nil {
+		return uploadRow{}, err
+	}
+	if err := limits.addRow(); err != nil {
+		return uploadRow{}, err
+	}
+	number, found, err := fieldValue(obj, opts.numberField())
+	if err != nil {
+		return uploadRow{}, &jsonError{Msg: fmt.Sprintf("object %d: %s", pos, err)}
+	}
+	if !found {
+		return uploadRow{}, &jsonError{Msg: fmt.Sprintf("object %d has no %s field", pos, opts.numberField())}
+	}
+	row := uploadRow{number: number, country: defaultCountry}
+	row.columns, row.cells = objectCells(obj)
+	if opts.countryColumn != "" {
+		country, _, err := fieldValue(obj, opts.countryColumn)
+		if err != nil {
+			return uploadRow{}, &jsonError{Msg: fmt.Sprintf("object %d: %s", pos, err)}
+		}
+		row.country = rowCountry(country, defaultCountry)
+	}
+	if len(opts.passthrough) > 0 {
+		row.passthrough = store.Passthrough{}
+		for _, column := range opts.passthrough {
+			value, err := passthroughValue(obj, column)
+			if err != nil {
+				return uploadRow{}, &jsonError{Msg: fmt.Sprintf("object %d: %s", pos, err)}
+			}
+			row.passthrough[column] = value
+		}
+	}
+	return row, nil
+}
+
+// returns the named field of a JSON object as a string, missing fields being empty
+// unlike numbers, passthrough fields such as opt-in flags may be booleans
+func passthroughValue(obj map[string]interface{}, name string) (string, error) {
+	for key, val := range obj {
+		if b, ok := val.(bool); ok && strings.EqualFold(strings.TrimSpace(key), name) {
+			return strconv.FormatBool(b), nil
+		}
+	}
+	value, _, err := fieldValue(obj, name)
+	return value, err
+}
+
+// returns the fields of a JSON object in sorted order, along with their values as strings
+// nested objects and arrays are kept as JSON, null values are empty
+func objectCells(obj map[string]interface{}) ([]string, []string) {
+	columns := make([]string, 0, len(obj))
+	for key := range obj {
+		columns = append(columns, key)
+	}
+	sort.Strings(columns)
+	cells := make([]string, len(columns))
+	for i, key := range columns {
+		switch v := obj[key].(type) {
+		case nil:
+		case string:
+			cells[i] = v
+		case json.Number:
+			cells[i] = v.String()
+		case bool:
+			cells[i] = strconv.FormatBool(v)
+		default:
+			data, _ := json.Marshal(v)
+			cells[i] = string(data)
+		}
+	}
+	return columns, cells
+}
+
+// returns the named field of a JSON object as a string
+// field names are matched case insensitively, null values are returned as empty strings
+func fieldValue(obj map[string]interface{}, name string) (string, bool, error) {
+	for key, val := range obj {
+		if !strings.EqualFold(strings.TrimSpace(key), name) {
+			continue
+		}
+		switch v := val.(type) {
+		case nil:
+			return "", true, nil
+		case string:
+			return v, true, nil
+		case json.Number:
+			return v.String(), true, nil
+		}
+		return "", true, fmt.Errorf("field %s must be a string or number", key)
+	}
+	return "", false, nil
+}
+
+// normalises a country cell, falling back to defaultCountry when it is empty
+func rowCountry(cell string, defaultCountry string) string {
+	if country := strings.ToLower(strings.TrimSpace(cell)); country != "" {
+		return country
+	}
+	return defaultCountry
+}
+
+// returns the index of the named column in the header row, or -1 if not present
+// column names are matched case insensitively
+func columnIndex(header []string, name string) int {
+	for i, col := range header {
+		if strings.EqualFold(strings.TrimSpace(col), name) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// reads every row of body
+func collectRows(body io.Reader, format string, defaultCountry string, opts uploadOptions, limits *uploadLimits) ([]uploadRow, error) {
+	var rows []uploadRow
+	err := readRows(body, format, defaultCountry, opts, limits, func(row uploadRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	return rows, err
+}
+
+// returns the fingerprint of rows, read in order from an upload made for country
+func fingerprint(rows []uploadRow, country string) string {
+	f := newFingerprinter(country)
+	for _, row := range rows {
+		f.add(row)
+	}
+	return f.sum()
+}
+
+func TestReadCSVRows(t *testing.T) {
+	body := "id,sms_phone,Country\n1,27717278645,RSA\n2,61412345,aus\n3,27717278646,\n"
+	tests := map[string]struct {
+		opts     uploadOptions
+		expected []uploadRow
+		err      bool
+	}{
+		"URL country for every row": {
+			opts: uploadOptions{},
+			expected: []uploadRow{
+				{number: "27717278645", country: "por"},
+				{number: "61412345", country: "por"},
+				{number: "27717278646", country: "por"},
+			},
+		},
+		"country column with fallback to URL country": {
+			opts: uploadOptions{countryColumn: "country"},
+			expected: []uploadRow{
+				{number: "27717278645", country: "rsa"},
+				{number: "61412345", country: "aus"},
+				{number: "27717278646", country: "por"},
+			},
+		},
+		"unknown country column": {
+			opts: uploadOptions{countryColumn: "market"},
+			err:  true,
+		},
+	}
+	for tName, test := range tests {
+		actual, err := collectRows(strings.NewReader(body), csvFormat, "por", test.opts, nil)
+		if test.err {
+			require.Error(t, err, tName)
+			continue
+		}
+		require.NoError(t, err, tName)
+		require.Equal(t, test.expected, withoutCells(actual), tName)
+	}
+}
+
+func TestReadRowsFormats(t *testing.T) {
+	expected := []uploadRow{
+		{number: "27717278645", country: "rsa"},
+		{number: "61412345", country: "aus"},
+		{number: "27717278646", country: "por"},
+	}
+	bodies := map[string]string{
+		csvFormat: "id,sms_phone,country\n1,27717278645,rsa\n2,61412345,AUS\n3,27717278646,\n",
+		jsonFormat: `[
+			{"id": 1, "sms_phone": 27717278645, "country": "rsa"},
+			{"id": 2, "sms_phone": "61412345", "country": "AUS"},
+			{"id": 3, "sms_phone": "27717278646", "country": null}
+		]`,
+		ndjsonFormat: "{\"sms_phone\": \"27717278645\", \"country\": \"rsa\"}\n\n" +
+			"{\"sms_phone\": 61412345, \"country\": \"aus\"}\n" +
+			"{\"sms_phone\": \"27717278646\"}\n",
+	}
+	for format, body := range bodies {
+		actual, err := collectRows(strings.NewReader(body), format, "por", uploadOptions{countryColumn: "country"}, nil)
+		require.NoError(t, err, format)
+		require.Equal(t, expected, withoutCells(actual), format)
+	}
+}
+
+// returns rows without the cells they were read from, for tests of how their numbers are read
+func withoutCells(rows []uploadRow) []uploadRow {
+	for i := range rows {
+		rows[i].columns, rows[i].cells = nil, nil
+	}
+	return rows
+}
+
+func TestReadRowsCells(t *testing.T) {
+	rows, err := collectRows(strings.NewReader("id,sms_phone,name\n1,27717278645,Ann\n2,27717278646,\n"), csvFormat, "rsa",
+		uploadOptions{}, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	require.Equal(t, []string{"id", "sms_phone", "name"}, rows[0].columns)
+	require.Equal(t, []string{"1", "27717278645", "Ann"}, rows[0].cells)
+	require.Equal(t, []string{"2", "27717278646", ""}, rows[1].cells)
+
+	rows, err = collectRows(strings.NewReader(`[{"sms_phone": 27717278645, "opt_in": true, "name": null, "tags": ["a", "b"]}]`),
+		jsonFormat, "rsa", uploadOptions{}, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	require.Equal(t, []string{"name", "opt_in", "sms_phone", "tags"}, rows[0].columns)
+	require.Equal(t, []string{"", "true", "27717278645", `["a","b"]`}, rows[0].cells)
+}
+
+func TestReadRowsMissingNumberField(t *testing.T) {
+	_, err := collectRows(strings.NewReader(`[{"phone": "27717278645"}]`), jsonFormat, "rsa", uploadOptions{}, nil)
+	require.Error(t, err)
+	rows, err := collectRows(strings.NewReader(`[{"phone": "27717278645"}]`), jsonFormat, "rsa", uploadOptions{numberColumn: "phone"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []uploadRow{{number: "27717278645", country: "rsa"}}, withoutCells(rows))
+}
+
+func TestReadRowsPassthrough(t *testing.T) {
+	opts := uploadOptions{passthrough: []string{"name", "opt_in"}}
+	expected := []uploadRow{
+		{number: "27717278645", country: "rsa", passthrough: store.Passthrough{"name": "Ann", "opt_in": "true"}},
+		{number: "27717278646", country: "rsa", passthrough: store.Passthrough{"name": "Bob", "opt_in": ""}},
+	}
+	bodies := map[string]string{
+		csvFormat: "Name,sms_phone,Opt_In\nAnn,27717278645,true\nBob,27717278646,\n",
+		jsonFormat: `[
+			{"name": "Ann", "sms_phone": "27717278645", "opt_in": true},
+			{"name": "Bob", "sms_phone": "27717278646"}
+		]`,
+	}
+	for format, body := range bodies {
+		actual, err := collectRows(strings.NewReader(body), format, "rsa", opts, nil)
+		require.NoError(t, err, format)
+		require.Equal(t, expected, withoutCells(actual), format)
+	}
+
+	_, err := collectRows(strings.NewReader("id,sms_phone\n1,27717278645\n"), csvFormat, "rsa", opts, nil)
+	require.EqualError(t, err, "passthrough column name not found in header")
+	require.Equal(t, []string{"name", "opt_in"}, passthroughColumns(" name, ,opt_in "))
+	require.Nil(t, passthroughColumns(""))
+
+	// passthrough values are stored with the numbers, so different values are different content
+	changed := []uploadRow{expected[0], {number: "27717278646", country: "rsa", passthrough: store.Passthrough{"name": "Eve", "opt_in": ""}}}
+	require.NotEqual(t, fingerprint(expected, "rsa"), fingerprint(changed, "rsa"))
+}
+
+func TestParseMultipartUpload(t *testing.T) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.NoError(t, mw.WriteField("country", "AUS"))
+	require.NoError(t, mw.WriteField("label", "march campaign"))
+	require.NoError(t, mw.WriteField("number_column", "phone"))
+	part, err := mw.CreateFormFile("file", "customers.ndjson")
+	require.NoError(t, err)
+	_, err = part.Write([]byte("{\"phone\": \"61412345678\"}\n"))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest("POST", "/rsa/numbers", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	up, err := parseUpload(req, "rsa")
+	require.NoError(t, err)
+	defer up.Close()
+	require.Equal(t, ndjsonFormat, up.format)
+	require.Equal(t, "aus", up.country)
+	require.Equal(t, "customers.ndjson", up.filename)
+	require.Equal(t, "march campaign", up.label)
+
+	rows, err := collectRows(up.body, up.format, up.country, up.opts, nil)
+	require.NoError(t, err)
+	require.Equal(t, []uploadRow{{number: "61412345678", country: "aus"}}, withoutCells(rows))
+}
+
+func TestFingerprint(t *testing.T) {
+	rows := []uploadRow{
+		{number: "27717278645", country: "rsa"},
+		{number: "61412345678", country: "aus"},
+	}
+	reformatted := []uploadRow{
+		{number: " 27717278645 ", country: "rsa"},
+		{number: "61412345678", country: "aus"},
+	}
+	require.Equal(t, fingerprint(rows, "rsa"), fingerprint(reformatted, "rsa"))
+	require.True(t, strings.HasPrefix(fingerprint(rows, "rsa"), fingerprintVersion+":"))
+
+	// downloads in the input layout reproduce the order and cells of the rows, so they are part of the content
+	reordered := []uploadRow{rows[1], rows[0]}
+	require.NotEqual(t, fingerprint(rows, "rsa"), fingerprint(reordered, "rsa"))
+	header := []string{"id", "sms_phone"}
+	withCells := []uploadRow{
+		{number: "27717278645", country: "rsa", columns: header, cells: []string{"1", "27717278645"}},
+		{number: "61412345678", country: "aus", columns: header, cells: []string{"2", "61412345678"}},
+	}
+	otherCells := []uploadRow{withCells[0], withCells[1]}
+	otherCells[1].cells = []string{"3", "61412345678"}
+	require.NotEqual(t, fingerprint(rows, "rsa"), fingerprint(withCells, "rsa"))
+	require.NotEqual(t, fingerprint(withCells, "rsa"), fingerprint(otherCells, "rsa"))
+	require.NotEqual(t, fingerprint(rows, "rsa"), fingerprint(rows, "aus"))
+	require.NotEqual(t, fingerprint(rows, "rsa"), fingerprint(rows[:1], "rsa"))
+}
+
+func TestReadRowsLimits(t *testing.T) {
+	bodies := map[string]string{
+		csvFormat:    "id,sms_phone,country\n1,27717278645,rsa\n2,27717278646,rsa\n3,27717278647,rsa\n",
+		jsonFormat:   `[{"id": 1, "sms_phone": "27717278645", "country": "rsa"}, {"id": 2, "sms_phone": "27717278646", "country": "rsa"}, {"id": 3, "sms_phone": "27717278647", "country": "rsa"}]`,
+		ndjsonFormat: "{\"id\": 1, \"sms_phone\": \"27717278645\", \"country\": \"rsa\"}\n{\"id\": 2, \"sms_phone\": \"27717278646\", \"country\": \"rsa\"}\n{\"id\": 3, \"sms_phone\": \"27717278647\", \"country\": \"rsa\"}\n",
+	}
+	for format, body := range bodies {
+		rows, err := collectRows(strings.NewReader(body), format, "rsa", uploadOptions{}, &uploadLimits{maxRows: 3, maxColumns: 3})
+		require.NoError(t, err, format)
+		require.Len(t, rows, 3, format)
+
+		_, err = collectRows(strings.NewReader(body), format, "rsa", uploadOptions{}, &uploadLimits{maxRows: 2})
+		require.Error(t, err, format)
+		require.Equal(t, http.StatusRequestEntityTooLarge, errorStatus(err, http.StatusBadRequest), format)
+		require.Equal(t, jsonError{Msg: "upload has more than 2 rows", Limit: "rows", Max: 2}, errorJSON(err), format)
+
+		_, err = collectRows(strings.NewReader(body), format, "rsa", uploadOptions{}, &uploadLimits{maxColumns: 2})
+		require.Error(t, err, format)
+		require.Equal(t, "columns", errorJSON(err).Limit, format)
+	}
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	body := "id,sms_phone\n1,27717278645\n"
+	req := httptest.NewRequest("POST", "/rsa/numbers", strings.NewReader(body))
+	limitRequestBody(req, int64(len(body)-1))
+	up, err := parseUpload(req, "rsa")
+	require.NoError(t, err)
+	_, err = readUploadRows(up, Config{})
+	require.Error(t, err)
+	require.Equal(t, http.StatusRequestEntityTooLarge, errorStatus(err, http.StatusBadRequest))
+	require.Equal(t, "body_bytes", errorJSON(err).Limit)
+}
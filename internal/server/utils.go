@@ -1,33 +1,70 @@
 package server
 
 import (
-	"encoding/csv"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"hash"
 	"net/http"
+	"strings"
 
 	"github.com/gofrs/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
-// generates random UUID
-// improvement: gererate unique hash against sorted CSV data. This can be used to avoid processing same file twice.
-func generateHash(data [][]string) (uuid.UUID, error) {
+// generates random UUID used to reference a processed file
+func generateHash() (uuid.UUID, error) {
 	return uuid.NewV4()
 }
 
-// transform CSV into string slices
-func readCSVFromHttpRequest(req *http.Request) ([][]string, error) {
-	r := csv.NewReader(req.Body)
-	records, err := r.ReadAll()
-	if err != nil {
-		return nil, err
+// version of the fingerprint, changed along with what it covers so that files fingerprinted before are not matched
+const fingerprintVersion = "v3"
+
+// builds a deterministic fingerprint of the content of a file, a row at a time as the file is read
+// numbers are trimmed so the fingerprint does not depend on their formatting, and rows are kept in file order,
+// as downloads in the input layout reproduce the rows in that order
+// the fix policy is included so content is processed again after the fix rules change
+type fingerprinter struct {
+	h hash.Hash
+	// the countries whose rules apply to the rows, those of the rows along with the country of the upload
+	countries map[string]bool
+}
+
+func newFingerprinter(country string) *fingerprinter {
+	f := &fingerprinter{h: sha256.New(), countries: map[string]bool{strings.ToLower(country): true}}
+	fmt.Fprintf(f.h, "country\t%s\n", strings.ToLower(country))
+	return f
+}
+
+// adds a row of the file, in file order
+func (f *fingerprinter) add(row uploadRow) {
+	f.countries[row.country] = true
+	line := fmt.Sprintf("%s\t%s", row.country, strings.TrimSpace(row.number))
+	// passthrough values are stored with the numbers, and the cells of each row for the input layout,
+	// so they are part of the content
+	if len(row.passthrough) > 0 {
+		values, _ := json.Marshal(row.passthrough)
+		line += "\t" + string(values)
+	}
+	if len(row.cells) > 0 {
+		cells, _ := json.Marshal([][]string{row.columns, row.cells})
+		line += "\t" + string(cells)
 	}
-	return records, nil
+	fmt.Fprintln(f.h, line)
+}
+
+// returns the fingerprint of the rows added, along with the fix policy of their countries
+func (f *fingerprinter) sum() string {
+	fmt.Fprintf(f.h, "policy\t%s\n", fixPolicy(f.countries))
+	return fingerprintVersion + ":" + hex.EncodeToString(f.h.Sum(nil))
 }
 
+// reports err to the client as JSON
+// errors carrying their own status code override the code given
 func handleError(w http.ResponseWriter, err error, code int) {
 	log.Error(err)
-	errJSON := jsonError{Msg: err.Error()}
-	w.WriteHeader(code)
+	errJSON := errorJSON(err)
+	w.WriteHeader(errorStatus(err, code))
 	json.NewEncoder(w).Encode(errJSON)
 }
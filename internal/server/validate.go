@@ -0,0 +1,82 @@
+package server
+
+import (
+	"sync"
+)
+
+// outcome of validating and fixing a single upload row
+type validatedRow struct {
+	row uploadRow
+	num *mobileNumber
+	// set when the number was rejected
+	err error
+}
+
+// validates and fixes rows on a pool of workers
+// rows are validated in batches of batchSize, and emit is called with each batch in row order,
+// so results are deterministic regardless of the number of workers
+// validation stops at the first error returned by emit
+func validateRows(rows []uploadRow, workers int, batchSize int, emit func(batch []validatedRow) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	batches := (len(rows) + batchSize - 1) / batchSize
+	results := make([]validatedRow, len(rows))
+	done := make([]chan struct{}, batches)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	pending := make(chan int)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(quit)
+
+	go func() {
+		defer close(pending)
+		for i := 0; i < batches; i++ {
+			select {
+			case pending <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				start, end := batchBounds(i, batchSize, len(rows))
+				for j := start; j < end; j++ {
+					num, err := newMobileNumber(rows[j].country, rows[j].number)
+					results[j] = validatedRow{row: rows[j], num: num, err: err}
+				}
+				close(done[i])
+			}
+		}()
+	}
+
+	for i := 0; i < batches; i++ {
+		<-done[i]
+		start, end := batchBounds(i, batchSize, len(rows))
+		if err := emit(results[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the range of rows in the given batch
+func batchBounds(batch int, batchSize int, total int) (int, int) {
+	start := batch * batchSize
+	end := start + batchSize
+	if end > total {
+		end = total
+	}
+	return start, end
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// builds a mix of valid, fixable and invalid South African numbers
+func testRows(n int) []uploadRow {
+	rows := make([]uploadRow, n)
+	for i := range rows {
+		switch i % 4 {
+		case 0:
+			rows[i] = uploadRow{number: fmt.Sprintf("2771%07d", i%10000000), country: "rsa"}
+		case 1:
+			rows[i] = uploadRow{number: fmt.Sprintf("71%07d", i%10000000), country: "rsa"}
+		case 2:
+			rows[i] = uploadRow{number: fmt.Sprintf("+27 71-%07d9", i%10000000), country: "rsa"}
+		default:
+			rows[i] = uploadRow{number: fmt.Sprintf("%d", i%1000), country: "rsa"}
+		}
+	}
+	return rows
+}
+
+func TestValidateRowsIsDeterministic(t *testing.T) {
+	rows := testRows(1003)
+	var expected []validatedRow
+	for _, row := range rows {
+		num, err := newMobileNumber(row.country, row.number)
+		expected = append(expected, validatedRow{row: row, num: num, err: err})
+	}
+	for _, workers := range []int{1, 3, 8} {
+		var actual []validatedRow
+		err := validateRows(rows, workers, 10, func(batch []validatedRow) error {
+			require.True(t, len(batch) <= 10)
+			actual = append(actual, batch...)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, "%d workers", workers)
+	}
+}
+
+func TestValidateRowsStopsOnEmitError(t *testing.T) {
+	batches := 0
+	err := validateRows(testRows(100), 4, 10, func(batch []validatedRow) error {
+		batches++
+		if batches == 2 {
+			return errors.New("unable to save numbers")
+		}
+		return nil
+	})
+	require.EqualError(t, err, "unable to save numbers")
+	require.Equal(t, 2, batches)
+}
+
+func BenchmarkValidateRows(b *testing.B) {
+	rows := testRows(100000)
+	workerCounts := []int{1, 2, 4}
+	if cpus := runtime.NumCPU(); cpus > 4 {
+		workerCounts = append(workerCounts, cpus)
+	}
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := validateRows(rows, workers, 1000, func(batch []validatedRow) error { return nil })
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(rows)*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
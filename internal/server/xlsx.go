@@ -0,0 +1,156 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// the most rows a sheet can hold, past which rows continue on another sheet
+var xlsxMaxRows = 1048576
+
+// the parts of a workbook holding the given number of sheets, other than the sheets themselves
+func xlsxParts(sheets int) []struct {
+	name    string
+	content string
+} {
+	var overrides, entries, rels strings.Builder
+	for i := 1; i <= sheets; i++ {
+		name := "Numbers"
+		if i > 1 {
+			name += " " + strconv.Itoa(i)
+		}
+		fmt.Fprintf(&overrides, `<Override PartName="/%s" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`,
+			xlsxSheet(i))
+		fmt.Fprintf(&entries, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, name, i, i)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`,
+			i, i)
+	}
+	return []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			overrides.String() + `</Types>`},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+			`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + entries.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			rels.String() + `</Relationships>`},
+	}
+}
+
+// name of the part holding the nth sheet, counting from 1
+func xlsxSheet(n int) string {
+	return fmt.Sprintf("xl/worksheets/sheet%d.xml", n)
+}
+
+// a row of a sheet
+type xlsxRow struct {
+	XMLName xml.Name   `xml:"row"`
+	Index   int        `xml:"r,attr"`
+	Cells   []xlsxCell `xml:"c"`
+}
+
+// a cell holding a string of its own, so that the sheet can be written before every string is known
+type xlsxCell struct {
+	Type  string `xml:"t,attr"`
+	Value string `xml:"is>t"`
+}
+
+// writes a workbook of strings a row at a time, starting another sheet when a sheet is full
+// rows are encoded into the zip archive as they are written, so the workbook is never held in memory
+type xlsxWriter struct {
+	zw *zip.Writer
+	// row repeated at the top of every sheet, if any
+	header []string
+	sheets int
+	sheet  io.Writer
+	enc    *xml.Encoder
+	// rows of the current sheet
+	rows int
+}
+
+// starts a workbook written to w, each sheet starting with header unless it is nil
+func newXLSXWriter(w io.Writer, header []string) (*xlsxWriter, error) {
+	x := &xlsxWriter{zw: zip.NewWriter(w), header: header}
+	return x, x.startSheet()
+}
+
+// ends the current sheet, if any, and starts the next one
+func (x *xlsxWriter) startSheet() error {
+	if x.sheet != nil {
+		if err := x.endSheet(); err != nil {
+			return err
+		}
+	}
+	x.sheets++
+	sheet, err := x.zw.Create(xlsxSheet(x.sheets))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(sheet, xml.Header+
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return err
+	}
+	x.sheet, x.enc, x.rows = sheet, xml.NewEncoder(sheet), 0
+	if x.header == nil {
+		return nil
+	}
+	return x.writeRow(x.header)
+}
+
+func (x *xlsxWriter) endSheet() error {
+	if err := x.enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(x.sheet, `</sheetData></worksheet>`)
+	return err
+}
+
+// adds a row to the current sheet, or to a new one when it is full
+func (x *xlsxWriter) Write(record []string) error {
+	if x.rows >= xlsxMaxRows {
+		if err := x.startSheet(); err != nil {
+			return err
+		}
+	}
+	return x.writeRow(record)
+}
+
+func (x *xlsxWriter) writeRow(record []string) error {
+	x.rows++
+	row := xlsxRow{Index: x.rows, Cells: make([]xlsxCell, len(record))}
+	for i, value := range record {
+		row.Cells[i] = xlsxCell{Type: "inlineStr", Value: value}
+	}
+	return x.enc.Encode(row)
+}
+
+// ends the last sheet and the workbook, without closing the underlying writer
+// the parts listing the sheets follow them in the archive, once their number is known
+func (x *xlsxWriter) Close() error {
+	if err := x.endSheet(); err != nil {
+		return err
+	}
+	for _, part := range xlsxParts(x.sheets) {
+		pw, err := x.zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(pw, part.content); err != nil {
+			return err
+		}
+	}
+	return x.zw.Close()
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// reads the rows of each sheet of a workbook written by xlsxWriter, checking every part is well formed
+func readXLSXSheets(t *testing.T, data []byte) [][][]string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	var names, expectedNames []string
+	var sheets [][][]string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		rc, err := f.Open()
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		if strings.HasPrefix(f.Name, "xl/worksheets/") {
+			expectedNames = append(expectedNames, xlsxSheet(len(sheets)+1))
+			var sheet struct {
+				Rows []xlsxRow `xml:"sheetData>row"`
+			}
+			require.NoError(t, xml.Unmarshal(content, &sheet))
+			sheets = append(sheets, sheetValues(t, sheet.Rows))
+			continue
+		}
+		var part struct{}
+		require.NoError(t, xml.Unmarshal(content, &part), f.Name)
+		if f.Name == "xl/workbook.xml" {
+			require.Equal(t, len(sheets), strings.Count(string(content), "<sheet "))
+		}
+	}
+	expectedNames = append(expectedNames, "[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels")
+	require.Equal(t, expectedNames, names)
+	return sheets
+}
+
+// reads the rows of a workbook of a single sheet
+func readXLSX(t *testing.T, data []byte) [][]string {
+	sheets := readXLSXSheets(t, data)
+	require.Len(t, sheets, 1)
+	return sheets[0]
+}
+
+func sheetValues(t *testing.T, rows []xlsxRow) [][]string {
+	var values [][]string
+	for i, row := range rows {
+		require.Equal(t, i+1, row.Index)
+		cells := make([]string, len(row.Cells))
+		for j, cell := range row.Cells {
+			require.Equal(t, "inlineStr", cell.Type)
+			cells[j] = cell.Value
+		}
+		values = append(values, cells)
+	}
+	return values
+}
+
+func TestXLSXWriter(t *testing.T) {
+	var buf bytes.Buffer
+	x, err := newXLSXWriter(&buf, nil)
+	require.NoError(t, err)
+	rows := [][]string{
+		{"row_id", "original"},
+		{"1", "<27831234567> & \"more\""},
+		{"2", ""},
+	}
+	for _, row := range rows {
+		require.NoError(t, x.Write(row))
+	}
+	require.NoError(t, x.Close())
+	require.Equal(t, rows, readXLSX(t, buf.Bytes()))
+
+	// a workbook without rows is still well formed
+	buf.Reset()
+	x, err = newXLSXWriter(&buf, nil)
+	require.NoError(t, err)
+	require.NoError(t, x.Close())
+	require.Empty(t, readXLSX(t, buf.Bytes()))
+}
+
+func TestXLSXWriterStartsSheetWhenFull(t *testing.T) {
+	defer func(max int) { xlsxMaxRows = max }(xlsxMaxRows)
+	xlsxMaxRows = 3
+
+	var buf bytes.Buffer
+	x, err := newXLSXWriter(&buf, []string{"row_id"})
+	require.NoError(t, err)
+	for _, row := range []string{"1", "2", "3", "4", "5"} {
+		require.NoError(t, x.Write([]string{row}))
+	}
+	require.NoError(t, x.Close())
+	require.Equal(t, [][][]string{
+		{{"row_id"}, {"1"}, {"2"}},
+		{{"row_id"}, {"3"}, {"4"}},
+		{{"row_id"}, {"5"}},
+	}, readXLSXSheets(t, buf.Bytes()))
+}
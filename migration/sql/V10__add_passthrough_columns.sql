@@ -0,0 +1,7 @@
+-- values of the extra columns of an upload kept with each number, NULL when none were kept
+ALTER TABLE numbers ADD COLUMN IF NOT EXISTS passthrough JSONB;
+ALTER TABLE fixed_numbers ADD COLUMN IF NOT EXISTS passthrough JSONB;
+ALTER TABLE rejected_numbers ADD COLUMN IF NOT EXISTS passthrough JSONB;
+ALTER TABLE duplicate_numbers ADD COLUMN IF NOT EXISTS passthrough JSONB;
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS passthrough_columns TEXT[] NOT NULL DEFAULT '{}';
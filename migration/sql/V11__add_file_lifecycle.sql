@@ -0,0 +1,23 @@
+-- upload metadata and processing status of each file
+-- status is processing while the numbers of the file are being saved, then completed or failed
+ALTER TABLE files ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS row_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS fix_policy TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS rules_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'completed';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS error TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+
+-- files processed before the files table existed only have numbers
+-- each number of those files was read from its own row
+INSERT INTO files (ref, country, row_count)
+SELECT file_ref, MIN(country_ioc_code), COUNT(*) FROM (
+  SELECT file_ref, country_ioc_code FROM numbers
+  UNION ALL SELECT file_ref, country_ioc_code FROM fixed_numbers
+  UNION ALL SELECT file_ref, country_ioc_code FROM rejected_numbers
+  UNION ALL SELECT file_ref, country_ioc_code FROM duplicate_numbers
+) AS processed
+GROUP BY file_ref
+ON CONFLICT (ref) DO NOTHING;
+
+UPDATE files SET completed_at = uploaded_at WHERE status = 'completed' AND completed_at IS NULL;
@@ -0,0 +1,3 @@
+-- stats of the numbers of a file, saved along with them so they need not be counted on every request
+-- NULL for files processed before stats were saved, whose stats are counted from their numbers
+ALTER TABLE files ADD COLUMN IF NOT EXISTS stats JSONB;
@@ -0,0 +1,8 @@
+-- numbers of a file in the order of the file, for reading a file a page at a time from any position
+CREATE INDEX IF NOT EXISTS numbers_file_ref_row_idx ON numbers (file_ref, row_number, part, number);
+CREATE INDEX IF NOT EXISTS fixed_numbers_file_ref_row_idx ON fixed_numbers (file_ref, row_number, part, original_number);
+CREATE INDEX IF NOT EXISTS rejected_numbers_file_ref_row_idx ON rejected_numbers (file_ref, row_number, part, number);
+CREATE INDEX IF NOT EXISTS duplicate_numbers_file_ref_row_idx ON duplicate_numbers (file_ref, row_number, part, number);
+
+-- covered by duplicate_numbers_file_ref_row_idx
+DROP INDEX IF EXISTS duplicate_numbers_file_ref_idx;
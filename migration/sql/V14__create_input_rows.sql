@@ -0,0 +1,14 @@
+-- columns of an uploaded file, naming the cells of its input rows
+-- empty for files processed before input rows were kept
+ALTER TABLE files ADD COLUMN IF NOT EXISTS source_columns TEXT[] NOT NULL DEFAULT '{}';
+
+-- cells of each row of an uploaded file, in the order of the file's source columns
+-- the numbers read from a row share its row_number
+CREATE TABLE IF NOT EXISTS input_rows (
+  file_ref          UUID NOT NULL,
+  row_number        INTEGER NOT NULL,
+  cells             TEXT[] NOT NULL,
+  PRIMARY KEY       (file_ref, row_number)
+);
+
+GRANT ALL PRIVILEGES ON TABLE input_rows TO olx;
@@ -0,0 +1,18 @@
+-- files recorded between V3 and V11 have a row of their own, so the backfill of V11 left them without details
+-- their country and rows are counted from their numbers, as for older files
+-- numbers saved before V9 have no row number, and each was read from its own row
+UPDATE files SET
+  country = CASE WHEN files.country = '' THEN processed.country ELSE files.country END,
+  row_count = processed.row_count
+FROM (
+  SELECT file_ref, MIN(country_ioc_code) AS country,
+    COUNT(DISTINCT NULLIF(row_number, 0)) + COUNT(*) FILTER (WHERE row_number = 0) AS row_count
+  FROM (
+    SELECT file_ref, country_ioc_code, row_number FROM numbers
+    UNION ALL SELECT file_ref, country_ioc_code, row_number FROM fixed_numbers
+    UNION ALL SELECT file_ref, country_ioc_code, row_number FROM rejected_numbers
+    UNION ALL SELECT file_ref, country_ioc_code, row_number FROM duplicate_numbers
+  ) AS saved
+  GROUP BY file_ref
+) AS processed
+WHERE files.ref = processed.file_ref AND files.row_count = 0;
@@ -0,0 +1,2 @@
+ALTER TABLE fixed_numbers ADD COLUMN IF NOT EXISTS country_ioc_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE rejected_numbers ADD COLUMN IF NOT EXISTS country_ioc_code TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS files (
+  ref               UUID NOT NULL,
+  filename          TEXT NOT NULL DEFAULT '',
+  label             TEXT NOT NULL DEFAULT '',
+  uploaded_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY       (ref)
+);
+
+GRANT ALL PRIVILEGES ON TABLE files TO olx;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  key               TEXT NOT NULL,
+  fingerprint       TEXT NOT NULL,
+  file_ref          UUID NOT NULL,
+  status_code       INTEGER NOT NULL,
+  response          BYTEA NOT NULL,
+  created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY       (key)
+);
+
+GRANT ALL PRIVILEGES ON TABLE idempotency_keys TO olx;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS duplicate_numbers (
+  number            TEXT NOT NULL,
+  normalized_number TEXT NOT NULL,
+  row_number        INTEGER NOT NULL,
+  first_row_number  INTEGER NOT NULL,
+  country_ioc_code  TEXT NOT NULL,
+  file_ref          UUID NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS duplicate_numbers_file_ref_idx ON duplicate_numbers (file_ref, row_number);
+
+GRANT ALL PRIVILEGES ON TABLE duplicate_numbers TO olx;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS client_quotas (
+  client_id         TEXT NOT NULL,
+  day               DATE NOT NULL,
+  rows_used         BIGINT NOT NULL,
+  PRIMARY KEY       (client_id, day)
+);
+
+GRANT ALL PRIVILEGES ON TABLE client_quotas TO olx;
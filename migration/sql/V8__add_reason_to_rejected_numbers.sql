@@ -0,0 +1,6 @@
+ALTER TABLE rejected_numbers ADD COLUMN IF NOT EXISTS reason TEXT NOT NULL DEFAULT '';
+
+-- numbers rejected before reasons were recorded were either of an unknown country or of the wrong length
+UPDATE rejected_numbers
+SET reason = CASE WHEN country_ioc_code IN ('rsa', 'aus', 'por', 'usa') THEN 'invalid_length' ELSE 'unknown_country' END
+WHERE reason = '' AND country_ioc_code <> '';
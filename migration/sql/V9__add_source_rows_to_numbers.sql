@@ -0,0 +1,11 @@
+-- position of each number in the uploaded file
+-- part numbers the numbers of a cell holding several, and is 0 for a cell holding one
+ALTER TABLE numbers ADD COLUMN IF NOT EXISTS row_number INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE numbers ADD COLUMN IF NOT EXISTS part INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE fixed_numbers ADD COLUMN IF NOT EXISTS row_number INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE fixed_numbers ADD COLUMN IF NOT EXISTS part INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rejected_numbers ADD COLUMN IF NOT EXISTS row_number INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rejected_numbers ADD COLUMN IF NOT EXISTS part INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE duplicate_numbers ADD COLUMN IF NOT EXISTS part INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS split_cells INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,30 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+	"github.com/tonyOreglia/api-mobile-numbers/store/storetest"
+)
+
+func TestMemoryStoreContract(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		return store.NewMemory()
+	})
+}
+
+func TestFileStoreContract(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		s, err := store.NewFileStore(t.TempDir())
+		require.NoError(t, err)
+		t.Cleanup(s.Close)
+		return s
+	})
+}
+
+func TestPostgresStoreContract(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		return storetest.Postgres(t)
+	})
+}
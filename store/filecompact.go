@@ -0,0 +1,196 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// the log of a FileStore is compacted when it is opened, once the records it no longer needs take this many bytes
+// and half of the log
+const compactMinBytes = 1 << 20
+
+// name of the compacted log within the data directory while it is written
+const compactFileName = logFileName + ".compact"
+
+// a record kept when the log is compacted
+type liveRecord struct {
+	// body of the record, encoded from the index
+	body []byte
+	// or offset of a batch record copied from the log, along with the file and attempt it is moved to
+	batch        int64
+	ref, attempt uuid.UUID
+	size         int64
+}
+
+// lists the records rebuilding the index when replayed, along with their size in the log
+// batches of attempts that did not complete, records of files, idempotency keys and quotas saved again since, and
+// released idempotency keys are left out
+func (s *FileStore) liveRecords() ([]liveRecord, int64, error) {
+	var records []liveRecord
+	var size int64
+	add := func(kind byte, header []byte, payload interface{}) error {
+		body, err := encodeRecord(kind, header, payload)
+		if err != nil {
+			return err
+		}
+		records = append(records, liveRecord{body: body, size: int64(frameHeaderSize + len(body))})
+		size += int64(frameHeaderSize + len(body))
+		return nil
+	}
+
+	// files are kept in the order they were uploaded, so that the compacted log reads like the original
+	refs := make([]uuid.UUID, 0, len(s.files))
+	for ref := range s.files {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := s.files[refs[i]].file, s.files[refs[j]].file
+		if !a.UploadedAt.Equal(b.UploadedAt) {
+			return a.UploadedAt.Before(b.UploadedAt)
+		}
+		return refs[i].String() < refs[j].String()
+	})
+	for _, ref := range refs {
+		entry := s.files[ref]
+		if err := add(fileRecord, nil, entry.file); err != nil {
+			return nil, 0, err
+		}
+		if entry.file.Status != FileCompleted {
+			continue
+		}
+		attempt, err := uuid.NewV4()
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, offset := range entry.batches {
+			header := make([]byte, frameHeaderSize)
+			if _, err := s.log.ReadAt(header, offset); err != nil {
+				return nil, 0, errors.Wrapf(err, "[FileStore] unable to read record at offset %d", offset)
+			}
+			batchSize := int64(frameHeaderSize + binary.BigEndian.Uint32(header))
+			records = append(records, liveRecord{batch: offset, ref: ref, attempt: attempt, size: batchSize})
+			size += batchSize
+		}
+		c := completion{Stats: entry.stats, CompletedAt: *entry.file.CompletedAt}
+		if err := add(completeRecord, append(ref.Bytes(), attempt.Bytes()...), c); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	keys := make([]string, 0, len(s.idempotencyKeys))
+	for key := range s.idempotencyKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := add(idempotencyKeyRecord, nil, s.idempotencyKeys[key]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	quotas := make([]quotaKey, 0, len(s.quotas))
+	for key := range s.quotas {
+		quotas = append(quotas, key)
+	}
+	sort.Slice(quotas, func(i, j int) bool {
+		if quotas[i].day != quotas[j].day {
+			return quotas[i].day < quotas[j].day
+		}
+		return quotas[i].clientID < quotas[j].clientID
+	})
+	for _, key := range quotas {
+		if err := add(quotaRecord, nil, quotaUsage{ClientID: key.clientID, Day: key.day, Used: s.quotas[key]}); err != nil {
+			return nil, 0, err
+		}
+	}
+	return records, size, nil
+}
+
+// compacts the log if the records it no longer needs take at least compactMinBytes and half of it
+// a log that could not be compacted is kept as it is, unless it could not be opened again
+func (s *FileStore) compactIfNeeded() error {
+	records, size, err := s.liveRecords()
+	if err != nil {
+		return err
+	}
+	reclaimable := s.size - size
+	if reclaimable < compactMinBytes || reclaimable*2 < s.size {
+		return nil
+	}
+	path := filepath.Join(s.dir, compactFileName)
+	if err := s.writeCompacted(path, records); err != nil {
+		log.Warn(errors.Wrap(err, "[FileStore] unable to compact the log"))
+		os.Remove(path)
+		return nil
+	}
+	log.Infof("[FileStore] compacting the log from %d to %d bytes", s.size, size)
+	return s.replaceLog(path)
+}
+
+// writes records to a new log at path, flushed to disk
+func (s *FileStore) writeCompacted(path string, records []liveRecord) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, record := range records {
+		body := record.body
+		if body == nil {
+			// batches are moved to the attempt completing them in the compacted log
+			if body, err = s.readBatchRecord(record.batch); err != nil {
+				return err
+			}
+			copy(body[1:], record.ref.Bytes())
+			copy(body[1+16:], record.attempt.Bytes())
+		}
+		if _, err := w.Write(encodeFrame(body)); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// replaces the log with the compacted log at path, and rebuilds the index from it
+// the log is closed before it is replaced, as an open file cannot be replaced on every system
+func (s *FileStore) replaceLog(path string) error {
+	logPath := filepath.Join(s.dir, logFileName)
+	s.log.Close()
+	s.log = nil
+	if err := os.Rename(path, logPath); err != nil {
+		log.Warn(errors.Wrap(err, "[FileStore] unable to replace the log with the compacted log"))
+		os.Remove(path)
+		// the index still matches the log, which is only opened again
+		f, err := openLog(logPath)
+		if err != nil {
+			return err
+		}
+		s.log = f
+		return nil
+	}
+	// the rename is only durable once the directory is flushed, which not every system supports
+	if dir, err := os.Open(s.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	f, err := openLog(logPath)
+	if err != nil {
+		return err
+	}
+	s.log = f
+	return s.replay()
+}
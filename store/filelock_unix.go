@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package store
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// takes an exclusive lock on the log, held until it is closed, so that a single process appends to it
+// the lock is advisory, and is released by the system if the process dies
+func lockLog(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return errors.Errorf("[NewFileStore] %s is in use by another process", f.Name())
+		}
+		return errors.Wrapf(err, "[NewFileStore] unable to lock %s", f.Name())
+	}
+	return nil
+}
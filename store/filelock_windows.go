@@ -0,0 +1,8 @@
+package store
+
+import "os"
+
+// the log is not locked on Windows, where it is left to the operator to run a single process per data directory
+func lockLog(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,762 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// name of the log within the data directory of a FileStore
+const logFileName = "store.log"
+
+// kinds of record in the log of a FileStore
+const (
+	// the record of a file, written when it is created and when it fails
+	fileRecord byte = iota + 1
+	// a batch of the numbers of a file being processed
+	batchRecord
+	// marks the batches saved by an attempt at processing a file as the numbers of the file
+	completeRecord
+	idempotencyKeyRecord
+	quotaRecord
+)
+
+// each record is framed by its length and checksum, followed by its kind
+// batch and complete records then hold the file ref and the id of the attempt at processing it
+const (
+	frameHeaderSize  = 8
+	attemptHeaderLen = 32
+)
+
+// FileStore keeps processed files in a local data directory, with no database
+// everything is appended to a log, and an index of the log is rebuilt when the store is opened
+// the numbers of a file are read from the log when asked for, the rest of the index is kept in memory
+type FileStore struct {
+	mu   sync.RWMutex
+	dir  string
+	log  *os.File
+	size int64
+
+	files           map[uuid.UUID]*fileEntry
+	idempotencyKeys map[string]IdempotencyKey
+	quotas          map[quotaKey]int
+	// offsets of the batches saved by attempts at processing a file that have not completed
+	pending map[uuid.UUID][]int64
+	// the numbers of the files read most recently, so that paging through a file does not read the log again
+	sorted *sortedCache
+}
+
+// a file along with where its numbers are in the log
+type fileEntry struct {
+	file    File
+	stats   *Stats
+	batches []int64
+}
+
+// payload of a batch record
+type numberBatch struct {
+	Numbers    []Number
+	Fixed      []FixedNumber
+	Rejected   []RejectedNumber
+	Duplicates []DuplicateNumber
+	Inputs     []InputRow
+}
+
+// payload of a complete record
+type completion struct {
+	Stats       *Stats
+	CompletedAt time.Time
+}
+
+// payload of a quota record, holding the rows used by a client on a day
+type quotaUsage struct {
+	ClientID string
+	Day      string
+	Used     int
+}
+
+// error recorded for files whose processing was interrupted by the store being closed
+const interruptedReason = "processing was interrupted by a restart of the server"
+
+// NewFileStore opens the data store kept in dir, creating it if needed
+// a record cut short by a crash while it was written is dropped, and files left processing are marked as failed
+// the log is then compacted if most of it is records no longer needed, see compactIfNeeded
+// the log is locked while the store is open, opening it again before it is closed fails
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "[NewFileStore] unable to create data directory %s", dir)
+	}
+	f, err := openLog(filepath.Join(dir, logFileName))
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{dir: dir, log: f, sorted: newSortedCache(sortedFilesCached)}
+	if err := s.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// files being processed when the store was closed never will be
+	for ref, entry := range s.files {
+		if entry.file.Status != FileProcessing {
+			continue
+		}
+		if err := s.FailFile(ref, interruptedReason); err != nil {
+			s.log.Close()
+			return nil, err
+		}
+	}
+	if err := s.compactIfNeeded(); err != nil {
+		if s.log != nil {
+			s.log.Close()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// opens and locks the log at path, creating it if needed
+func openLog(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[NewFileStore] unable to open log %s", path)
+	}
+	if err := lockLog(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// rebuilds the index from the log
+// only the last record of the log can have been cut short by a crash, a bad record followed by others is corruption,
+// and the store is not opened rather than dropping the records after it
+func (s *FileStore) replay() error {
+	s.size = 0
+	s.files = map[uuid.UUID]*fileEntry{}
+	s.idempotencyKeys = map[string]IdempotencyKey{}
+	s.quotas = map[quotaKey]int{}
+	s.pending = map[uuid.UUID][]int64{}
+	info, err := s.log.Stat()
+	if err != nil {
+		return errors.Wrap(err, "[FileStore] unable to read log")
+	}
+	logSize := info.Size()
+	r := bufio.NewReader(io.NewSectionReader(s.log, 0, logSize))
+	for {
+		body, err := readFrame(r, logSize-s.size)
+		if err == io.EOF {
+			break
+		}
+		if err == errTornRecord {
+			log.Warnf("[FileStore] dropping a record cut short at offset %d of the log", s.size)
+			if err := s.log.Truncate(s.size); err != nil {
+				return errors.Wrap(err, "[FileStore] unable to drop a record cut short")
+			}
+			break
+		}
+		if err == errCorruptRecord {
+			return errors.Errorf("[FileStore] record at offset %d of the log is corrupt, and followed by other records", s.size)
+		}
+		if err != nil {
+			return errors.Wrap(err, "[FileStore] unable to read log")
+		}
+		offset := s.size
+		s.size += int64(frameHeaderSize + len(body))
+		if err := s.apply(offset, body); err != nil {
+			return err
+		}
+	}
+	// attempts that did not complete before the store was closed never will
+	s.pending = map[uuid.UUID][]int64{}
+	return nil
+}
+
+var (
+	// the last record of the log, not completely written or with a checksum that does not match
+	errTornRecord = errors.New("torn record")
+	// a record with a checksum that does not match, followed by other records
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+// reads the body of the next record of the log, remaining bytes from the end of the log
+// the length of the record is checked against them before the body is read, so a bad length never allocates more
+func readFrame(r io.Reader, remaining int64) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header))
+	last := frameHeaderSize+length >= remaining
+	if frameHeaderSize+length > remaining {
+		// a record running past the end of the log is the last record, written in part
+		return nil, errTornRecord
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if len(body) == 0 || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		if last {
+			return nil, errTornRecord
+		}
+		return nil, errCorruptRecord
+	}
+	return body, nil
+}
+
+// updates the index with the record at offset of the log
+func (s *FileStore) apply(offset int64, body []byte) error {
+	kind, payload := body[0], body[1:]
+	var ref, attempt uuid.UUID
+	if kind == batchRecord || kind == completeRecord {
+		if len(payload) < attemptHeaderLen {
+			return errors.Errorf("[FileStore] record at offset %d is too short", offset)
+		}
+		copy(ref[:], payload[:16])
+		copy(attempt[:], payload[16:attemptHeaderLen])
+		payload = payload[attemptHeaderLen:]
+	}
+	decode := func(v interface{}) error {
+		err := gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+		return errors.Wrapf(err, "[FileStore] unable to decode record at offset %d", offset)
+	}
+	switch kind {
+	case fileRecord:
+		var file File
+		if err := decode(&file); err != nil {
+			return err
+		}
+		if entry, found := s.files[file.Ref]; found {
+			entry.file = file
+		} else {
+			s.files[file.Ref] = &fileEntry{file: file}
+		}
+	case batchRecord:
+		// numbers are only decoded when they are read
+		s.pending[attempt] = append(s.pending[attempt], offset)
+	case completeRecord:
+		var c completion
+		if err := decode(&c); err != nil {
+			return err
+		}
+		entry, found := s.files[ref]
+		if !found {
+			return errors.Errorf("[FileStore] record at offset %d completes unknown file %s", offset, ref)
+		}
+		entry.batches = s.pending[attempt]
+		entry.stats = c.Stats
+		entry.file.Status = FileCompleted
+		entry.file.CompletedAt = &c.CompletedAt
+		delete(s.pending, attempt)
+	case idempotencyKeyRecord:
+		var key IdempotencyKey
+		if err := decode(&key); err != nil {
+			return err
+		}
+		if key.CreatedAt.IsZero() {
+			delete(s.idempotencyKeys, key.Key)
+		} else {
+			s.idempotencyKeys[key.Key] = key
+		}
+	case quotaRecord:
+		var usage quotaUsage
+		if err := decode(&usage); err != nil {
+			return err
+		}
+		s.quotas[quotaKey{clientID: usage.ClientID, day: usage.Day}] = usage.Used
+	default:
+		return errors.Errorf("[FileStore] record at offset %d is of unknown kind %d", offset, kind)
+	}
+	return nil
+}
+
+// encodes a record of the given kind
+// header is written before the gob encoded payload
+func encodeRecord(kind byte, header []byte, payload interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{kind})
+	buf.Write(header)
+	if err := gob.NewEncoder(buf).Encode(payload); err != nil {
+		return nil, errors.Wrap(err, "[FileStore] unable to encode record")
+	}
+	return buf.Bytes(), nil
+}
+
+// appends a record to the log and applies it to the index, s.mu must be held
+// sync flushes the log to disk, along with every record appended before
+func (s *FileStore) append(body []byte, sync bool) error {
+	frame := encodeFrame(body)
+	if _, err := s.log.WriteAt(frame, s.size); err != nil {
+		// a partly written record would hide the records appended after it
+		s.log.Truncate(s.size)
+		return errors.Wrap(err, "[FileStore] unable to append to log")
+	}
+	if sync {
+		if err := s.log.Sync(); err != nil {
+			return errors.Wrap(err, "[FileStore] unable to sync log")
+		}
+	}
+	offset := s.size
+	s.size += int64(len(frame))
+	return s.apply(offset, body)
+}
+
+// frames the body of a record with its length and checksum
+func encodeFrame(body []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(body))
+	copy(frame[frameHeaderSize:], body)
+	return frame
+}
+
+// encodes and appends a record
+func (s *FileStore) appendRecord(kind byte, header []byte, payload interface{}, sync bool) error {
+	body, err := encodeRecord(kind, header, payload)
+	if err != nil {
+		return err
+	}
+	return s.append(body, sync)
+}
+
+// reads the body of the batch record at offset
+func (s *FileStore) readBatchRecord(offset int64) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := s.log.ReadAt(header, offset); err != nil {
+		return nil, errors.Wrapf(err, "[FileStore] unable to read record at offset %d", offset)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := s.log.ReadAt(body, offset+frameHeaderSize); err != nil {
+		return nil, errors.Wrapf(err, "[FileStore] unable to read record at offset %d", offset)
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) || body[0] != batchRecord {
+		return nil, errors.Errorf("[FileStore] record at offset %d is corrupt", offset)
+	}
+	return body, nil
+}
+
+// reads the numbers of the batch record at offset
+func (s *FileStore) readBatch(offset int64) (*numberBatch, error) {
+	body, err := s.readBatchRecord(offset)
+	if err != nil {
+		return nil, err
+	}
+	batch := &numberBatch{}
+	err = gob.NewDecoder(bytes.NewReader(body[1+attemptHeaderLen:])).Decode(batch)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[FileStore] unable to decode record at offset %d", offset)
+	}
+	return batch, nil
+}
+
+// reads the numbers of a file from the log
+// sql.ErrNoRows is returned for an unknown file
+func (s *FileStore) readNumbers(ref uuid.UUID) (*fileNumbers, error) {
+	s.mu.RLock()
+	entry, found := s.files[ref]
+	var batches []int64
+	var stats *Stats
+	if found {
+		batches, stats = entry.batches, entry.stats
+	}
+	s.mu.RUnlock()
+	if !found {
+		return nil, sql.ErrNoRows
+	}
+	// records are never changed once appended, so they are read without holding the lock
+	numbers := &fileNumbers{saved: stats}
+	for _, offset := range batches {
+		batch, err := s.readBatch(offset)
+		if err != nil {
+			return nil, err
+		}
+		numbers.add(&fileNumbers{numbers: batch.Numbers, fixed: batch.Fixed, rejected: batch.Rejected, duplicates: batch.Duplicates,
+			inputs: batch.Inputs})
+	}
+	return numbers, nil
+}
+
+// number of files whose sorted numbers a FileStore keeps in memory
+const sortedFilesCached = 4
+
+// the sorted numbers of the files read most recently
+type sortedCache struct {
+	mu   sync.Mutex
+	max  int
+	refs []uuid.UUID // least recently read first
+	rows map[uuid.UUID]*sortedRows
+}
+
+func newSortedCache(max int) *sortedCache {
+	return &sortedCache{max: max, rows: map[uuid.UUID]*sortedRows{}}
+}
+
+// returns the numbers of a file, nil if they are not kept
+func (c *sortedCache) get(ref uuid.UUID) *sortedRows {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rows, found := c.rows[ref]
+	if found {
+		c.touch(ref)
+	}
+	return rows
+}
+
+// keeps the numbers of a file, dropping those of the file read least recently once there are too many
+func (c *sortedCache) put(ref uuid.UUID, rows *sortedRows) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.rows[ref]; !found && len(c.refs) >= c.max {
+		delete(c.rows, c.refs[0])
+		c.refs = c.refs[1:]
+	}
+	c.rows[ref] = rows
+	c.touch(ref)
+}
+
+// moves ref to the end of the refs read, c.mu must be held
+func (c *sortedCache) touch(ref uuid.UUID) {
+	for i, r := range c.refs {
+		if r == ref {
+			c.refs = append(c.refs[:i], c.refs[i+1:]...)
+			break
+		}
+	}
+	c.refs = append(c.refs, ref)
+}
+
+// Close closes the log
+func (s *FileStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.log.Close(); err != nil {
+		log.Error(errors.Wrap(err, "failed to close log"))
+	}
+}
+
+// CreateFile saves the record of a file about to be processed
+func (s *FileStore) CreateFile(file File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.files[file.Ref]; found {
+		return errors.Errorf("[CreateFile] file %s already exists", file.Ref)
+	}
+	file.Status = FileProcessing
+	file.Error = ""
+	file.CompletedAt = nil
+	return s.appendRecord(fileRecord, nil, file, true)
+}
+
+// SaveProcessedFile saves the numbers of a file created with CreateFile
+// batches are appended to the log as they are saved, but only become the numbers of the file once it is completed,
+// so a failure leaves none of them behind
+func (s *FileStore) SaveProcessedFile(ref uuid.UUID, write func(w FileWriter) error) error {
+	attempt, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	w := &fileStoreWriter{s: s, header: append(ref.Bytes(), attempt.Bytes()...)}
+	err = write(w)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		delete(s.pending, attempt)
+		return err
+	}
+	entry, found := s.files[ref]
+	if !found || entry.file.Status != FileProcessing {
+		delete(s.pending, attempt)
+		return errors.Errorf("[SaveProcessedFile] file %s is not being processed", ref)
+	}
+	return s.appendRecord(completeRecord, w.header, completion{Stats: w.stats, CompletedAt: time.Now()}, true)
+}
+
+// FailFile marks a file as failed, recording why
+func (s *FileStore) FailFile(ref uuid.UUID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.files[ref]
+	if !found {
+		return nil
+	}
+	file := entry.file
+	completedAt := time.Now()
+	file.Status = FileFailed
+	file.Error = reason
+	file.CompletedAt = &completedAt
+	return s.appendRecord(fileRecord, nil, file, true)
+}
+
+// GetFile returns the record of a file
+func (s *FileStore) GetFile(ref uuid.UUID) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, found := s.files[ref]
+	if !found {
+		return nil, sql.ErrNoRows
+	}
+	file := entry.file
+	return &file, nil
+}
+
+// FindFileByFingerprint returns the most recently completed file with the given content fingerprint
+func (s *FileStore) FindFileByFingerprint(fingerprint string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var latest *File
+	for _, entry := range s.files {
+		if entry.file.Fingerprint != fingerprint || entry.file.Status != FileCompleted {
+			continue
+		}
+		if latest == nil || entry.file.UploadedAt.After(latest.UploadedAt) {
+			file := entry.file
+			latest = &file
+		}
+	}
+	if latest == nil {
+		return nil, sql.ErrNoRows
+	}
+	return latest, nil
+}
+
+// GetFileStats returns the stats saved with the numbers of a file, or counts them if none were saved
+func (s *FileStore) GetFileStats(ref uuid.UUID) (*Stats, error) {
+	s.mu.RLock()
+	entry, found := s.files[ref]
+	var stats *Stats
+	if found && entry.stats != nil {
+		saved := *entry.stats
+		stats = &saved
+	}
+	s.mu.RUnlock()
+	if stats != nil {
+		return stats, nil
+	}
+	numbers, err := s.readNumbers(ref)
+	if err != nil {
+		return nil, err
+	}
+	return numbers.stats(), nil
+}
+
+// GetFileResults returns the numbers of a file by category, sql.ErrNoRows for an unknown ref
+func (s *FileStore) GetFileResults(ref uuid.UUID) (*FileResults, error) {
+	numbers, err := s.readNumbers(ref)
+	if err != nil {
+		return nil, err
+	}
+	return numbers.results(), nil
+}
+
+// GetFileRows returns every number of a file, in the order of the file
+func (s *FileStore) GetFileRows(ref uuid.UUID) ([]ResultRow, error) {
+	numbers, err := s.readNumbers(ref)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return numbers.rows(), nil
+}
+
+// GetFileRowsPage returns a page of the numbers of a file, ordered by their RowCursor
+func (s *FileStore) GetFileRowsPage(ref uuid.UUID, page RowPage) ([]ResultRow, error) {
+	rows, err := s.readSortedRows(ref)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rows.page(page), nil
+}
+
+// EachFileRow calls fn with each number of a file in the order of GetFileRowsPage
+// the batches of a file are read before the first call, as numbers are ordered across batches
+func (s *FileStore) EachFileRow(ctx context.Context, ref uuid.UUID, category string, fn func(row ResultRow) error) error {
+	rows, err := s.readSortedRows(ref)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return eachRow(ctx, rows.page(RowPage{Category: category}), fn)
+}
+
+// reads the numbers of a file ordered by their RowCursor, from the cache unless they were not read recently
+// sql.ErrNoRows is returned for an unknown file
+func (s *FileStore) readSortedRows(ref uuid.UUID) (*sortedRows, error) {
+	if rows := s.sorted.get(ref); rows != nil {
+		return rows, nil
+	}
+	// the batches of a completed file never change, so only its numbers are kept
+	s.mu.RLock()
+	entry, found := s.files[ref]
+	completed := found && entry.file.Status == FileCompleted
+	s.mu.RUnlock()
+	numbers, err := s.readNumbers(ref)
+	if err != nil {
+		return nil, err
+	}
+	rows := newSortedRows(numbers.rows())
+	if completed {
+		s.sorted.put(ref, rows)
+	}
+	return rows, nil
+}
+
+// EachInputRow calls fn with each row of a file in the order of the file, along with the numbers read from it
+// the batches of a file are read before the first call, as rows and numbers are ordered across batches
+func (s *FileStore) EachInputRow(ctx context.Context, ref uuid.UUID, fn func(row InputRow, numbers []ResultRow) error) error {
+	numbers, err := s.readNumbers(ref)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return numbers.eachInput(ctx, fn)
+}
+
+// GetIdempotencyKey returns an idempotency key saved after since
+func (s *FileStore) GetIdempotencyKey(key string, since time.Time) (*IdempotencyKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	idempotencyKey, found := s.idempotencyKeys[key]
+	if !found || !idempotencyKey.CreatedAt.After(since) {
+		return nil, sql.ErrNoRows
+	}
+	return &idempotencyKey, nil
+}
+
+// SaveIdempotencyKey saves the response to an upload, replacing an earlier record of the same key
+func (s *FileStore) SaveIdempotencyKey(key IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key.CreatedAt = time.Now()
+	return s.appendRecord(idempotencyKeyRecord, nil, key, true)
+}
+
+// ReserveIdempotencyKey appends a pending record of key, unless the key was saved after since or reserved after
+// pendingSince
+func (s *FileStore) ReserveIdempotencyKey(key IdempotencyKey, since time.Time, pendingSince time.Time) (*IdempotencyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prior, found := s.idempotencyKeys[key.Key]; found && prior.heldAfter(since, pendingSince) {
+		return &prior, nil
+	}
+	key.StatusCode, key.Response, key.CreatedAt = 0, nil, time.Now()
+	return nil, s.appendRecord(idempotencyKeyRecord, nil, key, true)
+}
+
+// ReleaseIdempotencyKey appends a record removing the pending record of a key
+func (s *FileStore) ReleaseIdempotencyKey(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prior, found := s.idempotencyKeys[key]; !found || prior.StatusCode != 0 {
+		return nil
+	}
+	// a record without a time removes the key when applied
+	return s.appendRecord(idempotencyKeyRecord, nil, IdempotencyKey{Key: key}, true)
+}
+
+// ReserveRowQuota counts rows against a client's quota for the given day
+// reports false, and counts nothing, if the rows would take the client's usage for the day over limit
+func (s *FileStore) ReserveRowQuota(clientID string, day time.Time, rows int, limit int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := quotaUsage{ClientID: clientID, Day: day.Format("2006-01-02")}
+	usage.Used = s.quotas[quotaKey{clientID: usage.ClientID, day: usage.Day}] + rows
+	if usage.Used > limit {
+		return false, nil
+	}
+	if err := s.appendRecord(quotaRecord, nil, usage, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReleaseRowQuota gives back rows reserved for an upload that was not processed
+func (s *FileStore) ReleaseRowQuota(clientID string, day time.Time, rows int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := quotaUsage{ClientID: clientID, Day: day.Format("2006-01-02")}
+	usage.Used = s.quotas[quotaKey{clientID: usage.ClientID, day: usage.Day}] - rows
+	if usage.Used < 0 {
+		usage.Used = 0
+	}
+	return s.appendRecord(quotaRecord, nil, usage, true)
+}
+
+// GetRowQuotaUsage returns the number of rows a client has uploaded on the given day
+func (s *FileStore) GetRowQuotaUsage(clientID string, day time.Time) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.quotas[quotaKey{clientID: clientID, day: day.Format("2006-01-02")}], nil
+}
+
+// appends the numbers of a file being processed to the log, as batch records of one attempt
+type fileStoreWriter struct {
+	s *FileStore
+	// ref of the file and id of the attempt
+	header []byte
+	stats  *Stats
+}
+
+// appends a batch record, unless the batch is empty
+func (w *fileStoreWriter) save(batch numberBatch, n int) error {
+	if n == 0 {
+		return nil
+	}
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	return w.s.appendRecord(batchRecord, w.header, batch, false)
+}
+
+// SaveNumbers appends valid numbers
+func (w *fileStoreWriter) SaveNumbers(numbers []Number) error {
+	return w.save(numberBatch{Numbers: numbers}, len(numbers))
+}
+
+// SaveFixedNumbers appends fixed numbers
+func (w *fileStoreWriter) SaveFixedNumbers(fixedNums []FixedNumber) error {
+	return w.save(numberBatch{Fixed: fixedNums}, len(fixedNums))
+}
+
+// SaveRejectedNumbers appends numbers that could not be fixed
+func (w *fileStoreWriter) SaveRejectedNumbers(rejectedNums []RejectedNumber) error {
+	return w.save(numberBatch{Rejected: rejectedNums}, len(rejectedNums))
+}
+
+// SaveDuplicateNumbers appends numbers repeating an earlier number in the same file
+func (w *fileStoreWriter) SaveDuplicateNumbers(duplicateNums []DuplicateNumber) error {
+	return w.save(numberBatch{Duplicates: duplicateNums}, len(duplicateNums))
+}
+
+// SaveInputRows appends the cells of rows of the uploaded file
+func (w *fileStoreWriter) SaveInputRows(rows []InputRow) error {
+	return w.save(numberBatch{Inputs: rows}, len(rows))
+}
+
+// SaveStats keeps the stats of the file, to be appended when it is completed
+func (w *fileStoreWriter) SaveStats(stats Stats) error {
+	w.stats = &stats
+	return nil
+}
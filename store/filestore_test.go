@@ -0,0 +1,375 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	ref := uuid.Must(uuid.NewV4())
+	file := File{Ref: ref, Filename: "numbers.csv", UploadedAt: time.Now().UTC(), Fingerprint: "abc123", Country: "rsa",
+		RowCount: 3, PassthroughColumns: pq.StringArray{"name"}}
+	require.NoError(t, s.CreateFile(file))
+	stats := Stats{ValidNumbersCount: 1, FixedNumbersCount: 1, InvalidNumbersCount: 1, TotalNumbersProcessed: 3,
+		Changes: map[string]int{"dialing_code_prepended": 1}, Reasons: map[string]int{"invalid_length": 1}}
+	err = s.SaveProcessedFile(ref, func(w FileWriter) error {
+		err := w.SaveNumbers([]Number{{Number: "27831234567", CountryIOCCode: "rsa", FileRef: ref,
+			SourceRow: SourceRow{RowNumber: 1, Passthrough: Passthrough{"name": "Ann"}}}})
+		if err != nil {
+			return err
+		}
+		err = w.SaveFixedNumbers([]FixedNumber{{OriginalNumber: "831234568", FixedNumber: "27831234568",
+			Changes: "prepended number with 27", CountryIOCCode: "rsa", FileRef: ref, SourceRow: SourceRow{RowNumber: 2}}})
+		if err != nil {
+			return err
+		}
+		err = w.SaveRejectedNumbers([]RejectedNumber{{Number: "123", CountryIOCCode: "rsa", FileRef: ref, Reason: "invalid_length",
+			SourceRow: SourceRow{RowNumber: 3}}})
+		if err != nil {
+			return err
+		}
+		return w.SaveStats(stats)
+	})
+	require.NoError(t, err)
+
+	// a failed attempt leaves nothing behind
+	failed := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: failed, UploadedAt: time.Now().UTC()}))
+	err = s.SaveProcessedFile(failed, func(w FileWriter) error {
+		require.NoError(t, w.SaveNumbers([]Number{{Number: "27831234569", CountryIOCCode: "rsa", FileRef: failed}}))
+		return errors.New("validation failed")
+	})
+	require.EqualError(t, err, "validation failed")
+	require.NoError(t, s.FailFile(failed, "validation failed"))
+	// a file still being processed when the store is closed
+	interrupted := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: interrupted, UploadedAt: time.Now().UTC()}))
+
+	require.NoError(t, s.SaveIdempotencyKey(IdempotencyKey{Key: "retry-1", FileRef: ref, StatusCode: 200, Response: []byte(`{}`)}))
+	day := time.Now()
+	reserved, err := s.ReserveRowQuota("client", day, 3, 10)
+	require.NoError(t, err)
+	require.True(t, reserved)
+	rows, err := s.GetFileRows(ref)
+	require.NoError(t, err)
+	s.Close()
+
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	got, err := s.GetFile(ref)
+	require.NoError(t, err)
+	require.Equal(t, FileCompleted, got.Status)
+	require.NotNil(t, got.CompletedAt)
+	require.Equal(t, file.Filename, got.Filename)
+	require.Equal(t, file.PassthroughColumns, got.PassthroughColumns)
+	require.True(t, file.UploadedAt.Equal(got.UploadedAt))
+	got, err = s.FindFileByFingerprint("abc123")
+	require.NoError(t, err)
+	require.Equal(t, ref, got.Ref)
+
+	gotStats, err := s.GetFileStats(ref)
+	require.NoError(t, err)
+	require.Equal(t, &stats, gotStats)
+	results, err := s.GetFileResults(ref)
+	require.NoError(t, err)
+	require.Equal(t, []string{"27831234567"}, results.ValidNumbers)
+	require.Equal(t, []string{"123"}, results.RejectedNumbers)
+	require.Equal(t, []FixedNumber{{OriginalNumber: "831234568", FixedNumber: "27831234568", Changes: "prepended number with 27"}},
+		results.FixedNumbers)
+	reopenedRows, err := s.GetFileRows(ref)
+	require.NoError(t, err)
+	require.Equal(t, rows, reopenedRows)
+	require.Len(t, rows, 3)
+
+	got, err = s.GetFile(failed)
+	require.NoError(t, err)
+	require.Equal(t, FileFailed, got.Status)
+	require.Equal(t, "validation failed", got.Error)
+	results, err = s.GetFileResults(failed)
+	require.NoError(t, err)
+	require.Empty(t, results.ValidNumbers)
+	got, err = s.GetFile(interrupted)
+	require.NoError(t, err)
+	require.Equal(t, FileFailed, got.Status)
+	require.Equal(t, interruptedReason, got.Error)
+
+	key, err := s.GetIdempotencyKey("retry-1", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, ref, key.FileRef)
+	used, err := s.GetRowQuotaUsage("client", day)
+	require.NoError(t, err)
+	require.Equal(t, 3, used)
+}
+
+func TestFileStoreDropsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	require.NoError(t, err)
+	ref := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: ref}))
+	s.Close()
+
+	// a crash while appending leaves part of a record at the end of the log
+	path := filepath.Join(dir, logFileName)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+	_, err = s.GetFile(ref)
+	require.NoError(t, err)
+	_, err = s.GetFile(uuid.Must(uuid.NewV4()))
+	require.Equal(t, sql.ErrNoRows, err)
+
+	// records appended later are kept
+	other := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: other}))
+	s.Close()
+	truncated, err := os.Stat(path)
+	require.NoError(t, err)
+	require.True(t, truncated.Size() > info.Size())
+
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.GetFile(other)
+	require.NoError(t, err)
+}
+
+func TestFileStoreRefusesCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	require.NoError(t, err)
+	first := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: first, Filename: "first.csv"}))
+	firstEnd := s.size
+	second := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: second, Filename: "second.csv"}))
+	require.NoError(t, s.CreateFile(File{Ref: uuid.Must(uuid.NewV4()), Filename: "third.csv"}))
+	s.Close()
+
+	// a byte flipped in the body of a record in the middle of the log
+	path := filepath.Join(dir, logFileName)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[firstEnd+frameHeaderSize+4] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	_, err = NewFileStore(dir)
+	require.EqualError(t, err, fmt.Sprintf("[FileStore] record at offset %d of the log is corrupt, and followed by other records", firstEnd))
+	// the records after it are kept for the log to be repaired
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size())
+
+	// a length running past the end of the log is a record cut short, and is not allocated
+	data[firstEnd+frameHeaderSize+4] ^= 0xff
+	binary.BigEndian.PutUint32(data[firstEnd:], 0xffffffff)
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.GetFile(first)
+	require.NoError(t, err)
+	_, err = s.GetFile(second)
+	require.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestFileStoreLocksDataDir(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	require.NoError(t, err)
+	_, err = NewFileStore(dir)
+	require.EqualError(t, err, fmt.Sprintf("[NewFileStore] %s is in use by another process", filepath.Join(dir, logFileName)))
+
+	s.Close()
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+	s.Close()
+}
+
+func TestFileStoreCachesSortedRows(t *testing.T) {
+	s, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// numbers are saved out of order, across batches
+	var refs []uuid.UUID
+	for i := 0; i <= sortedFilesCached; i++ {
+		ref := uuid.Must(uuid.NewV4())
+		require.NoError(t, s.CreateFile(File{Ref: ref, UploadedAt: time.Now().UTC()}))
+		err := s.SaveProcessedFile(ref, func(w FileWriter) error {
+			if err := w.SaveNumbers([]Number{{Number: "27831234569", FileRef: ref, SourceRow: SourceRow{RowNumber: 3}}}); err != nil {
+				return err
+			}
+			return w.SaveRejectedNumbers([]RejectedNumber{{Number: "123", FileRef: ref, Reason: "invalid_length",
+				SourceRow: SourceRow{RowNumber: 1}}})
+		})
+		require.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	processing := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: processing, UploadedAt: time.Now().UTC()}))
+
+	first, err := s.GetFileRowsPage(refs[0], RowPage{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+	require.Equal(t, "123", first[0].Number)
+	require.NotNil(t, s.sorted.get(refs[0]))
+	cursor := first[0].Cursor()
+	next, err := s.GetFileRowsPage(refs[0], RowPage{After: &cursor, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, next, 1)
+	require.Equal(t, "27831234569", next[0].Number)
+
+	// the numbers of a file still being processed are not kept, as they have yet to be saved
+	_, err = s.GetFileRowsPage(processing, RowPage{})
+	require.NoError(t, err)
+	require.Nil(t, s.sorted.get(processing))
+
+	// the file read least recently is dropped once too many are kept
+	for _, ref := range refs[1:] {
+		_, err := s.GetFileRowsPage(ref, RowPage{})
+		require.NoError(t, err)
+	}
+	require.Nil(t, s.sorted.get(refs[0]))
+	for _, ref := range refs[1:] {
+		require.NotNil(t, s.sorted.get(ref))
+	}
+}
+
+func TestFileStoreCompactsLog(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, logFileName)
+	s, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	ref := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: ref, UploadedAt: time.Now().UTC(), Fingerprint: "abc123"}))
+	stats := Stats{ValidNumbersCount: 1, InvalidNumbersCount: 1, TotalNumbersProcessed: 2}
+	err = s.SaveProcessedFile(ref, func(w FileWriter) error {
+		err := w.SaveNumbers([]Number{{Number: "27831234567", FileRef: ref, SourceRow: SourceRow{RowNumber: 1}}})
+		if err != nil {
+			return err
+		}
+		err = w.SaveRejectedNumbers([]RejectedNumber{{Number: "123", FileRef: ref, Reason: "invalid_length",
+			SourceRow: SourceRow{RowNumber: 2}}})
+		if err != nil {
+			return err
+		}
+		return w.SaveStats(stats)
+	})
+	require.NoError(t, err)
+	rows, err := s.GetFileRows(ref)
+	require.NoError(t, err)
+
+	// a failed attempt leaves a batch behind in the log, large enough for the log to be compacted
+	failed := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: failed, UploadedAt: time.Now().UTC()}))
+	err = s.SaveProcessedFile(failed, func(w FileWriter) error {
+		padding := Passthrough{"notes": string(make([]byte, 2*compactMinBytes))}
+		err := w.SaveNumbers([]Number{{Number: "27831234569", FileRef: failed,
+			SourceRow: SourceRow{RowNumber: 1, Passthrough: padding}}})
+		require.NoError(t, err)
+		return errors.New("validation failed")
+	})
+	require.EqualError(t, err, "validation failed")
+	require.NoError(t, s.FailFile(failed, "validation failed"))
+
+	_, err = s.ReserveIdempotencyKey(IdempotencyKey{Key: "released", FileRef: failed}, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, s.ReleaseIdempotencyKey("released"))
+	require.NoError(t, s.SaveIdempotencyKey(IdempotencyKey{Key: "retry-1", FileRef: ref, StatusCode: 200, Response: []byte(`{}`)}))
+	day := time.Now()
+	for i := 0; i < 3; i++ {
+		reserved, err := s.ReserveRowQuota("client", day, 2, 10)
+		require.NoError(t, err)
+		require.True(t, reserved)
+	}
+	s.Close()
+	info, err := os.Stat(logPath)
+	require.NoError(t, err)
+	before := info.Size()
+
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+	info, err = os.Stat(logPath)
+	require.NoError(t, err)
+	require.True(t, info.Size() < compactMinBytes)
+	require.Equal(t, info.Size(), s.size)
+	_, err = os.Stat(filepath.Join(dir, compactFileName))
+	require.True(t, os.IsNotExist(err))
+
+	// the compacted log holds everything the index did, and is appended to as before
+	newer := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(File{Ref: newer, UploadedAt: time.Now().UTC()}))
+	s.Close()
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+
+	got, err := s.GetFile(ref)
+	require.NoError(t, err)
+	require.Equal(t, FileCompleted, got.Status)
+	require.NotNil(t, got.CompletedAt)
+	gotStats, err := s.GetFileStats(ref)
+	require.NoError(t, err)
+	require.Equal(t, &stats, gotStats)
+	compactedRows, err := s.GetFileRows(ref)
+	require.NoError(t, err)
+	require.Equal(t, rows, compactedRows)
+
+	got, err = s.GetFile(failed)
+	require.NoError(t, err)
+	require.Equal(t, FileFailed, got.Status)
+	require.Equal(t, "validation failed", got.Error)
+	results, err := s.GetFileResults(failed)
+	require.NoError(t, err)
+	require.Empty(t, results.ValidNumbers)
+	got, err = s.GetFile(newer)
+	require.NoError(t, err)
+	require.Equal(t, FileFailed, got.Status)
+
+	_, err = s.GetIdempotencyKey("released", time.Time{})
+	require.Equal(t, sql.ErrNoRows, err)
+	key, err := s.GetIdempotencyKey("retry-1", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, ref, key.FileRef)
+	used, err := s.GetRowQuotaUsage("client", day)
+	require.NoError(t, err)
+	require.Equal(t, 6, used)
+
+	// a log with little to reclaim is left as it is
+	s.Close()
+	info, err = os.Stat(logPath)
+	require.NoError(t, err)
+	size := info.Size()
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+	info, err = os.Stat(logPath)
+	require.NoError(t, err)
+	require.Equal(t, size, info.Size())
+	require.True(t, size < before)
+	s.Close()
+}
@@ -0,0 +1,269 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// MemoryStore keeps processed files in memory, for tests and for running without a database
+// nothing survives a restart
+type MemoryStore struct {
+	mu              sync.RWMutex
+	files           map[uuid.UUID]*memoryFile
+	idempotencyKeys map[string]IdempotencyKey
+	quotas          map[quotaKey]int
+}
+
+// a file along with its numbers
+type memoryFile struct {
+	file File
+	*fileNumbers
+}
+
+// rows used by a client on a day
+type quotaKey struct {
+	clientID string
+	day      string
+}
+
+// NewMemory returns an empty in-memory data store
+func NewMemory() *MemoryStore {
+	return &MemoryStore{
+		files:           map[uuid.UUID]*memoryFile{},
+		idempotencyKeys: map[string]IdempotencyKey{},
+		quotas:          map[quotaKey]int{},
+	}
+}
+
+// Close does nothing, there is no connection to close
+func (m *MemoryStore) Close() {}
+
+// CreateFile saves the record of a file about to be processed
+func (m *MemoryStore) CreateFile(file File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.files[file.Ref]; found {
+		return errors.Errorf("[CreateFile] file %s already exists", file.Ref)
+	}
+	file.Status = FileProcessing
+	file.Error = ""
+	file.CompletedAt = nil
+	m.files[file.Ref] = &memoryFile{file: file, fileNumbers: &fileNumbers{}}
+	return nil
+}
+
+// SaveProcessedFile saves the numbers of a file created with CreateFile
+// numbers are kept aside until write returns, so a failure leaves none of them behind
+func (m *MemoryStore) SaveProcessedFile(ref uuid.UUID, write func(w FileWriter) error) error {
+	w := &fileNumbers{}
+	if err := write(w); err != nil {
+		return err
+	}
+	w.index()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, found := m.files[ref]
+	if !found || f.file.Status != FileProcessing {
+		return errors.Errorf("[SaveProcessedFile] file %s is not being processed", ref)
+	}
+	f.fileNumbers = w
+	completedAt := time.Now()
+	f.file.Status = FileCompleted
+	f.file.CompletedAt = &completedAt
+	return nil
+}
+
+// FailFile marks a file as failed, recording why
+func (m *MemoryStore) FailFile(ref uuid.UUID, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, found := m.files[ref]; found {
+		completedAt := time.Now()
+		f.file.Status = FileFailed
+		f.file.Error = reason
+		f.file.CompletedAt = &completedAt
+	}
+	return nil
+}
+
+// GetFile returns the record of a file
+func (m *MemoryStore) GetFile(ref uuid.UUID) (*File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, found := m.files[ref]
+	if !found {
+		return nil, sql.ErrNoRows
+	}
+	file := f.file
+	return &file, nil
+}
+
+// FindFileByFingerprint returns the most recently completed file with the given content fingerprint
+func (m *MemoryStore) FindFileByFingerprint(fingerprint string) (*File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var latest *File
+	for _, f := range m.files {
+		if f.file.Fingerprint != fingerprint || f.file.Status != FileCompleted {
+			continue
+		}
+		if latest == nil || f.file.UploadedAt.After(latest.UploadedAt) {
+			file := f.file
+			latest = &file
+		}
+	}
+	if latest == nil {
+		return nil, sql.ErrNoRows
+	}
+	return latest, nil
+}
+
+// GetFileStats returns the stats saved with the numbers of a file, or counts them if none were saved
+func (m *MemoryStore) GetFileStats(ref uuid.UUID) (*Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, found := m.files[ref]
+	if !found {
+		return nil, sql.ErrNoRows
+	}
+	return f.stats(), nil
+}
+
+// GetFileResults returns the numbers of a file by category, sql.ErrNoRows for an unknown ref
+func (m *MemoryStore) GetFileResults(ref uuid.UUID) (*FileResults, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, found := m.files[ref]
+	if !found {
+		return nil, sql.ErrNoRows
+	}
+	return f.results(), nil
+}
+
+// GetFileRows returns every number of a file, in the order of the file
+func (m *MemoryStore) GetFileRows(ref uuid.UUID) ([]ResultRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, found := m.files[ref]
+	if !found {
+		return nil, nil
+	}
+	return f.rows(), nil
+}
+
+// GetFileRowsPage returns a page of the numbers of a file, ordered by their RowCursor
+func (m *MemoryStore) GetFileRowsPage(ref uuid.UUID, page RowPage) ([]ResultRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, found := m.files[ref]
+	if !found {
+		return nil, nil
+	}
+	return f.page(page), nil
+}
+
+// EachFileRow calls fn with each number of a file in the order of GetFileRowsPage
+func (m *MemoryStore) EachFileRow(ctx context.Context, ref uuid.UUID, category string, fn func(row ResultRow) error) error {
+	m.mu.RLock()
+	f, found := m.files[ref]
+	var rows []ResultRow
+	if found {
+		rows = f.page(RowPage{Category: category})
+	}
+	m.mu.RUnlock()
+	return eachRow(ctx, rows, fn)
+}
+
+// EachInputRow calls fn with each row of a file in the order of the file, along with the numbers read from it
+func (m *MemoryStore) EachInputRow(ctx context.Context, ref uuid.UUID, fn func(row InputRow, numbers []ResultRow) error) error {
+	m.mu.RLock()
+	f, found := m.files[ref]
+	var numbers *fileNumbers
+	if found {
+		numbers = f.fileNumbers
+	}
+	m.mu.RUnlock()
+	if numbers == nil {
+		return nil
+	}
+	// the numbers of a file are replaced rather than changed once saved, so they are read without holding the lock
+	return numbers.eachInput(ctx, fn)
+}
+
+// GetIdempotencyKey returns an idempotency key saved after since
+func (m *MemoryStore) GetIdempotencyKey(key string, since time.Time) (*IdempotencyKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	idempotencyKey, found := m.idempotencyKeys[key]
+	if !found || !idempotencyKey.CreatedAt.After(since) {
+		return nil, sql.ErrNoRows
+	}
+	return &idempotencyKey, nil
+}
+
+// SaveIdempotencyKey saves the response to an upload, replacing an earlier record of the same key
+func (m *MemoryStore) SaveIdempotencyKey(key IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key.CreatedAt = time.Now()
+	m.idempotencyKeys[key.Key] = key
+	return nil
+}
+
+// ReserveIdempotencyKey records key as pending, unless the key was saved after since or reserved after pendingSince
+func (m *MemoryStore) ReserveIdempotencyKey(key IdempotencyKey, since time.Time, pendingSince time.Time) (*IdempotencyKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if prior, found := m.idempotencyKeys[key.Key]; found && prior.heldAfter(since, pendingSince) {
+		return &prior, nil
+	}
+	key.StatusCode, key.Response, key.CreatedAt = 0, nil, time.Now()
+	m.idempotencyKeys[key.Key] = key
+	return nil, nil
+}
+
+// ReleaseIdempotencyKey removes the pending record of a key
+func (m *MemoryStore) ReleaseIdempotencyKey(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if prior, found := m.idempotencyKeys[key]; found && prior.StatusCode == 0 {
+		delete(m.idempotencyKeys, key)
+	}
+	return nil
+}
+
+// ReserveRowQuota counts rows against a client's quota for the given day
+// reports false, and counts nothing, if the rows would take the client's usage for the day over limit
+func (m *MemoryStore) ReserveRowQuota(clientID string, day time.Time, rows int, limit int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := quotaKey{clientID: clientID, day: day.Format("2006-01-02")}
+	if m.quotas[k]+rows > limit {
+		return false, nil
+	}
+	m.quotas[k] += rows
+	return true, nil
+}
+
+// ReleaseRowQuota gives back rows reserved for an upload that was not processed
+func (m *MemoryStore) ReleaseRowQuota(clientID string, day time.Time, rows int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := quotaKey{clientID: clientID, day: day.Format("2006-01-02")}
+	if m.quotas[k] -= rows; m.quotas[k] < 0 {
+		m.quotas[k] = 0
+	}
+	return nil
+}
+
+// GetRowQuotaUsage returns the number of rows a client has uploaded on the given day
+func (m *MemoryStore) GetRowQuotaUsage(clientID string, day time.Time) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.quotas[quotaKey{clientID: clientID, day: day.Format("2006-01-02")}], nil
+}
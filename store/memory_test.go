@@ -0,0 +1,90 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStoreSaveProcessedFile(t *testing.T) {
+	m := NewMemory()
+	ref := uuid.Must(uuid.NewV4())
+	require.NoError(t, m.CreateFile(File{Ref: ref, Fingerprint: "abc123", UploadedAt: time.Now()}))
+	require.Error(t, m.CreateFile(File{Ref: ref}))
+
+	// processing files are not matched by fingerprint
+	_, err := m.FindFileByFingerprint("abc123")
+	require.Equal(t, sql.ErrNoRows, err)
+
+	// a failed write leaves nothing behind, and the file can still be saved
+	err = m.SaveProcessedFile(ref, func(w FileWriter) error {
+		require.NoError(t, w.SaveNumbers([]Number{{Number: "27831234567", CountryIOCCode: "rsa", FileRef: ref}}))
+		return errors.New("validation failed")
+	})
+	require.EqualError(t, err, "validation failed")
+	results, err := m.GetFileResults(ref)
+	require.NoError(t, err)
+	require.Empty(t, results.ValidNumbers)
+
+	numbers := []Number{{Number: "27831234567", CountryIOCCode: "rsa", FileRef: ref, SourceRow: SourceRow{RowNumber: 1}}}
+	err = m.SaveProcessedFile(ref, func(w FileWriter) error {
+		if err := w.SaveNumbers(numbers); err != nil {
+			return err
+		}
+		// the caller reuses its batches once written
+		numbers[0].Number = "27831234568"
+		return nil
+	})
+	require.NoError(t, err)
+	results, err = m.GetFileResults(ref)
+	require.NoError(t, err)
+	require.Equal(t, []string{"27831234567"}, results.ValidNumbers)
+
+	file, err := m.FindFileByFingerprint("abc123")
+	require.NoError(t, err)
+	require.Equal(t, FileCompleted, file.Status)
+	require.NotNil(t, file.CompletedAt)
+	stats, err := m.GetFileStats(ref)
+	require.NoError(t, err)
+	require.Equal(t, &Stats{ValidNumbersCount: 1, TotalNumbersProcessed: 1,
+		Countries: map[string]Stats{"rsa": {ValidNumbersCount: 1, TotalNumbersProcessed: 1}}}, stats)
+
+	// a completed file cannot be saved again
+	require.Error(t, m.SaveProcessedFile(ref, func(w FileWriter) error { return nil }))
+}
+
+func TestMemoryStoreRowQuota(t *testing.T) {
+	m := NewMemory()
+	day := time.Now()
+	var wg sync.WaitGroup
+	reserved := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := m.ReserveRowQuota("client", day, 30, 100)
+			require.NoError(t, err)
+			reserved <- ok
+		}()
+	}
+	wg.Wait()
+	close(reserved)
+	count := 0
+	for ok := range reserved {
+		if ok {
+			count++
+		}
+	}
+	require.Equal(t, 3, count)
+	used, err := m.GetRowQuotaUsage("client", day)
+	require.NoError(t, err)
+	require.Equal(t, 90, used)
+	used, err = m.GetRowQuotaUsage("client", day.AddDate(0, 0, 1))
+	require.NoError(t, err)
+	require.Equal(t, 0, used)
+}
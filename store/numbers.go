@@ -0,0 +1,245 @@
+package store
+
+import (
+	"context"
+	"sort"
+)
+
+// the numbers of a file kept outside a database, by category
+// implements FileWriter, so a file being processed can be collected before it is stored
+type fileNumbers struct {
+	numbers    []Number
+	fixed      []FixedNumber
+	rejected   []RejectedNumber
+	duplicates []DuplicateNumber
+	inputs     []InputRow
+	saved      *Stats
+	// the numbers ordered by their RowCursor, once every number is saved
+	sorted *sortedRows
+}
+
+// SaveNumbers keeps valid numbers
+func (f *fileNumbers) SaveNumbers(numbers []Number) error {
+	f.numbers = append(f.numbers, numbers...)
+	return nil
+}
+
+// SaveFixedNumbers keeps fixed numbers
+func (f *fileNumbers) SaveFixedNumbers(fixedNums []FixedNumber) error {
+	f.fixed = append(f.fixed, fixedNums...)
+	return nil
+}
+
+// SaveRejectedNumbers keeps numbers that could not be fixed
+func (f *fileNumbers) SaveRejectedNumbers(rejectedNums []RejectedNumber) error {
+	f.rejected = append(f.rejected, rejectedNums...)
+	return nil
+}
+
+// SaveDuplicateNumbers keeps numbers repeating an earlier number in the same file
+func (f *fileNumbers) SaveDuplicateNumbers(duplicateNums []DuplicateNumber) error {
+	f.duplicates = append(f.duplicates, duplicateNums...)
+	return nil
+}
+
+// SaveInputRows keeps the cells of rows of the uploaded file
+func (f *fileNumbers) SaveInputRows(rows []InputRow) error {
+	f.inputs = append(f.inputs, rows...)
+	return nil
+}
+
+// SaveStats keeps the stats of the file
+func (f *fileNumbers) SaveStats(stats Stats) error {
+	f.saved = &stats
+	return nil
+}
+
+// adds the numbers of other after those already kept
+func (f *fileNumbers) add(other *fileNumbers) {
+	f.numbers = append(f.numbers, other.numbers...)
+	f.fixed = append(f.fixed, other.fixed...)
+	f.rejected = append(f.rejected, other.rejected...)
+	f.duplicates = append(f.duplicates, other.duplicates...)
+	f.inputs = append(f.inputs, other.inputs...)
+	if other.saved != nil {
+		f.saved = other.saved
+	}
+	f.sorted = nil
+}
+
+// sorts the numbers once every number is saved, so that pages are read without sorting them again
+func (f *fileNumbers) index() {
+	f.sorted = newSortedRows(f.rows())
+}
+
+// returns the numbers ordered by their RowCursor, sorting them unless they were indexed
+func (f *fileNumbers) sortedRows() *sortedRows {
+	if f.sorted != nil {
+		return f.sorted
+	}
+	return newSortedRows(f.rows())
+}
+
+// returns the saved stats, or counts them from the numbers, as the Postgres store does
+func (f *fileNumbers) stats() *Stats {
+	if f.saved != nil {
+		stats := *f.saved
+		return &stats
+	}
+	stats := &Stats{}
+	for _, num := range f.numbers {
+		stats.Add(num.CountryIOCCode, ValidCategory, 1)
+	}
+	for _, num := range f.fixed {
+		stats.Add(num.CountryIOCCode, FixedCategory, 1)
+	}
+	for _, num := range f.rejected {
+		stats.Add(num.CountryIOCCode, RejectedCategory, 1)
+		stats.AddReason(num.Reason, 1)
+	}
+	for _, num := range f.duplicates {
+		stats.Add(num.CountryIOCCode, DuplicateCategory, 1)
+	}
+	return stats
+}
+
+// returns the numbers by category, with the fields the Postgres store returns
+func (f *fileNumbers) results() *FileResults {
+	result := &FileResults{}
+	for _, num := range f.numbers {
+		result.ValidNumbers = append(result.ValidNumbers, num.Number)
+	}
+	for _, num := range f.rejected {
+		result.RejectedNumbers = append(result.RejectedNumbers, num.Number)
+	}
+	for _, num := range f.fixed {
+		result.FixedNumbers = append(result.FixedNumbers, FixedNumber{
+			OriginalNumber: num.OriginalNumber,
+			Changes:        num.Changes,
+			FixedNumber:    num.FixedNumber,
+		})
+	}
+	for _, num := range f.duplicates {
+		result.DuplicateNumbers = append(result.DuplicateNumbers, DuplicateNumber{
+			Number:           num.Number,
+			NormalizedNumber: num.NormalizedNumber,
+			RowNumber:        num.RowNumber,
+			FirstRowNumber:   num.FirstRowNumber,
+			Part:             num.Part,
+			Passthrough:      num.Passthrough,
+		})
+	}
+	sort.SliceStable(result.DuplicateNumbers, func(i, j int) bool {
+		a, b := result.DuplicateNumbers[i], result.DuplicateNumbers[j]
+		return a.RowNumber < b.RowNumber || (a.RowNumber == b.RowNumber && a.Part < b.Part)
+	})
+	return result
+}
+
+// returns every number in the order of the file
+func (f *fileNumbers) rows() []ResultRow {
+	var rows []ResultRow
+	for _, num := range f.numbers {
+		rows = append(rows, ResultRow{SourceRow: num.SourceRow, Category: ValidCategory, Number: num.Number, FixedNumber: num.Number})
+	}
+	for _, num := range f.fixed {
+		rows = append(rows, ResultRow{SourceRow: num.SourceRow, Category: FixedCategory, Number: num.OriginalNumber,
+			FixedNumber: num.FixedNumber, Changes: num.Changes})
+	}
+	for _, num := range f.rejected {
+		rows = append(rows, ResultRow{SourceRow: num.SourceRow, Category: RejectedCategory, Number: num.Number, Reason: num.Reason})
+	}
+	for _, num := range f.duplicates {
+		rows = append(rows, ResultRow{
+			SourceRow:      SourceRow{RowNumber: num.RowNumber, Part: num.Part, Passthrough: num.Passthrough},
+			Category:       DuplicateCategory,
+			Number:         num.Number,
+			FixedNumber:    num.NormalizedNumber,
+			FirstRowNumber: num.FirstRowNumber,
+		})
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		return a.RowNumber < b.RowNumber || (a.RowNumber == b.RowNumber && a.Part < b.Part)
+	})
+	return rows
+}
+
+// returns a page of the numbers, ordered by their RowCursor as the Postgres store orders them
+func (f *fileNumbers) page(page RowPage) []ResultRow {
+	return f.sortedRows().page(page)
+}
+
+// the numbers of a file ordered by their RowCursor, as a whole and by category
+// a page is found by seeking to its cursor, rather than by going through the numbers before it
+type sortedRows struct {
+	all        []ResultRow
+	byCategory map[string][]ResultRow
+}
+
+// sorts rows by their RowCursor
+func newSortedRows(rows []ResultRow) *sortedRows {
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Cursor().before(rows[j].Cursor()) })
+	s := &sortedRows{all: rows, byCategory: map[string][]ResultRow{}}
+	for _, row := range rows {
+		s.byCategory[row.Category] = append(s.byCategory[row.Category], row)
+	}
+	return s
+}
+
+// returns a page of the numbers, which must not be changed as it is shared with other pages
+func (s *sortedRows) page(page RowPage) []ResultRow {
+	rows := s.all
+	if page.Category != "" {
+		rows = s.byCategory[page.Category]
+	}
+	if page.After != nil {
+		after := *page.After
+		rows = rows[sort.Search(len(rows), func(i int) bool { return after.before(rows[i].Cursor()) }):]
+	}
+	if page.Limit > 0 && len(rows) > page.Limit {
+		rows = rows[:page.Limit]
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return rows[:len(rows):len(rows)]
+}
+
+// calls fn with each of rows, stopping once ctx is done
+func eachRow(ctx context.Context, rows []ResultRow, fn func(row ResultRow) error) error {
+	for _, row := range rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// calls fn with each input row in the order of the file, along with the numbers read from it, stopping once ctx is done
+func (f *fileNumbers) eachInput(ctx context.Context, fn func(row InputRow, numbers []ResultRow) error) error {
+	inputs := append([]InputRow(nil), f.inputs...)
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].RowNumber < inputs[j].RowNumber })
+	rows := f.page(RowPage{})
+	for _, input := range inputs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// both are ordered by row, so the numbers of each row follow those of the row before
+		for len(rows) > 0 && rows[0].RowNumber < input.RowNumber {
+			rows = rows[1:]
+		}
+		n := 0
+		for n < len(rows) && rows[n].RowNumber == input.RowNumber {
+			n++
+		}
+		if err := fn(input, rows[:n:n]); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package store_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+	"github.com/tonyOreglia/api-mobile-numbers/store/storetest"
+)
+
+func TestGetFileStatsPostgres(t *testing.T) {
+	s := storetest.Postgres(t)
+	ref := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(store.File{Ref: ref, Filename: "numbers.csv", UploadedAt: time.Now(), Country: "rsa", RowCount: 6}))
+
+	expected := store.Stats{
+		ValidNumbersCount:     2,
+		FixedNumbersCount:     1,
+		InvalidNumbersCount:   2,
+		DuplicateNumbersCount: 1,
+		TotalNumbersProcessed: 6,
+		Countries: map[string]store.Stats{
+			"rsa": {ValidNumbersCount: 1, FixedNumbersCount: 1, InvalidNumbersCount: 1, DuplicateNumbersCount: 1, TotalNumbersProcessed: 4},
+			"aus": {ValidNumbersCount: 1, InvalidNumbersCount: 1, TotalNumbersProcessed: 2},
+		},
+		Changes: map[string]int{"dialing_code_prepended": 1},
+		Reasons: map[string]int{"invalid_length": 1, "unknown_country": 1},
+	}
+	err := s.SaveProcessedFile(ref, func(w store.FileWriter) error {
+		err := w.SaveNumbers([]store.Number{
+			{Number: "27831234567", CountryIOCCode: "rsa", FileRef: ref, SourceRow: store.SourceRow{RowNumber: 1}},
+			{Number: "61412345678", CountryIOCCode: "aus", FileRef: ref, SourceRow: store.SourceRow{RowNumber: 2}},
+		})
+		if err != nil {
+			return err
+		}
+		err = w.SaveFixedNumbers([]store.FixedNumber{{OriginalNumber: "831234568", FixedNumber: "27831234568",
+			Changes: "prepended number with 27", CountryIOCCode: "rsa", FileRef: ref, SourceRow: store.SourceRow{RowNumber: 3}}})
+		if err != nil {
+			return err
+		}
+		err = w.SaveRejectedNumbers([]store.RejectedNumber{
+			{Number: "123", CountryIOCCode: "rsa", FileRef: ref, Reason: "invalid_length", SourceRow: store.SourceRow{RowNumber: 4}},
+			{Number: "456", CountryIOCCode: "aus", FileRef: ref, Reason: "unknown_country", SourceRow: store.SourceRow{RowNumber: 5}},
+		})
+		if err != nil {
+			return err
+		}
+		err = w.SaveDuplicateNumbers([]store.DuplicateNumber{{Number: "27831234567", NormalizedNumber: "27831234567", RowNumber: 6,
+			FirstRowNumber: 1, CountryIOCCode: "rsa", FileRef: ref}})
+		if err != nil {
+			return err
+		}
+		return w.SaveStats(expected)
+	})
+	require.NoError(t, err)
+
+	stats, err := s.GetFileStats(ref)
+	require.NoError(t, err)
+	require.Equal(t, &expected, stats)
+
+	// counting the numbers gives the same stats, but for the changes which are only known when fixing
+	s.DB.MustExec(`UPDATE files SET stats=NULL WHERE ref=$1`, ref)
+	stats, err = s.GetFileStats(ref)
+	require.NoError(t, err)
+	expected.Changes = nil
+	require.Equal(t, &expected, stats)
+
+	file, err := s.GetFile(ref)
+	require.NoError(t, err)
+	require.Equal(t, store.FileCompleted, file.Status)
+	require.NotNil(t, file.CompletedAt)
+
+	_, err = s.GetFileStats(uuid.Must(uuid.NewV4()))
+	require.Equal(t, sql.ErrNoRows, err)
+}
@@ -1,7 +1,13 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/lib/pq"
@@ -10,185 +16,639 @@ import (
 )
 
 type Stats struct {
-	ValidNumbersCount     int `json:"valid_numbers_count"`
-	FixedNumbersCount     int `json:"fixed_numbers_count"`
-	InvalidNumbersCount   int `json:"invalid_numbers_count"`
-	TotalNumbersProcessed int `json:"total_numbers_processed"`
+	ValidNumbersCount     int              `json:"valid_numbers_count"`
+	FixedNumbersCount     int              `json:"fixed_numbers_count"`
+	InvalidNumbersCount   int              `json:"invalid_numbers_count"`
+	DuplicateNumbersCount int              `json:"duplicate_numbers_count"`
+	TotalNumbersProcessed int              `json:"total_numbers_processed"`
+	Countries             map[string]Stats `json:"countries,omitempty"`
+	// number of fixed numbers that had each type of change made, a number may have several
+	Changes map[string]int `json:"changes,omitempty"`
+	// number of rejected numbers by the reason they were rejected for
+	Reasons map[string]int `json:"reasons,omitempty"`
+	// stats of each file of an uploaded zip archive, in archive order
+	Members []MemberStats `json:"members,omitempty"`
+}
+
+// MemberStats are the stats of a single file within an uploaded zip archive
+type MemberStats struct {
+	Name  string `json:"name"`
+	Stats Stats  `json:"stats"`
+}
+
+// AddChanges counts a fixed number with the given types of change
+func (s *Stats) AddChanges(changeTypes []string) {
+	for _, changeType := range changeTypes {
+		if s.Changes == nil {
+			s.Changes = map[string]int{}
+		}
+		s.Changes[changeType]++
+	}
+}
+
+// AddReason counts rejected numbers rejected for reason
+func (s *Stats) AddReason(reason string, count int) {
+	if reason == "" {
+		return
+	}
+	if s.Reasons == nil {
+		s.Reasons = map[string]int{}
+	}
+	s.Reasons[reason] += count
+}
+
+// Value implements driver.Valuer, stats are stored as JSON
+func (s Stats) Value() (driver.Value, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan implements sql.Scanner
+func (s *Stats) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	}
+	return errors.Errorf("cannot scan %T into Stats", src)
+}
+
+// Add counts numbers of the given category towards the totals and towards the given country
+func (s *Stats) Add(country string, category string, count int) {
+	s.add(category, count)
+	s.addCountry(country, category, count)
+}
+
+func (s *Stats) addCountry(country string, category string, count int) {
+	if country == "" {
+		return
+	}
+	if s.Countries == nil {
+		s.Countries = map[string]Stats{}
+	}
+	countryStats := s.Countries[country]
+	countryStats.add(category, count)
+	s.Countries[country] = countryStats
+}
+
+func (s *Stats) add(category string, count int) {
+	switch category {
+	case ValidCategory:
+		s.ValidNumbersCount += count
+	case FixedCategory:
+		s.FixedNumbersCount += count
+	case RejectedCategory:
+		s.InvalidNumbersCount += count
+	case DuplicateCategory:
+		s.DuplicateNumbersCount += count
+	default:
+		return
+	}
+	s.TotalNumbersProcessed += count
 }
 
 type FileResults struct {
-	ValidNumbers    []string      `json:"valid_numbers"`
-	FixedNumbers    []FixedNumber `json:"fixed_numbers"`
-	RejectedNumbers []string      `json:"rejected_numbers"`
+	ValidNumbers     []string          `json:"valid_numbers"`
+	FixedNumbers     []FixedNumber     `json:"fixed_numbers"`
+	RejectedNumbers  []string          `json:"rejected_numbers"`
+	DuplicateNumbers []DuplicateNumber `json:"duplicate_numbers"`
+	// columns of the upload kept with each number, and every number in file order along with their values
+	// only set for files that kept passthrough columns
+	PassthroughColumns []string    `json:"passthrough_columns,omitempty"`
+	Rows               []ResultRow `json:"rows,omitempty"`
 }
 
-// GetFileResults query DB for results from previously processed file
+// GetFileResults query DB for results from previously processed file, sql.ErrNoRows for an unknown ref
 func (s *Store) GetFileResults(ref uuid.UUID) (*FileResults, error) {
-	query := `SELECT number FROM numbers WHERE file_ref=$1`
-	result := &FileResults{}
-	rows, err := s.DB.Query(query, ref)
+	var exists bool
+	err := s.DB.Get(&exists, `SELECT EXISTS(SELECT 1 FROM files WHERE ref=$1)`, ref)
 	if err != nil {
 		return nil, err
 	}
-	for rows.Next() {
-		var number string
-		err = rows.Scan(&number)
-		result.ValidNumbers = append(result.ValidNumbers, number)
+	if !exists {
+		return nil, sql.ErrNoRows
 	}
-	query = `SELECT number FROM rejected_numbers WHERE file_ref=$1`
-	rows, err = s.DB.Query(query, ref)
+	result := &FileResults{}
+	query := `SELECT number FROM numbers WHERE file_ref=$1`
+	err = s.DB.Select(&result.ValidNumbers, query, ref)
 	if err != nil {
 		return nil, err
 	}
-	for rows.Next() {
-		var number string
-		err = rows.Scan(&number)
-		if err != nil {
-			return nil, err
-		}
-		result.RejectedNumbers = append(result.RejectedNumbers, number)
+	query = `SELECT number FROM rejected_numbers WHERE file_ref=$1`
+	err = s.DB.Select(&result.RejectedNumbers, query, ref)
+	if err != nil {
+		return nil, err
 	}
 	query = `SELECT original_number, changes, fixed_number FROM fixed_numbers WHERE file_ref=$1`
 	err = s.DB.Select(&result.FixedNumbers, query, ref)
 	if err != nil {
 		return nil, err
 	}
+	query = `SELECT number, normalized_number, row_number, first_row_number, part, passthrough FROM duplicate_numbers
+		WHERE file_ref=$1 ORDER BY row_number, part`
+	err = s.DB.Select(&result.DuplicateNumbers, query, ref)
+	if err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
-// GetFileStats query DB for statistics from previously processed file
-func (s *Store) GetFileStats(ref uuid.UUID) (*Stats, error) {
-	query := `SELECT FROM numbers WHERE file_ref=$1`
-	result, err := s.DB.Exec(query, ref)
+// GetFileRows query DB for every number of a previously processed file, in the order of the file
+func (s *Store) GetFileRows(ref uuid.UUID) ([]ResultRow, error) {
+	query, args := rowsQuery(ref, RowPage{})
+	var rows []ResultRow
+	err := s.DB.Select(&rows, query, args...)
 	if err != nil {
 		return nil, err
 	}
-	validNumbers, err := result.RowsAffected()
+	return rows, nil
+}
+
+// the tables holding each category of numbers, selecting the columns of a ResultRow
+// each is ordered within a file by row_number, part and its number column, as indexed
+var rowTables = []struct {
+	category     string
+	numberColumn string
+	query        string
+}{
+	{DuplicateCategory, "number", `SELECT row_number, part, passthrough, 'duplicate' AS category, number,
+		normalized_number AS fixed_number, '' AS changes, '' AS reason, first_row_number FROM duplicate_numbers`},
+	{FixedCategory, "original_number", `SELECT row_number, part, passthrough, 'fixed' AS category,
+		original_number AS number, fixed_number, changes, '' AS reason, 0 AS first_row_number FROM fixed_numbers`},
+	{RejectedCategory, "number", `SELECT row_number, part, passthrough, 'rejected' AS category, number,
+		'' AS fixed_number, '' AS changes, reason, 0 AS first_row_number FROM rejected_numbers`},
+	{ValidCategory, "number", `SELECT row_number, part, passthrough, 'valid' AS category, number,
+		number AS fixed_number, '' AS changes, '' AS reason, 0 AS first_row_number FROM numbers`},
+}
+
+// GetFileRowsPage query DB for a page of the numbers of a previously processed file, ordered by their RowCursor
+// every table is read with a keyset query from the cursor on, so pages deep into a file cost as little as the first
+func (s *Store) GetFileRowsPage(ref uuid.UUID, page RowPage) ([]ResultRow, error) {
+	query, args := rowsQuery(ref, page)
+	if query == "" {
+		return nil, nil
+	}
+	var rows []ResultRow
+	err := s.DB.Select(&rows, query, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[GetFileRowsPage] unable to query numbers of file %s", ref)
+	}
+	return rows, nil
+}
 
-	query = `SELECT FROM fixed_numbers WHERE file_ref=$1`
-	result, err = s.DB.Exec(query, ref)
+// EachFileRow query DB for the numbers of a previously processed file, calling fn with each as it is read
+// rows are read from the connection one at a time, so a file of any size is read in constant memory
+// the query is cancelled along with ctx
+func (s *Store) EachFileRow(ctx context.Context, ref uuid.UUID, category string, fn func(row ResultRow) error) error {
+	query, args := rowsQuery(ref, RowPage{Category: category})
+	if query == "" {
+		return nil
+	}
+	rows, err := s.DB.QueryxContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return errors.Wrapf(err, "[EachFileRow] unable to query numbers of file %s", ref)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row ResultRow
+		if err := rows.StructScan(&row); err != nil {
+			return errors.Wrapf(err, "[EachFileRow] unable to read number of file %s", ref)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
 	}
-	fixedNumbers, err := result.RowsAffected()
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "[EachFileRow] unable to read numbers of file %s", ref)
+	}
+	return nil
+}
 
-	query = `SELECT FROM rejected_numbers WHERE file_ref=$1`
-	result, err = s.DB.Exec(query, ref)
+// EachInputRow calls fn with each row of a file in the order of the file, along with the numbers read from it
+// rows and numbers are read with a single query, so that a download holds a single connection of the pool
+func (s *Store) EachInputRow(ctx context.Context, ref uuid.UUID, fn func(row InputRow, numbers []ResultRow) error) error {
+	numbersQuery, args := rowsQuery(ref, RowPage{})
+	query := fmt.Sprintf(`SELECT input.cells, numbers.* FROM input_rows AS input JOIN (%s) AS numbers
+		ON numbers.row_number=input.row_number WHERE input.file_ref=$1
+		ORDER BY numbers.row_number, numbers.part, numbers.category, numbers.number`, numbersQuery)
+	rows, err := s.DB.QueryxContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return errors.Wrapf(err, "[EachInputRow] unable to query rows of file %s", ref)
 	}
-	rejectedNumbers, err := result.RowsAffected()
+	defer rows.Close()
+	var input *InputRow
+	var numbers []ResultRow
+	for rows.Next() {
+		var row struct {
+			Cells pq.StringArray `db:"cells"`
+			ResultRow
+		}
+		if err := rows.StructScan(&row); err != nil {
+			return errors.Wrapf(err, "[EachInputRow] unable to read row of file %s", ref)
+		}
+		if input != nil && input.RowNumber != row.RowNumber {
+			if err := fn(*input, numbers); err != nil {
+				return err
+			}
+			input, numbers = nil, nil
+		}
+		if input == nil {
+			input = &InputRow{FileRef: ref, RowNumber: row.RowNumber, Cells: row.Cells}
+		}
+		numbers = append(numbers, row.ResultRow)
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "[EachInputRow] unable to read rows of file %s", ref)
+	}
+	if input != nil {
+		return fn(*input, numbers)
+	}
+	return nil
+}
 
-	return &Stats{
-		ValidNumbersCount:     int(validNumbers),
-		FixedNumbersCount:     int(fixedNumbers),
-		InvalidNumbersCount:   int(rejectedNumbers),
-		TotalNumbersProcessed: int(validNumbers) + int(fixedNumbers) + int(rejectedNumbers),
-	}, nil
+// builds the query of the numbers of a file selected by page, ordered by their RowCursor
+// the query is empty for an unknown category, which has no numbers
+func rowsQuery(ref uuid.UUID, page RowPage) (string, []interface{}) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	fileRef, limit := arg(ref), ""
+	if page.Limit > 0 {
+		limit = " LIMIT " + arg(page.Limit)
+	}
+	var queries []string
+	for _, table := range rowTables {
+		if page.Category != "" && table.category != page.Category {
+			continue
+		}
+		where := "file_ref=" + fileRef
+		if after := page.After; after != nil {
+			// numbers at the cursor's row and part come after it only if their category, then number, does
+			switch {
+			case table.category > after.Category:
+				where += fmt.Sprintf(" AND (row_number, part) >= (%s, %s)", arg(after.RowNumber), arg(after.Part))
+			case table.category < after.Category:
+				where += fmt.Sprintf(" AND (row_number, part) > (%s, %s)", arg(after.RowNumber), arg(after.Part))
+			default:
+				where += fmt.Sprintf(" AND (row_number, part, %s) > (%s, %s, %s)",
+					table.numberColumn, arg(after.RowNumber), arg(after.Part), arg(after.Number))
+			}
+		}
+		queries = append(queries, fmt.Sprintf("(%s WHERE %s ORDER BY row_number, part, %s%s)",
+			table.query, where, table.numberColumn, limit))
+	}
+	if len(queries) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) AS page ORDER BY row_number, part, category, number%s",
+		strings.Join(queries, " UNION ALL "), limit), args
 }
 
-// SaveNumbers stores valid numbers
-func (s *Store) SaveNumbers(numbers []Number) error {
-	if len(numbers) == 0 {
-		return nil
+// GetFileStats query DB for the stats of a previously processed file
+// stats are saved with the numbers of a file, files processed before they were are counted from their numbers
+// sql.ErrNoRows is returned for an unknown file
+func (s *Store) GetFileStats(ref uuid.UUID) (*Stats, error) {
+	var saved struct {
+		Stats *Stats `db:"stats"`
 	}
-	log.Infof("Saving %d numbers", len(numbers))
-	txn, err := s.DB.Begin()
+	err := s.DB.Get(&saved, `SELECT stats FROM files WHERE ref=$1`, ref)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if saved.Stats != nil {
+		return saved.Stats, nil
 	}
-	stmt, err := txn.Prepare(pq.CopyIn("numbers", "number", "country_ioc_code", "file_ref"))
+	return s.countFileStats(ref)
+}
+
+// counts the numbers of a file by category, country and rejection reason in a single query
+func (s *Store) countFileStats(ref uuid.UUID) (*Stats, error) {
+	query := `SELECT country_ioc_code, category, reason, COUNT(*) AS count FROM (
+		SELECT country_ioc_code, 'valid' AS category, '' AS reason FROM numbers WHERE file_ref=$1
+		UNION ALL SELECT country_ioc_code, 'fixed' AS category, '' AS reason FROM fixed_numbers WHERE file_ref=$1
+		UNION ALL SELECT country_ioc_code, 'rejected' AS category, reason FROM rejected_numbers WHERE file_ref=$1
+		UNION ALL SELECT country_ioc_code, 'duplicate' AS category, '' AS reason FROM duplicate_numbers WHERE file_ref=$1
+	) AS results GROUP BY country_ioc_code, category, reason`
+	var counts []struct {
+		CountryIOCCode string `db:"country_ioc_code"`
+		Category       string `db:"category"`
+		Reason         string `db:"reason"`
+		Count          int    `db:"count"`
+	}
+	err := s.DB.Select(&counts, query, ref)
 	if err != nil {
-		return errors.Wrap(err, "[SaveNumbers] unable to prepare pq.CopyIn")
+		return nil, errors.Wrapf(err, "[GetFileStats] unable to count numbers of file %s", ref)
+	}
+	stats := &Stats{}
+	for _, c := range counts {
+		stats.Add(c.CountryIOCCode, c.Category, c.Count)
+		stats.AddReason(c.Reason, c.Count)
 	}
+	return stats, nil
+}
 
-	for _, num := range numbers {
-		_, err = stmt.Exec(num.Number, num.CountryIOCCode, num.FileRef)
-		if err != nil {
-			endTrasaction(stmt, txn)
-			return errors.Wrapf(err, "[SaveNumbers] unable to save number %+v", num)
-		}
+// columns of the files table, in the order of the File fields
+const fileColumns = `ref, filename, label, uploaded_at, fingerprint, split_cells, passthrough_columns, country, row_count,
+	fix_policy, rules_version, status, error, completed_at, source_columns`
+
+// a nil array would be saved as NULL
+func nonNullArray(a pq.StringArray) pq.StringArray {
+	if a == nil {
+		return pq.StringArray{}
 	}
-	return executeTransaction(stmt, txn, "SaveNumbers")
+	return a
 }
 
-// SaveFixedNumbers stores fixed mobile numbers, the originally provided number, and a list of changes
-func (s *Store) SaveFixedNumbers(fixedNums []FixedNumber) error {
-	if len(fixedNums) == 0 {
-		return nil
+// CreateFile saves the record of a file about to be processed
+// the numbers of the file are then saved with SaveProcessedFile, or FailFile records why they could not be
+func (s *Store) CreateFile(file File) error {
+	query := `INSERT INTO files (ref, filename, label, uploaded_at, fingerprint, split_cells, passthrough_columns, country,
+		row_count, fix_policy, rules_version, status, source_columns)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+	_, err := s.DB.Exec(query, file.Ref, file.Filename, file.Label, file.UploadedAt, file.Fingerprint, file.SplitCells,
+		nonNullArray(file.PassthroughColumns), file.Country, file.RowCount, file.FixPolicy, file.RulesVersion, FileProcessing,
+		nonNullArray(file.SourceColumns))
+	if err != nil {
+		return errors.Wrapf(err, "[CreateFile] unable to save file %s", file.Ref)
 	}
-	log.Infof("Saving %d fixed numbers", len(fixedNums))
-	txn, err := s.DB.Begin()
+	return nil
+}
+
+// FailFile marks a file as failed, recording why
+func (s *Store) FailFile(ref uuid.UUID, reason string) error {
+	query := `UPDATE files SET status=$2, error=$3, completed_at=now() WHERE ref=$1`
+	_, err := s.DB.Exec(query, ref, FileFailed, reason)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "[FailFile] unable to mark file %s as failed", ref)
 	}
-	stmt, err := txn.Prepare(pq.CopyIn("fixed_numbers", "original_number", "changes", "fixed_number", "file_ref"))
+	return nil
+}
+
+// GetFile query DB for the upload metadata of a previously processed file
+// sql.ErrNoRows is returned if there is no record of the file
+func (s *Store) GetFile(ref uuid.UUID) (*File, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE ref=$1`
+	file := &File{}
+	err := s.DB.Get(file, query, ref)
 	if err != nil {
-		endTrasaction(stmt, txn)
-		return errors.Wrap(err, "[SaveFixedNumbers] unable to prepare pq.CopyIn")
+		return nil, err
 	}
-	for _, num := range fixedNums {
-		_, err = stmt.Exec(num.OriginalNumber, num.Changes, num.FixedNumber, num.FileRef)
-		if err != nil {
-			endTrasaction(stmt, txn)
-			return errors.Wrapf(err, "[SaveFixedNumbers] unable to save number %+v", num)
-		}
+	return file, nil
+}
+
+// FindFileByFingerprint query DB for the most recently completed file with the given content fingerprint
+// sql.ErrNoRows is returned if no file with the fingerprint was completed
+func (s *Store) FindFileByFingerprint(fingerprint string) (*File, error) {
+	query := `SELECT ` + fileColumns + ` FROM files
+		WHERE fingerprint=$1 AND status=$2 ORDER BY uploaded_at DESC LIMIT 1`
+	file := &File{}
+	err := s.DB.Get(file, query, fingerprint, FileCompleted)
+	if err != nil {
+		return nil, err
 	}
-	return executeTransaction(stmt, txn, "SaveFixedNumbers")
+	return file, nil
 }
 
-// SaveRejectedNumbers saves invalid numbers that could not be fixed
-func (s *Store) SaveRejectedNumbers(rejectedNums []RejectedNumber) error {
-	if len(rejectedNums) == 0 {
-		return nil
+// GetIdempotencyKey query DB for an idempotency key used after the given time
+// sql.ErrNoRows is returned if the key was not used, or was last used before since
+func (s *Store) GetIdempotencyKey(key string, since time.Time) (*IdempotencyKey, error) {
+	query := `SELECT key, fingerprint, file_ref, status_code, response, created_at FROM idempotency_keys
+		WHERE key=$1 AND created_at>$2`
+	idempotencyKey := &IdempotencyKey{}
+	err := s.DB.Get(idempotencyKey, query, key, since)
+	if err != nil {
+		return nil, err
 	}
-	log.Infof("Saving %d rejected numbers", len(rejectedNums))
-	txn, err := s.DB.Begin()
+	return idempotencyKey, nil
+}
+
+// SaveIdempotencyKey stores the response to an upload against its idempotency key
+// an expired record of the same key is replaced
+func (s *Store) SaveIdempotencyKey(key IdempotencyKey) error {
+	query := `INSERT INTO idempotency_keys (key, fingerprint, file_ref, status_code, response) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (key) DO UPDATE SET fingerprint=EXCLUDED.fingerprint, file_ref=EXCLUDED.file_ref,
+		status_code=EXCLUDED.status_code, response=EXCLUDED.response, created_at=now()`
+	_, err := s.DB.Exec(query, key.Key, key.Fingerprint, key.FileRef, key.StatusCode, key.Response)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "[SaveIdempotencyKey] unable to save idempotency key %s", key.Key)
+	}
+	return nil
+}
+
+// ReserveIdempotencyKey inserts a pending record of an idempotency key, unless the key was saved after since or
+// reserved after pendingSince
+// the insert and the check are a single statement, so only one of several concurrent requests reserves the key
+func (s *Store) ReserveIdempotencyKey(key IdempotencyKey, since time.Time, pendingSince time.Time) (*IdempotencyKey, error) {
+	query := `INSERT INTO idempotency_keys (key, fingerprint, file_ref, status_code, response) VALUES ($1, $2, $3, 0, '')
+		ON CONFLICT (key) DO UPDATE SET fingerprint=EXCLUDED.fingerprint, file_ref=EXCLUDED.file_ref, status_code=0,
+		response='', created_at=now()
+		WHERE idempotency_keys.created_at<=$4 OR (idempotency_keys.status_code=0 AND idempotency_keys.created_at<=$5)
+		RETURNING key`
+	var reserved string
+	err := s.DB.Get(&reserved, query, key.Key, key.Fingerprint, key.FileRef, since, pendingSince)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "[ReserveIdempotencyKey] unable to reserve idempotency key %s", key.Key)
+	}
+	prior, err := s.GetIdempotencyKey(key.Key, since)
+	if err == sql.ErrNoRows {
+		// the key was released since it was found, it is reported as pending so the upload is retried
+		return &IdempotencyKey{Key: key.Key, Fingerprint: key.Fingerprint}, nil
 	}
-	stmt, err := txn.Prepare(pq.CopyIn("rejected_numbers", "number", "file_ref"))
 	if err != nil {
-		endTrasaction(stmt, txn)
-		return errors.Wrap(err, "[SaveRejectedNumbers] unable to prepare pq.CopyIn")
+		return nil, errors.Wrapf(err, "[ReserveIdempotencyKey] unable to read idempotency key %s", key.Key)
 	}
-	for _, num := range rejectedNums {
-		_, err = stmt.Exec(num.Number, num.FileRef)
-		if err != nil {
-			endTrasaction(stmt, txn)
-			return errors.Wrapf(err, "[SaveRejectedNumbers] unable to save number %+v", num)
-		}
+	return prior, nil
+}
+
+// ReleaseIdempotencyKey deletes the pending record of an idempotency key, leaving a saved response in place
+func (s *Store) ReleaseIdempotencyKey(key string) error {
+	_, err := s.DB.Exec(`DELETE FROM idempotency_keys WHERE key=$1 AND status_code=0`, key)
+	if err != nil {
+		return errors.Wrapf(err, "[ReleaseIdempotencyKey] unable to release idempotency key %s", key)
 	}
-	return executeTransaction(stmt, txn, "SaveRejectedNumbers")
+	return nil
 }
 
-func executeTransaction(stmt *sql.Stmt, txn *sql.Tx, op string) error {
-	_, err := stmt.Exec()
+// ReserveRowQuota counts rows against a client's quota for the given day
+// reports false, and counts nothing, if the rows would take the client's usage for the day over limit
+func (s *Store) ReserveRowQuota(clientID string, day time.Time, rows int, limit int) (bool, error) {
+	if rows > limit {
+		return false, nil
+	}
+	query := `INSERT INTO client_quotas (client_id, day, rows_used) VALUES ($1, $2, $3)
+		ON CONFLICT (client_id, day) DO UPDATE SET rows_used=client_quotas.rows_used+EXCLUDED.rows_used
+		WHERE client_quotas.rows_used+EXCLUDED.rows_used<=$4
+		RETURNING rows_used`
+	var used int
+	err := s.DB.Get(&used, query, clientID, day.Format("2006-01-02"), rows, limit)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
 	if err != nil {
-		endTrasaction(stmt, txn)
-		return errors.Wrapf(err, "[%s] unable to execute bulk insert to numbers", op)
+		return false, errors.Wrapf(err, "[ReserveRowQuota] unable to reserve %d rows for client %s", rows, clientID)
 	}
+	return true, nil
+}
 
-	err = stmt.Close()
+// ReleaseRowQuota gives back rows reserved for an upload that was not processed
+func (s *Store) ReleaseRowQuota(clientID string, day time.Time, rows int) error {
+	query := `UPDATE client_quotas SET rows_used=GREATEST(rows_used-$3, 0) WHERE client_id=$1 AND day=$2`
+	_, err := s.DB.Exec(query, clientID, day.Format("2006-01-02"), rows)
 	if err != nil {
-		if e := stmt.Close(); e != nil {
-			log.Error(e)
+		return errors.Wrapf(err, "[ReleaseRowQuota] unable to release %d rows of client %s", rows, clientID)
+	}
+	return nil
+}
+
+// GetRowQuotaUsage query DB for the number of rows a client has uploaded on the given day
+func (s *Store) GetRowQuotaUsage(clientID string, day time.Time) (int, error) {
+	query := `SELECT rows_used FROM client_quotas WHERE client_id=$1 AND day=$2`
+	var used int
+	err := s.DB.Get(&used, query, clientID, day.Format("2006-01-02"))
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+// saves the numbers of a processed file within the transaction of SaveProcessedFile
+type txnWriter struct {
+	txn *sql.Tx
+	ref uuid.UUID
+}
+
+// SaveProcessedFile saves the numbers of a file created with CreateFile in a single transaction
+// write is called to save the numbers through the FileWriter, in as many batches as it likes,
+// then the file is marked as completed
+// the transaction is only committed once everything is saved, any failure rolls it back and leaves none of the numbers behind
+func (s *Store) SaveProcessedFile(ref uuid.UUID, write func(w FileWriter) error) error {
+	txn, err := s.DB.Begin()
+	if err != nil {
+		return errors.Wrapf(err, "[SaveProcessedFile] unable to begin transaction for file %s", ref)
+	}
+	committed := false
+	defer func() {
+		// also reached when write panics
+		if !committed {
+			if err := txn.Rollback(); err != nil {
+				log.Error(errors.Wrapf(err, "[SaveProcessedFile] unable to roll back file %s", ref))
+			}
 		}
-		return errors.Wrapf(err, "[%s] unable to close DB connection", op)
+	}()
+	if err := write(&txnWriter{txn: txn, ref: ref}); err != nil {
+		return err
 	}
+	query := `UPDATE files SET status=$2, completed_at=now() WHERE ref=$1 AND status=$3`
+	res, err := txn.Exec(query, ref, FileCompleted, FileProcessing)
+	if err != nil {
+		return errors.Wrapf(err, "[SaveProcessedFile] unable to complete file %s", ref)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errors.Errorf("[SaveProcessedFile] file %s is not being processed", ref)
+	}
+	if err := txn.Commit(); err != nil {
+		return errors.Wrapf(err, "[SaveProcessedFile] unable to commit file %s", ref)
+	}
+	committed = true
+	return nil
+}
 
-	err = txn.Commit()
+// SaveStats stores the stats of the file, so they need not be counted from its numbers
+func (w *txnWriter) SaveStats(stats Stats) error {
+	_, err := w.txn.Exec(`UPDATE files SET stats=$2 WHERE ref=$1`, w.ref, stats)
 	if err != nil {
-		return errors.Wrapf(err, "[%s] unable to commit bulk transaction", op)
+		return errors.Wrapf(err, "[SaveStats] unable to save stats of file %s", w.ref)
 	}
 	return nil
 }
 
-func endTrasaction(stmt *sql.Stmt, txn *sql.Tx) {
-	if e := stmt.Close(); e != nil {
-		log.Error(e)
+// SaveNumbers stores valid numbers
+func (w *txnWriter) SaveNumbers(numbers []Number) error {
+	return copyIn(w.txn, "SaveNumbers", "numbers",
+		[]string{"number", "country_ioc_code", "file_ref", "row_number", "part", "passthrough"},
+		len(numbers), func(i int) []interface{} {
+			num := numbers[i]
+			return []interface{}{num.Number, num.CountryIOCCode, num.FileRef, num.RowNumber, num.Part, num.Passthrough}
+		})
+}
+
+// SaveFixedNumbers stores fixed mobile numbers, the originally provided number, and a list of changes
+func (w *txnWriter) SaveFixedNumbers(fixedNums []FixedNumber) error {
+	return copyIn(w.txn, "SaveFixedNumbers", "fixed_numbers",
+		[]string{"original_number", "changes", "fixed_number", "country_ioc_code", "file_ref", "row_number", "part", "passthrough"},
+		len(fixedNums), func(i int) []interface{} {
+			num := fixedNums[i]
+			return []interface{}{num.OriginalNumber, num.Changes, num.FixedNumber, num.CountryIOCCode, num.FileRef,
+				num.RowNumber, num.Part, num.Passthrough}
+		})
+}
+
+// SaveRejectedNumbers saves invalid numbers that could not be fixed
+func (w *txnWriter) SaveRejectedNumbers(rejectedNums []RejectedNumber) error {
+	return copyIn(w.txn, "SaveRejectedNumbers", "rejected_numbers",
+		[]string{"number", "country_ioc_code", "file_ref", "reason", "row_number", "part", "passthrough"},
+		len(rejectedNums), func(i int) []interface{} {
+			num := rejectedNums[i]
+			return []interface{}{num.Number, num.CountryIOCCode, num.FileRef, num.Reason, num.RowNumber, num.Part, num.Passthrough}
+		})
+}
+
+// SaveDuplicateNumbers saves numbers repeating an earlier number in the same file
+func (w *txnWriter) SaveDuplicateNumbers(duplicateNums []DuplicateNumber) error {
+	return copyIn(w.txn, "SaveDuplicateNumbers", "duplicate_numbers",
+		[]string{"number", "normalized_number", "row_number", "first_row_number", "part", "country_ioc_code", "file_ref", "passthrough"},
+		len(duplicateNums), func(i int) []interface{} {
+			num := duplicateNums[i]
+			return []interface{}{num.Number, num.NormalizedNumber, num.RowNumber, num.FirstRowNumber, num.Part,
+				num.CountryIOCCode, num.FileRef, num.Passthrough}
+		})
+}
+
+// SaveInputRows saves the cells of rows of the uploaded file
+func (w *txnWriter) SaveInputRows(rows []InputRow) error {
+	return copyIn(w.txn, "SaveInputRows", "input_rows", []string{"file_ref", "row_number", "cells"},
+		len(rows), func(i int) []interface{} {
+			row := rows[i]
+			return []interface{}{row.FileRef, row.RowNumber, row.Cells}
+		})
+}
+
+// bulk inserts n rows into table within txn, row returning the values of the columns of each
+// the transaction is left for the caller to commit or roll back
+func copyIn(txn *sql.Tx, op string, table string, columns []string, n int, row func(i int) []interface{}) error {
+	if n == 0 {
+		return nil
+	}
+	log.Infof("Saving %d rows to %s", n, table)
+	stmt, err := txn.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		return errors.Wrapf(err, "[%s] unable to prepare pq.CopyIn", op)
 	}
-	if e := txn.Commit(); e != nil {
-		log.Error(e)
+	defer func() {
+		if err := stmt.Close(); err != nil {
+			log.Error(errors.Wrapf(err, "[%s] unable to close statement", op))
+		}
+	}()
+	for i := 0; i < n; i++ {
+		values := row(i)
+		if _, err := stmt.Exec(values...); err != nil {
+			return errors.Wrapf(err, "[%s] unable to save number %v", op, values)
+		}
 	}
+	if _, err := stmt.Exec(); err != nil {
+		return errors.Wrapf(err, "[%s] unable to execute bulk insert to %s", op, table)
+	}
+	return nil
 }
@@ -1,10 +1,17 @@
 package store
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/DATA-DOG/go-sqlmock.v2"
 )
@@ -27,9 +34,12 @@ func TestGetFileResults(t *testing.T) {
 	require.NoError(t, err)
 	db, DBStore, mock := PrepareMockStore(t)
 	defer db.Close()
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM files WHERE ref=\$1\)`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
 	mock.ExpectQuery(`SELECT number FROM numbers WHERE file_ref=\$1`).
 		WithArgs(testUUID).
-		WillReturnRows(sqlmock.NewRows([]string{"number", "file_ref", "country_ioc_code"}).AddRow("1234", testUUID, "rsa"))
+		WillReturnRows(sqlmock.NewRows([]string{"number"}).AddRow("1234"))
 
 	mock.ExpectQuery(`SELECT number FROM rejected_numbers WHERE file_ref=\$1`).
 		WithArgs(testUUID).
@@ -37,12 +47,234 @@ func TestGetFileResults(t *testing.T) {
 
 	mock.ExpectQuery(`SELECT original_number, changes, fixed_number FROM fixed_numbers WHERE file_ref=\$1`).
 		WithArgs(testUUID).
-		WillReturnRows(sqlmock.NewRows([]string{"original_number", "changes", "fixed_number", "file_ref"}).AddRow("1234", "change1,chang2", "1234", testUUID))
+		WillReturnRows(sqlmock.NewRows([]string{"original_number", "changes", "fixed_number"}).AddRow("1234", "change1,chang2", "1234"))
 
-	DBStore.GetFileResults(testUUID)
+	mock.ExpectQuery(`SELECT number, normalized_number, row_number, first_row_number, part, passthrough FROM duplicate_numbers\s+WHERE file_ref=\$1 ORDER BY row_number, part`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows([]string{"number", "normalized_number", "row_number", "first_row_number", "part", "passthrough"}).
+			AddRow("0717278645", "27717278645", 3, 1, 0, []byte(`{"name":"Ann"}`)))
+
+	results, err := DBStore.GetFileResults(testUUID)
+	require.NoError(t, err)
+	require.Equal(t, &FileResults{
+		ValidNumbers:    []string{"1234"},
+		RejectedNumbers: []string{"1234"},
+		FixedNumbers:    []FixedNumber{{OriginalNumber: "1234", Changes: "change1,chang2", FixedNumber: "1234"}},
+		DuplicateNumbers: []DuplicateNumber{{Number: "0717278645", NormalizedNumber: "27717278645", RowNumber: 3, FirstRowNumber: 1,
+			Passthrough: Passthrough{"name": "Ann"}}},
+	}, results)
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
+
+	// an unknown file has no results
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM files WHERE ref=\$1\)`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	_, err = DBStore.GetFileResults(testUUID)
+	require.Equal(t, sql.ErrNoRows, err)
+
+	// errors reading any category are returned
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM files WHERE ref=\$1\)`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT number FROM numbers WHERE file_ref=\$1`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows([]string{"number"}).AddRow("1234"))
+	mock.ExpectQuery(`SELECT number FROM rejected_numbers WHERE file_ref=\$1`).
+		WithArgs(testUUID).
+		WillReturnError(errors.New("connection reset"))
+	_, err = DBStore.GetFileResults(testUUID)
+	require.EqualError(t, err, "connection reset")
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetFileRows(t *testing.T) {
+	testUUID, err := uuid.NewV4()
+	require.NoError(t, err)
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+	columns := []string{"row_number", "part", "passthrough", "category", "number", "fixed_number", "changes", "reason",
+		"first_row_number"}
+	mock.ExpectQuery(`FROM duplicate_numbers WHERE file_ref=\$1 .* UNION ALL .* FROM numbers WHERE file_ref=\$1 .*` +
+		`ORDER BY row_number, part, category, number$`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 0, []byte(`{"name":"Ann"}`), ValidCategory, "27831234567", "27831234567", "", "", 0).
+			AddRow(2, 1, nil, RejectedCategory, "2.78212E+10", "", "", "precision_lost", 0).
+			AddRow(3, 0, nil, DuplicateCategory, "831234567", "27831234567", "", "", 1))
+
+	rows, err := DBStore.GetFileRows(testUUID)
+	require.NoError(t, err)
+	require.Equal(t, []ResultRow{
+		{
+			SourceRow:   SourceRow{RowNumber: 1, Passthrough: Passthrough{"name": "Ann"}},
+			Category:    ValidCategory,
+			Number:      "27831234567",
+			FixedNumber: "27831234567",
+		},
+		{
+			SourceRow: SourceRow{RowNumber: 2, Part: 1},
+			Category:  RejectedCategory,
+			Number:    "2.78212E+10",
+			Reason:    "precision_lost",
+		},
+		{
+			SourceRow:      SourceRow{RowNumber: 3},
+			Category:       DuplicateCategory,
+			Number:         "831234567",
+			FixedNumber:    "27831234567",
+			FirstRowNumber: 1,
+		},
+	}, rows)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetFileRowsPage(t *testing.T) {
+	testUUID, err := uuid.NewV4()
+	require.NoError(t, err)
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+	columns := []string{"row_number", "part", "passthrough", "category", "number", "fixed_number", "changes", "reason"}
+
+	// a category is read from its own table only
+	mock.ExpectQuery(`^SELECT \* FROM \(\(SELECT .* FROM fixed_numbers WHERE file_ref=\$1 `+
+		`ORDER BY row_number, part, original_number LIMIT \$2\)\) AS page ORDER BY row_number, part, category, number LIMIT \$2$`).
+		WithArgs(testUUID, 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(2, 0, nil, FixedCategory, "831234568", "27831234568", "prepended number with 27", ""))
+	rows, err := DBStore.GetFileRowsPage(testUUID, RowPage{Category: FixedCategory, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []ResultRow{{SourceRow: SourceRow{RowNumber: 2}, Category: FixedCategory, Number: "831234568",
+		FixedNumber: "27831234568", Changes: "prepended number with 27"}}, rows)
+
+	// numbers at the cursor's row and part are compared by category, then number
+	mock.ExpectQuery(`FROM duplicate_numbers WHERE file_ref=\$1 AND \(row_number, part\) > \(\$3, \$4\) .*`+
+		`FROM fixed_numbers WHERE file_ref=\$1 AND \(row_number, part, original_number\) > \(\$5, \$6, \$7\) .*`+
+		`FROM rejected_numbers WHERE file_ref=\$1 AND \(row_number, part\) >= \(\$8, \$9\) .*`+
+		`FROM numbers WHERE file_ref=\$1 AND \(row_number, part\) >= \(\$10, \$11\) `).
+		WithArgs(testUUID, 100, 2, 0, 2, 0, "831234568", 2, 0, 2, 0).
+		WillReturnRows(sqlmock.NewRows(columns))
+	rows, err = DBStore.GetFileRowsPage(testUUID, RowPage{
+		After: &RowCursor{RowNumber: 2, Category: FixedCategory, Number: "831234568"},
+		Limit: 100,
+	})
+	require.NoError(t, err)
+	require.Empty(t, rows)
+
+	mock.ExpectQuery(`FROM numbers`).WillReturnError(errors.New("connection reset"))
+	_, err = DBStore.GetFileRowsPage(testUUID, RowPage{Category: ValidCategory, Limit: 1})
+	require.EqualError(t, err, fmt.Sprintf("[GetFileRowsPage] unable to query numbers of file %s: connection reset", testUUID))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEachFileRow(t *testing.T) {
+	testUUID, err := uuid.NewV4()
+	require.NoError(t, err)
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+	columns := []string{"row_number", "part", "passthrough", "category", "number", "fixed_number", "changes", "reason",
+		"first_row_number"}
+	mock.ExpectQuery(`^SELECT \* FROM \(\(SELECT .* FROM rejected_numbers WHERE file_ref=\$1 ORDER BY row_number, part, number\)\) ` +
+		`AS page ORDER BY row_number, part, category, number$`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(3, 0, nil, RejectedCategory, "123", "", "", "invalid_length", 0).
+			AddRow(5, 0, nil, RejectedCategory, "456", "", "", "invalid_length", 0))
+	var rows []ResultRow
+	err = DBStore.EachFileRow(context.Background(), testUUID, RejectedCategory, func(row ResultRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []ResultRow{
+		{SourceRow: SourceRow{RowNumber: 3}, Category: RejectedCategory, Number: "123", Reason: "invalid_length"},
+		{SourceRow: SourceRow{RowNumber: 5}, Category: RejectedCategory, Number: "456", Reason: "invalid_length"},
+	}, rows)
+
+	// rows are not read past an error returned by fn
+	mock.ExpectQuery(`FROM numbers`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 0, nil, ValidCategory, "27831234567", "27831234567", "", "", 0).
+			AddRow(2, 0, nil, ValidCategory, "27831234568", "27831234568", "", "", 0))
+	calls := 0
+	err = DBStore.EachFileRow(context.Background(), testUUID, ValidCategory, func(row ResultRow) error {
+		calls++
+		return errors.New("client went away")
+	})
+	require.EqualError(t, err, "client went away")
+	require.Equal(t, 1, calls)
+
+	mock.ExpectQuery(`FROM numbers`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 0, nil, ValidCategory, "27831234567", "27831234567", "", "", 0).
+			RowError(0, errors.New("connection reset")))
+	err = DBStore.EachFileRow(context.Background(), testUUID, ValidCategory, func(row ResultRow) error { return nil })
+	require.EqualError(t, err, fmt.Sprintf("[EachFileRow] unable to read numbers of file %s: connection reset", testUUID))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEachInputRow(t *testing.T) {
+	testUUID, err := uuid.NewV4()
+	require.NoError(t, err)
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+	columns := []string{"cells", "row_number", "part", "passthrough", "category", "number", "fixed_number", "changes",
+		"reason", "first_row_number"}
+	mock.ExpectQuery(`^SELECT input.cells, numbers.\* FROM input_rows AS input JOIN \(SELECT \* FROM .* AS page ` +
+		`ORDER BY row_number, part, category, number\) AS numbers\s+ON numbers.row_number=input.row_number ` +
+		`WHERE input.file_ref=\$1\s+ORDER BY numbers.row_number, numbers.part, numbers.category, numbers.number$`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(`{1,27831234567}`, 1, 0, nil, ValidCategory, "27831234567", "27831234567", "", "", 0).
+			AddRow(`{2,"123 / 27831234568"}`, 2, 1, nil, RejectedCategory, "123", "", "", "invalid_length", 0).
+			AddRow(`{2,"123 / 27831234568"}`, 2, 2, nil, ValidCategory, "27831234568", "27831234568", "", "", 0))
+	var rows []InputRow
+	var numbers [][]ResultRow
+	err = DBStore.EachInputRow(context.Background(), testUUID, func(row InputRow, rowNumbers []ResultRow) error {
+		rows = append(rows, row)
+		numbers = append(numbers, rowNumbers)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []InputRow{
+		{FileRef: testUUID, RowNumber: 1, Cells: pq.StringArray{"1", "27831234567"}},
+		{FileRef: testUUID, RowNumber: 2, Cells: pq.StringArray{"2", "123 / 27831234568"}},
+	}, rows)
+	require.Equal(t, [][]ResultRow{
+		{{SourceRow: SourceRow{RowNumber: 1}, Category: ValidCategory, Number: "27831234567", FixedNumber: "27831234567"}},
+		{
+			{SourceRow: SourceRow{RowNumber: 2, Part: 1}, Category: RejectedCategory, Number: "123", Reason: "invalid_length"},
+			{SourceRow: SourceRow{RowNumber: 2, Part: 2}, Category: ValidCategory, Number: "27831234568", FixedNumber: "27831234568"},
+		},
+	}, numbers)
+
+	mock.ExpectQuery(`FROM input_rows`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(`{1,27831234567}`, 1, 0, nil, ValidCategory, "27831234567", "27831234567", "", "", 0).
+			RowError(0, errors.New("connection reset")))
+	err = DBStore.EachInputRow(context.Background(), testUUID, func(row InputRow, numbers []ResultRow) error { return nil })
+	require.EqualError(t, err, fmt.Sprintf("[EachInputRow] unable to read rows of file %s: connection reset", testUUID))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPassthroughValue(t *testing.T) {
+	value, err := Passthrough{"name": "Ann", "opt_in": "true"}.Value()
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"Ann","opt_in":"true"}`, value)
+	value, err = Passthrough{}.Value()
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	var p Passthrough
+	require.NoError(t, p.Scan([]byte(`{"name":"Ann"}`)))
+	require.Equal(t, Passthrough{"name": "Ann"}, p)
+	require.NoError(t, p.Scan(nil))
+	require.Nil(t, p)
+	require.Error(t, p.Scan(1))
 }
 
 func TestGetFileStats(t *testing.T) {
@@ -51,25 +283,351 @@ func TestGetFileStats(t *testing.T) {
 	db, DBStore, mock := PrepareMockStore(t)
 	defer db.Close()
 
+	// stats saved with the numbers of the file are returned as they are
+	saved := Stats{
+		ValidNumbersCount:     1,
+		FixedNumbersCount:     1,
+		TotalNumbersProcessed: 2,
+		Countries:             map[string]Stats{"rsa": {ValidNumbersCount: 1, FixedNumbersCount: 1, TotalNumbersProcessed: 2}},
+		Changes:               map[string]int{"dialing_code_prepended": 1},
+	}
+	mock.ExpectQuery(`SELECT stats FROM files WHERE ref=\$1`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows([]string{"stats"}).AddRow([]byte(`{"valid_numbers_count":1,"fixed_numbers_count":1,` +
+			`"invalid_numbers_count":0,"duplicate_numbers_count":0,"total_numbers_processed":2,` +
+			`"countries":{"rsa":{"valid_numbers_count":1,"fixed_numbers_count":1,"invalid_numbers_count":0,` +
+			`"duplicate_numbers_count":0,"total_numbers_processed":2}},"changes":{"dialing_code_prepended":1}}`)))
+	actualResult, err := DBStore.GetFileStats(testUUID)
+	require.NoError(t, err)
+	require.Equal(t, &saved, actualResult)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// files without saved stats are counted in a single query
 	expectedResult := &Stats{
 		ValidNumbersCount:     1,
 		FixedNumbersCount:     3,
 		InvalidNumbersCount:   2,
-		TotalNumbersProcessed: 6,
+		DuplicateNumbersCount: 1,
+		TotalNumbersProcessed: 7,
+		Countries: map[string]Stats{
+			"rsa": {ValidNumbersCount: 1, FixedNumbersCount: 2, DuplicateNumbersCount: 1, TotalNumbersProcessed: 4},
+			"aus": {FixedNumbersCount: 1, InvalidNumbersCount: 2, TotalNumbersProcessed: 3},
+		},
+		Reasons: map[string]int{"invalid_length": 1, "unknown_country": 1},
 	}
-	mock.ExpectExec(`SELECT FROM numbers WHERE file_ref=\$1`).
-		WithArgs(testUUID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT stats FROM files WHERE ref=\$1`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows([]string{"stats"}).AddRow(nil))
+	mock.ExpectQuery(`SELECT country_ioc_code, category, reason, COUNT\(\*\) AS count FROM`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows([]string{"country_ioc_code", "category", "reason", "count"}).
+			AddRow("rsa", ValidCategory, "", 1).
+			AddRow("rsa", FixedCategory, "", 2).
+			AddRow("aus", FixedCategory, "", 1).
+			AddRow("aus", RejectedCategory, "invalid_length", 1).
+			AddRow("aus", RejectedCategory, "unknown_country", 1).
+			AddRow("rsa", DuplicateCategory, "", 1))
+	actualResult, err = DBStore.GetFileStats(testUUID)
+	require.NoError(t, err)
+	require.Equal(t, expectedResult, actualResult)
+	require.NoError(t, mock.ExpectationsWereMet())
 
-	mock.ExpectExec(`SELECT FROM fixed_numbers WHERE file_ref=\$1`).
-		WithArgs(testUUID).WillReturnResult(sqlmock.NewResult(0, 3))
+	// unknown files have no stats
+	mock.ExpectQuery(`SELECT stats FROM files WHERE ref=\$1`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows([]string{"stats"}))
+	_, err = DBStore.GetFileStats(testUUID)
+	require.Equal(t, sql.ErrNoRows, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
 
-	mock.ExpectExec(`SELECT FROM rejected_numbers WHERE file_ref=\$1`).
-		WithArgs(testUUID).WillReturnResult(sqlmock.NewResult(0, 2))
+func TestStatsBreakdowns(t *testing.T) {
+	var stats Stats
+	stats.Add("rsa", FixedCategory, 1)
+	stats.AddChanges([]string{"dialing_code_prepended", "shortened"})
+	stats.Add("rsa", FixedCategory, 1)
+	stats.AddChanges([]string{"dialing_code_prepended"})
+	stats.Add("rsa", RejectedCategory, 1)
+	stats.AddReason("invalid_length", 1)
+	stats.AddReason("", 1)
+	require.Equal(t, map[string]int{"dialing_code_prepended": 2, "shortened": 1}, stats.Changes)
+	require.Equal(t, map[string]int{"invalid_length": 1}, stats.Reasons)
 
-	actualResult, err := DBStore.GetFileStats(testUUID)
+	value, err := stats.Value()
 	require.NoError(t, err)
+	var scanned Stats
+	require.NoError(t, scanned.Scan(value))
+	require.Equal(t, stats, scanned)
+	require.Error(t, scanned.Scan(nil))
+}
+
+func TestSaveAndGetFile(t *testing.T) {
+	testUUID, err := uuid.NewV4()
+	require.NoError(t, err)
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+
+	uploadedAt := time.Now()
+	file := File{Ref: testUUID, Filename: "numbers.csv", Label: "march", UploadedAt: uploadedAt, Fingerprint: "abc123", SplitCells: 2,
+		PassthroughColumns: pq.StringArray{"name", "opt_in"}, Country: "rsa", RowCount: 10, FixPolicy: "v2;rsa:27:11", RulesVersion: 2,
+		SourceColumns: pq.StringArray{"id", "sms_phone", "name", "opt_in"}}
+	mock.ExpectExec(`INSERT INTO files \(ref, filename, label, uploaded_at, fingerprint, split_cells, passthrough_columns, country,\s+row_count, fix_policy, rules_version, status, source_columns\)\s+VALUES \(\$1, \$2, \$3, \$4, \$5, \$6, \$7, \$8, \$9, \$10, \$11, \$12, \$13\)`).
+		WithArgs(testUUID, "numbers.csv", "march", uploadedAt, "abc123", 2, `{"name","opt_in"}`, "rsa", 10, "v2;rsa:27:11", 2, FileProcessing,
+			`{"id","sms_phone","name","opt_in"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE files SET status=\$2, completed_at=now\(\) WHERE ref=\$1 AND status=\$3`).
+		WithArgs(testUUID, FileCompleted, FileProcessing).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	completedAt := uploadedAt.Add(time.Second)
+	columns := []string{"ref", "filename", "label", "uploaded_at", "fingerprint", "split_cells", "passthrough_columns", "country", "row_count",
+		"fix_policy", "rules_version", "status", "error", "completed_at", "source_columns"}
+	row := []driver.Value{testUUID, "numbers.csv", "march", uploadedAt, "abc123", 2, `{name,opt_in}`, "rsa", 10, "v2;rsa:27:11", 2,
+		FileCompleted, "", completedAt, `{id,sms_phone,name,opt_in}`}
+	mock.ExpectQuery(`SELECT ref, filename, label, uploaded_at, fingerprint, split_cells, passthrough_columns, country, row_count,\s+fix_policy, rules_version, status, error, completed_at, source_columns FROM files WHERE ref=\$1`).
+		WithArgs(testUUID).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(row...))
+	mock.ExpectQuery(`SELECT .+ FROM files\s+WHERE fingerprint=\$1 AND status=\$2`).
+		WithArgs("abc123", FileCompleted).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(row...))
+	mock.ExpectQuery(`SELECT .+ FROM files\s+WHERE fingerprint=\$1 AND status=\$2`).
+		WithArgs("def456", FileCompleted).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	require.NoError(t, DBStore.CreateFile(file))
+	require.NoError(t, DBStore.SaveProcessedFile(testUUID, func(w FileWriter) error { return nil }))
+	expected := file
+	expected.Status = FileCompleted
+	expected.CompletedAt = &completedAt
+	got, err := DBStore.GetFile(testUUID)
+	require.NoError(t, err)
+	require.Equal(t, &expected, got)
+	got, err = DBStore.FindFileByFingerprint("abc123")
+	require.NoError(t, err)
+	require.Equal(t, &expected, got)
+	_, err = DBStore.FindFileByFingerprint("def456")
+	require.Equal(t, sql.ErrNoRows, err)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFailFile(t *testing.T) {
+	testUUID, err := uuid.NewV4()
+	require.NoError(t, err)
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+
+	mock.ExpectExec(`UPDATE files SET status=\$2, error=\$3, completed_at=now\(\) WHERE ref=\$1`).
+		WithArgs(testUUID, FileFailed, "connection reset").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, DBStore.FailFile(testUUID, "connection reset"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSaveAndGetIdempotencyKey(t *testing.T) {
+	testUUID, err := uuid.NewV4()
+	require.NoError(t, err)
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+
+	since := time.Now().Add(-time.Hour)
+	createdAt := time.Now()
+	response := []byte(`{"ref":"` + testUUID.String() + `"}`)
+	mock.ExpectExec(`INSERT INTO idempotency_keys \(key, fingerprint, file_ref, status_code, response\) VALUES \(\$1, \$2, \$3, \$4, \$5\)\s+ON CONFLICT \(key\) DO UPDATE`).
+		WithArgs("retry-1", "abc123", testUUID, 200, response).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT key, fingerprint, file_ref, status_code, response, created_at FROM idempotency_keys\s+WHERE key=\$1 AND created_at>\$2`).
+		WithArgs("retry-1", since).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "fingerprint", "file_ref", "status_code", "response", "created_at"}).
+			AddRow("retry-1", "abc123", testUUID, 200, response, createdAt))
+
+	err = DBStore.SaveIdempotencyKey(IdempotencyKey{
+		Key:         "retry-1",
+		Fingerprint: "abc123",
+		FileRef:     testUUID,
+		StatusCode:  200,
+		Response:    response,
+	})
+	require.NoError(t, err)
+	key, err := DBStore.GetIdempotencyKey("retry-1", since)
+	require.NoError(t, err)
+	require.Equal(t, &IdempotencyKey{
+		Key:         "retry-1",
+		Fingerprint: "abc123",
+		FileRef:     testUUID,
+		StatusCode:  200,
+		Response:    response,
+		CreatedAt:   createdAt,
+	}, key)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+	since := time.Now().Add(-time.Hour)
+	pendingSince := time.Now().Add(-time.Minute)
+	createdAt := time.Now()
+	reserve := `INSERT INTO idempotency_keys \(key, fingerprint, file_ref, status_code, response\) VALUES \(\$1, \$2, \$3, 0, ''\)\s+` +
+		`ON CONFLICT \(key\) DO UPDATE .*\s+WHERE idempotency_keys.created_at<=\$4 OR \(idempotency_keys.status_code=0 AND idempotency_keys.created_at<=\$5\)\s+RETURNING key`
+	mock.ExpectQuery(reserve).
+		WithArgs("retry-1", "abc123", uuid.Nil, since, pendingSince).
+		WillReturnRows(sqlmock.NewRows([]string{"key"}).AddRow("retry-1"))
+	prior, err := DBStore.ReserveIdempotencyKey(IdempotencyKey{Key: "retry-1", Fingerprint: "abc123"}, since, pendingSince)
+	require.NoError(t, err)
+	require.Nil(t, prior)
+
+	// a key used after since is not reserved again, and its record is returned
+	mock.ExpectQuery(reserve).
+		WithArgs("retry-1", "abc123", uuid.Nil, since, pendingSince).
+		WillReturnRows(sqlmock.NewRows([]string{"key"}))
+	mock.ExpectQuery(`SELECT key, fingerprint, file_ref, status_code, response, created_at FROM idempotency_keys`).
+		WithArgs("retry-1", since).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "fingerprint", "file_ref", "status_code", "response", "created_at"}).
+			AddRow("retry-1", "abc123", uuid.Nil, 0, []byte{}, createdAt))
+	prior, err = DBStore.ReserveIdempotencyKey(IdempotencyKey{Key: "retry-1", Fingerprint: "abc123"}, since, pendingSince)
+	require.NoError(t, err)
+	require.Equal(t, &IdempotencyKey{Key: "retry-1", Fingerprint: "abc123", Response: []byte{}, CreatedAt: createdAt}, prior)
+
+	mock.ExpectExec(`DELETE FROM idempotency_keys WHERE key=\$1 AND status_code=0`).
+		WithArgs("retry-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, DBStore.ReleaseIdempotencyKey("retry-1"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReserveRowQuota(t *testing.T) {
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+	day := time.Date(2019, 3, 1, 15, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`INSERT INTO client_quotas \(client_id, day, rows_used\) VALUES \(\$1, \$2, \$3\)\s+ON CONFLICT`).
+		WithArgs("billing", "2019-03-01", 40, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"rows_used"}).AddRow(90))
+	mock.ExpectQuery(`INSERT INTO client_quotas \(client_id, day, rows_used\) VALUES \(\$1, \$2, \$3\)\s+ON CONFLICT`).
+		WithArgs("billing", "2019-03-01", 20, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"rows_used"}))
+	mock.ExpectQuery(`SELECT rows_used FROM client_quotas WHERE client_id=\$1 AND day=\$2`).
+		WithArgs("billing", "2019-03-01").
+		WillReturnRows(sqlmock.NewRows([]string{"rows_used"}).AddRow(90))
+
+	reserved, err := DBStore.ReserveRowQuota("billing", day, 40, 100)
+	require.NoError(t, err)
+	require.True(t, reserved)
+	reserved, err = DBStore.ReserveRowQuota("billing", day, 20, 100)
+	require.NoError(t, err)
+	require.False(t, reserved)
+	// more rows than the whole quota are refused without querying
+	reserved, err = DBStore.ReserveRowQuota("billing", day, 101, 100)
+	require.NoError(t, err)
+	require.False(t, reserved)
+	used, err := DBStore.GetRowQuotaUsage("billing", day)
+	require.NoError(t, err)
+	require.Equal(t, 90, used)
+
+	mock.ExpectExec(`UPDATE client_quotas SET rows_used=GREATEST\(rows_used-\$3, 0\) WHERE client_id=\$1 AND day=\$2`).
+		WithArgs("billing", "2019-03-01", 40).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, DBStore.ReleaseRowQuota("billing", day, 40))
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
-	require.Equal(t, actualResult, expectedResult)
+}
+
+func TestSaveProcessedFile(t *testing.T) {
+	testUUID, err := uuid.NewV4()
+	require.NoError(t, err)
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	copyNumbers := mock.ExpectPrepare(`COPY "numbers" \("number", "country_ioc_code", "file_ref", "row_number", "part", "passthrough"\) FROM STDIN`)
+	copyNumbers.ExpectExec().WithArgs("27831234567", "rsa", testUUID, 1, 0, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	copyNumbers.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	copyRejected := mock.ExpectPrepare(`COPY "rejected_numbers" \("number", "country_ioc_code", "file_ref", "reason", "row_number", "part", "passthrough"\) FROM STDIN`)
+	copyRejected.ExpectExec().WithArgs("123", "rsa", testUUID, "invalid_length", 2, 0, `{"name":"Ann"}`).WillReturnResult(sqlmock.NewResult(0, 1))
+	copyRejected.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE files SET stats=\$2 WHERE ref=\$1`).
+		WithArgs(testUUID, `{"valid_numbers_count":1,"fixed_numbers_count":0,"invalid_numbers_count":1,"duplicate_numbers_count":0,`+
+			`"total_numbers_processed":2,"reasons":{"invalid_length":1}}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE files SET status`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = DBStore.SaveProcessedFile(testUUID, func(w FileWriter) error {
+		err := w.SaveNumbers([]Number{{Number: "27831234567", CountryIOCCode: "rsa", FileRef: testUUID, SourceRow: SourceRow{RowNumber: 1}}})
+		if err != nil {
+			return err
+		}
+		// empty batches are not written
+		if err := w.SaveFixedNumbers(nil); err != nil {
+			return err
+		}
+		err = w.SaveRejectedNumbers([]RejectedNumber{{
+			Number:         "123",
+			CountryIOCCode: "rsa",
+			FileRef:        testUUID,
+			Reason:         "invalid_length",
+			SourceRow:      SourceRow{RowNumber: 2, Passthrough: Passthrough{"name": "Ann"}},
+		}})
+		if err != nil {
+			return err
+		}
+		return w.SaveStats(Stats{ValidNumbersCount: 1, InvalidNumbersCount: 1, TotalNumbersProcessed: 2,
+			Reasons: map[string]int{"invalid_length": 1}})
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSaveProcessedFileRollsBack(t *testing.T) {
+	testUUID, err := uuid.NewV4()
+	require.NoError(t, err)
+	db, DBStore, mock := PrepareMockStore(t)
+	defer db.Close()
+	numbers := []Number{{Number: "27831234567", CountryIOCCode: "rsa", FileRef: testUUID}}
+
+	// a failed batch rolls back the batches saved before it
+	mock.ExpectBegin()
+	copyNumbers := mock.ExpectPrepare(`COPY "numbers"`)
+	copyNumbers.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	copyNumbers.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	copyFixed := mock.ExpectPrepare(`COPY "fixed_numbers"`)
+	copyFixed.ExpectExec().WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	err = DBStore.SaveProcessedFile(testUUID, func(w FileWriter) error {
+		if err := w.SaveNumbers(numbers); err != nil {
+			return err
+		}
+		return w.SaveFixedNumbers([]FixedNumber{{OriginalNumber: "831234567", FixedNumber: "27831234567", FileRef: testUUID}})
+	})
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// as does a failure to complete the file record
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE files`).WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	err = DBStore.SaveProcessedFile(testUUID, func(w FileWriter) error { return nil })
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// or a file that is no longer being processed
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE files`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	err = DBStore.SaveProcessedFile(testUUID, func(w FileWriter) error { return nil })
+	require.EqualError(t, err, "[SaveProcessedFile] file "+testUUID.String()+" is not being processed")
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// and an error of the caller
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	err = DBStore.SaveProcessedFile(testUUID, func(w FileWriter) error { return errors.New("validation failed") })
+	require.EqualError(t, err, "validation failed")
+	require.NoError(t, mock.ExpectationsWereMet())
 }
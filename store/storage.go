@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Storage defines the operations of a data store of processed files
+// lookups of a file, idempotency key or anything else that was not stored return sql.ErrNoRows
+type Storage interface {
+	// CreateFile saves the record of a file about to be processed
+	CreateFile(file File) error
+	// SaveProcessedFile saves the numbers of a file created with CreateFile, all or nothing
+	// write is called to save the numbers through the FileWriter, after which the file is marked as completed
+	SaveProcessedFile(ref uuid.UUID, write func(w FileWriter) error) error
+	// FailFile marks a file as failed, recording why
+	FailFile(ref uuid.UUID, reason string) error
+	GetFile(ref uuid.UUID) (*File, error)
+	// FindFileByFingerprint returns the most recently completed file with the given content fingerprint
+	FindFileByFingerprint(fingerprint string) (*File, error)
+	GetFileStats(ref uuid.UUID) (*Stats, error)
+	// GetFileResults returns the numbers of a file by category, sql.ErrNoRows for an unknown ref
+	GetFileResults(ref uuid.UUID) (*FileResults, error)
+	// GetFileRows returns every number of a file, in the order of the file
+	GetFileRows(ref uuid.UUID) ([]ResultRow, error)
+	// GetFileRowsPage returns a page of the numbers of a file, ordered by their RowCursor
+	GetFileRowsPage(ref uuid.UUID, page RowPage) ([]ResultRow, error)
+	// EachFileRow calls fn with each number of a file in the order of GetFileRowsPage, only numbers of category are read
+	// unless it is empty
+	// the Postgres store streams the numbers, but the memory and file stores hold every number of the file in memory
+	// while it is read, as the numbers are ordered across batches saved in any order
+	// reading stops at the first error returned by fn, or once ctx is done, returning the error
+	EachFileRow(ctx context.Context, ref uuid.UUID, category string, fn func(row ResultRow) error) error
+	// EachInputRow calls fn with each row of a file saved with SaveInputRows, in the order of the file, along with the
+	// numbers read from it in the order of GetFileRowsPage
+	// like EachFileRow, only the Postgres store reads the rows without holding all of them in memory
+	// reading stops at the first error returned by fn, or once ctx is done, returning the error
+	EachInputRow(ctx context.Context, ref uuid.UUID, fn func(row InputRow, numbers []ResultRow) error) error
+
+	// GetIdempotencyKey returns an idempotency key saved after since
+	GetIdempotencyKey(key string, since time.Time) (*IdempotencyKey, error)
+	// SaveIdempotencyKey saves the response to an upload, replacing an earlier record of the same key
+	SaveIdempotencyKey(key IdempotencyKey) error
+	// ReserveIdempotencyKey records key as pending, unless the key was saved after since, or reserved after both since
+	// and pendingSince, a reservation older than pendingSince being abandoned by an upload that never finished
+	// the earlier record of the key is returned in that case, and nil once the key is reserved
+	// a pending record has no StatusCode, and is replaced by SaveIdempotencyKey once the upload is answered
+	ReserveIdempotencyKey(key IdempotencyKey, since time.Time, pendingSince time.Time) (*IdempotencyKey, error)
+	// ReleaseIdempotencyKey removes the pending record of a key, so that a failed upload can be retried
+	ReleaseIdempotencyKey(key string) error
+
+	// ReserveRowQuota counts rows against a client's quota for the given day
+	// reports false, and counts nothing, if the rows would take the client's usage for the day over limit
+	ReserveRowQuota(clientID string, day time.Time, rows int, limit int) (bool, error)
+	// ReleaseRowQuota gives back rows reserved for an upload that was not processed
+	ReleaseRowQuota(clientID string, day time.Time, rows int) error
+	GetRowQuotaUsage(clientID string, day time.Time) (int, error)
+
+	Close()
+}
+
+// FileWriter saves the numbers of a file being processed, within SaveProcessedFile
+type FileWriter interface {
+	SaveNumbers(numbers []Number) error
+	SaveFixedNumbers(fixedNums []FixedNumber) error
+	SaveRejectedNumbers(rejectedNums []RejectedNumber) error
+	SaveDuplicateNumbers(duplicateNums []DuplicateNumber) error
+	// SaveInputRows saves the cells of rows of the uploaded file
+	SaveInputRows(rows []InputRow) error
+	// SaveStats saves the stats of the file, so they need not be counted from its numbers
+	SaveStats(stats Stats) error
+}
+
+var (
+	_ Storage = (*Store)(nil)
+	_ Storage = (*MemoryStore)(nil)
+	_ Storage = (*FileStore)(nil)
+)
@@ -22,9 +22,12 @@ func (s *Store) Close() {
 }
 
 // New returns the postgres implementation of a data store
-func New(connString string, maxDBConns int) *Store {
-	store := &Store{}
-	store.DB = sqlx.MustConnect("postgres", connString)
-	store.DB.SetMaxOpenConns(maxDBConns)
-	return store
+// an error is returned if the database cannot be reached
+func New(connString string, maxDBConns int) (*Store, error) {
+	db, err := sqlx.Connect("postgres", connString)
+	if err != nil {
+		return nil, errors.Wrap(err, "[New] unable to connect to postgres")
+	}
+	db.SetMaxOpenConns(maxDBConns)
+	return &Store{DB: db}, nil
 }
@@ -0,0 +1,685 @@
+// Package storetest holds the contract every implementation of store.Storage must keep
+package storetest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"github.com/tonyOreglia/api-mobile-numbers/store"
+)
+
+// Run runs the contract against the stores returned by newStorage, which is called once for each test
+// with an empty store
+func Run(t *testing.T, newStorage func(t *testing.T) store.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s store.Storage)
+	}{
+		{"SaveAndGetFile", testSaveAndGetFile},
+		{"GetResults", testGetResults},
+		{"Stats", testStats},
+		{"Duplicates", testDuplicates},
+		{"RowPages", testRowPages},
+		{"EachRow", testEachRow},
+		{"InputRows", testInputRows},
+		{"EmptyFile", testEmptyFile},
+		{"UnknownRef", testUnknownRef},
+		{"FailedWrite", testFailedWrite},
+		{"ConcurrentWrites", testConcurrentWrites},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"RowQuota", testRowQuota},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newStorage(t))
+		})
+	}
+}
+
+// a time every store keeps exactly, Postgres only keeps microseconds
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// creates a file and saves its numbers, returning its ref
+func saveFile(t *testing.T, s store.Storage, file store.File, write func(w store.FileWriter) error) uuid.UUID {
+	if file.Ref == uuid.Nil {
+		file.Ref = uuid.Must(uuid.NewV4())
+	}
+	if file.UploadedAt.IsZero() {
+		file.UploadedAt = now()
+	}
+	require.NoError(t, s.CreateFile(file))
+	require.NoError(t, s.SaveProcessedFile(file.Ref, write))
+	return file.Ref
+}
+
+// saves a number of each category to w
+func writeNumbers(ref uuid.UUID) func(w store.FileWriter) error {
+	return func(w store.FileWriter) error {
+		err := w.SaveNumbers([]store.Number{
+			{Number: "27831234567", CountryIOCCode: "rsa", FileRef: ref,
+				SourceRow: store.SourceRow{RowNumber: 1, Passthrough: store.Passthrough{"name": "Ann"}}},
+			{Number: "61412345678", CountryIOCCode: "aus", FileRef: ref, SourceRow: store.SourceRow{RowNumber: 4, Part: 2}},
+		})
+		if err != nil {
+			return err
+		}
+		err = w.SaveFixedNumbers([]store.FixedNumber{{OriginalNumber: "831234568", FixedNumber: "27831234568",
+			Changes: "prepended number with 27", CountryIOCCode: "rsa", FileRef: ref, SourceRow: store.SourceRow{RowNumber: 2}}})
+		if err != nil {
+			return err
+		}
+		err = w.SaveRejectedNumbers([]store.RejectedNumber{{Number: "123", CountryIOCCode: "rsa", FileRef: ref, Reason: "invalid_length",
+			SourceRow: store.SourceRow{RowNumber: 3}}})
+		if err != nil {
+			return err
+		}
+		// numbers of a category may be saved in several batches
+		return w.SaveNumbers([]store.Number{
+			{Number: "61412345679", CountryIOCCode: "aus", FileRef: ref, SourceRow: store.SourceRow{RowNumber: 4, Part: 1}},
+		})
+	}
+}
+
+func testSaveAndGetFile(t *testing.T, s store.Storage) {
+	ref := uuid.Must(uuid.NewV4())
+	file := store.File{
+		Ref:                ref,
+		Filename:           "numbers.csv",
+		Label:              "march",
+		UploadedAt:         now(),
+		Fingerprint:        "abc123",
+		SplitCells:         1,
+		PassthroughColumns: pq.StringArray{"name", "opt_in"},
+		Country:            "rsa",
+		RowCount:           4,
+		FixPolicy:          "v2;rsa:27:11",
+		RulesVersion:       2,
+	}
+	require.NoError(t, s.CreateFile(file))
+	require.Error(t, s.CreateFile(file), "a file is only created once")
+
+	got, err := s.GetFile(ref)
+	require.NoError(t, err)
+	require.Equal(t, store.FileProcessing, got.Status)
+	require.Nil(t, got.CompletedAt)
+	// files being processed are not matched by fingerprint
+	_, err = s.FindFileByFingerprint("abc123")
+	require.Equal(t, sql.ErrNoRows, err)
+
+	require.NoError(t, s.SaveProcessedFile(ref, writeNumbers(ref)))
+	require.Error(t, s.SaveProcessedFile(ref, func(w store.FileWriter) error { return nil }), "a file is only completed once")
+
+	got, err = s.GetFile(ref)
+	require.NoError(t, err)
+	require.Equal(t, store.FileCompleted, got.Status)
+	require.NotNil(t, got.CompletedAt)
+	require.True(t, file.UploadedAt.Equal(got.UploadedAt), "uploaded at %s, got %s", file.UploadedAt, got.UploadedAt)
+	expected := file
+	expected.Status = store.FileCompleted
+	expected.UploadedAt, expected.CompletedAt = got.UploadedAt, got.CompletedAt
+	require.Equal(t, &expected, got)
+
+	got, err = s.FindFileByFingerprint("abc123")
+	require.NoError(t, err)
+	require.Equal(t, ref, got.Ref)
+
+	// the most recently uploaded file with a fingerprint is found
+	later := saveFile(t, s, store.File{Fingerprint: "abc123", UploadedAt: file.UploadedAt.Add(time.Minute)},
+		func(w store.FileWriter) error { return nil })
+	saveFile(t, s, store.File{Fingerprint: "abc123", UploadedAt: file.UploadedAt.Add(-time.Minute)},
+		func(w store.FileWriter) error { return nil })
+	got, err = s.FindFileByFingerprint("abc123")
+	require.NoError(t, err)
+	require.Equal(t, later, got.Ref)
+	_, err = s.FindFileByFingerprint("def456")
+	require.Equal(t, sql.ErrNoRows, err)
+}
+
+func testGetResults(t *testing.T, s store.Storage) {
+	ref := uuid.Must(uuid.NewV4())
+	saveFile(t, s, store.File{Ref: ref}, writeNumbers(ref))
+	// numbers of other files are not returned
+	other := uuid.Must(uuid.NewV4())
+	saveFile(t, s, store.File{Ref: other}, writeNumbers(other))
+
+	results, err := s.GetFileResults(ref)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"27831234567", "61412345678", "61412345679"}, results.ValidNumbers)
+	require.Equal(t, []store.FixedNumber{{OriginalNumber: "831234568", FixedNumber: "27831234568", Changes: "prepended number with 27"}},
+		results.FixedNumbers)
+	require.Equal(t, []string{"123"}, results.RejectedNumbers)
+	require.Empty(t, results.DuplicateNumbers)
+
+	rows, err := s.GetFileRows(ref)
+	require.NoError(t, err)
+	require.Equal(t, []store.ResultRow{
+		{SourceRow: store.SourceRow{RowNumber: 1, Passthrough: store.Passthrough{"name": "Ann"}}, Category: store.ValidCategory,
+			Number: "27831234567", FixedNumber: "27831234567"},
+		{SourceRow: store.SourceRow{RowNumber: 2}, Category: store.FixedCategory, Number: "831234568", FixedNumber: "27831234568",
+			Changes: "prepended number with 27"},
+		{SourceRow: store.SourceRow{RowNumber: 3}, Category: store.RejectedCategory, Number: "123", Reason: "invalid_length"},
+		{SourceRow: store.SourceRow{RowNumber: 4, Part: 1}, Category: store.ValidCategory, Number: "61412345679", FixedNumber: "61412345679"},
+		{SourceRow: store.SourceRow{RowNumber: 4, Part: 2}, Category: store.ValidCategory, Number: "61412345678", FixedNumber: "61412345678"},
+	}, rows)
+}
+
+func testStats(t *testing.T, s store.Storage) {
+	counted := &store.Stats{
+		ValidNumbersCount:     3,
+		FixedNumbersCount:     1,
+		InvalidNumbersCount:   1,
+		TotalNumbersProcessed: 5,
+		Countries: map[string]store.Stats{
+			"rsa": {ValidNumbersCount: 1, FixedNumbersCount: 1, InvalidNumbersCount: 1, TotalNumbersProcessed: 3},
+			"aus": {ValidNumbersCount: 2, TotalNumbersProcessed: 2},
+		},
+		Reasons: map[string]int{"invalid_length": 1},
+	}
+	// stats of a file saved without stats are counted from its numbers
+	ref := uuid.Must(uuid.NewV4())
+	saveFile(t, s, store.File{Ref: ref}, writeNumbers(ref))
+	stats, err := s.GetFileStats(ref)
+	require.NoError(t, err)
+	require.Equal(t, counted, stats)
+
+	// saved stats are returned as they are, with the breakdowns only known when fixing
+	saved := *counted
+	saved.Changes = map[string]int{"dialing_code_prepended": 1}
+	saved.Members = []store.MemberStats{
+		{Name: "march/rsa.csv", Stats: store.Stats{ValidNumbersCount: 1, TotalNumbersProcessed: 1}},
+		{Name: "march/aus.csv", Stats: store.Stats{ValidNumbersCount: 2, TotalNumbersProcessed: 2}},
+	}
+	ref = uuid.Must(uuid.NewV4())
+	saveFile(t, s, store.File{Ref: ref}, func(w store.FileWriter) error {
+		if err := writeNumbers(ref)(w); err != nil {
+			return err
+		}
+		return w.SaveStats(saved)
+	})
+	stats, err = s.GetFileStats(ref)
+	require.NoError(t, err)
+	require.Equal(t, &saved, stats)
+}
+
+func testDuplicates(t *testing.T, s store.Storage) {
+	ref := uuid.Must(uuid.NewV4())
+	saveFile(t, s, store.File{Ref: ref}, func(w store.FileWriter) error {
+		err := w.SaveNumbers([]store.Number{{Number: "27831234567", CountryIOCCode: "rsa", FileRef: ref,
+			SourceRow: store.SourceRow{RowNumber: 1}}})
+		if err != nil {
+			return err
+		}
+		// saved out of order, and the same number more than once
+		return w.SaveDuplicateNumbers([]store.DuplicateNumber{
+			{Number: "831234567", NormalizedNumber: "27831234567", RowNumber: 5, FirstRowNumber: 1, CountryIOCCode: "rsa", FileRef: ref},
+			{Number: "27831234567", NormalizedNumber: "27831234567", RowNumber: 3, FirstRowNumber: 1, Part: 2, CountryIOCCode: "rsa",
+				FileRef: ref, Passthrough: store.Passthrough{"name": "Bob"}},
+			{Number: "27831234567", NormalizedNumber: "27831234567", RowNumber: 3, FirstRowNumber: 1, Part: 1, CountryIOCCode: "rsa",
+				FileRef: ref},
+			{Number: "12", RowNumber: 4, FirstRowNumber: 2, CountryIOCCode: "rsa", FileRef: ref},
+		})
+	})
+
+	results, err := s.GetFileResults(ref)
+	require.NoError(t, err)
+	require.Equal(t, []store.DuplicateNumber{
+		{Number: "27831234567", NormalizedNumber: "27831234567", RowNumber: 3, FirstRowNumber: 1, Part: 1},
+		{Number: "27831234567", NormalizedNumber: "27831234567", RowNumber: 3, FirstRowNumber: 1, Part: 2,
+			Passthrough: store.Passthrough{"name": "Bob"}},
+		{Number: "12", RowNumber: 4, FirstRowNumber: 2},
+		{Number: "831234567", NormalizedNumber: "27831234567", RowNumber: 5, FirstRowNumber: 1},
+	}, results.DuplicateNumbers)
+
+	stats, err := s.GetFileStats(ref)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.ValidNumbersCount)
+	require.Equal(t, 4, stats.DuplicateNumbersCount)
+	require.Equal(t, 5, stats.TotalNumbersProcessed)
+
+	rows, err := s.GetFileRows(ref)
+	require.NoError(t, err)
+	require.Len(t, rows, 5)
+	require.Equal(t, store.ResultRow{SourceRow: store.SourceRow{RowNumber: 3, Part: 2, Passthrough: store.Passthrough{"name": "Bob"}},
+		Category: store.DuplicateCategory, Number: "27831234567", FixedNumber: "27831234567", FirstRowNumber: 1}, rows[2])
+}
+
+func testRowPages(t *testing.T, s store.Storage) {
+	ref := uuid.Must(uuid.NewV4())
+	saveFile(t, s, store.File{Ref: ref}, func(w store.FileWriter) error {
+		if err := writeNumbers(ref)(w); err != nil {
+			return err
+		}
+		// numbers sharing a row and part are ordered by category, then number
+		err := w.SaveRejectedNumbers([]store.RejectedNumber{{Number: "5", CountryIOCCode: "rsa", FileRef: ref, Reason: "invalid_length",
+			SourceRow: store.SourceRow{RowNumber: 4, Part: 1}}})
+		if err != nil {
+			return err
+		}
+		return w.SaveDuplicateNumbers([]store.DuplicateNumber{
+			{Number: "61412345679", NormalizedNumber: "61412345679", RowNumber: 4, FirstRowNumber: 4, Part: 1, CountryIOCCode: "aus",
+				FileRef: ref},
+		})
+	})
+	all, err := s.GetFileRowsPage(ref, store.RowPage{Limit: 100})
+	require.NoError(t, err)
+	var order []store.RowCursor
+	for _, row := range all {
+		order = append(order, row.Cursor())
+	}
+	require.Equal(t, []store.RowCursor{
+		{RowNumber: 1, Category: store.ValidCategory, Number: "27831234567"},
+		{RowNumber: 2, Category: store.FixedCategory, Number: "831234568"},
+		{RowNumber: 3, Category: store.RejectedCategory, Number: "123"},
+		{RowNumber: 4, Part: 1, Category: store.DuplicateCategory, Number: "61412345679"},
+		{RowNumber: 4, Part: 1, Category: store.RejectedCategory, Number: "5"},
+		{RowNumber: 4, Part: 1, Category: store.ValidCategory, Number: "61412345679"},
+		{RowNumber: 4, Part: 2, Category: store.ValidCategory, Number: "61412345678"},
+	}, order)
+	require.Equal(t, store.Passthrough{"name": "Ann"}, all[0].Passthrough)
+	require.Equal(t, "27831234568", all[1].FixedNumber)
+	require.Equal(t, "invalid_length", all[2].Reason)
+
+	// paging from each cursor in turn returns every number once, whatever the page size
+	for _, limit := range []int{1, 2, 3, 7} {
+		var paged []store.ResultRow
+		page := store.RowPage{Limit: limit}
+		for {
+			rows, err := s.GetFileRowsPage(ref, page)
+			require.NoError(t, err)
+			require.True(t, len(rows) <= limit)
+			if len(rows) == 0 {
+				break
+			}
+			paged = append(paged, rows...)
+			cursor := rows[len(rows)-1].Cursor()
+			page.After = &cursor
+		}
+		require.Equal(t, all, paged, "limit %d", limit)
+	}
+
+	valid, err := s.GetFileRowsPage(ref, store.RowPage{Category: store.ValidCategory, After: &order[3], Limit: 100})
+	require.NoError(t, err)
+	require.Equal(t, all[5:], valid)
+	rejected, err := s.GetFileRowsPage(ref, store.RowPage{Category: store.RejectedCategory, Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, all[2:3], rejected)
+
+	rows, err := s.GetFileRowsPage(uuid.Must(uuid.NewV4()), store.RowPage{Limit: 100})
+	require.NoError(t, err)
+	require.Empty(t, rows)
+}
+
+func testEachRow(t *testing.T, s store.Storage) {
+	ref := uuid.Must(uuid.NewV4())
+	saveFile(t, s, store.File{Ref: ref}, writeNumbers(ref))
+	collect := func(category string) []store.ResultRow {
+		var rows []store.ResultRow
+		err := s.EachFileRow(context.Background(), ref, category, func(row store.ResultRow) error {
+			rows = append(rows, row)
+			return nil
+		})
+		require.NoError(t, err)
+		return rows
+	}
+	all, err := s.GetFileRowsPage(ref, store.RowPage{})
+	require.NoError(t, err)
+	require.Len(t, all, 5)
+	require.Equal(t, all, collect(""))
+	valid, err := s.GetFileRowsPage(ref, store.RowPage{Category: store.ValidCategory})
+	require.NoError(t, err)
+	require.Len(t, valid, 3)
+	require.Equal(t, valid, collect(store.ValidCategory))
+	require.Empty(t, collect(store.DuplicateCategory))
+
+	// the first error stops reading
+	calls := 0
+	stop := errors.New("stop")
+	err = s.EachFileRow(context.Background(), ref, "", func(row store.ResultRow) error {
+		calls++
+		return stop
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, 1, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.EachFileRow(ctx, ref, "", func(row store.ResultRow) error { return nil })
+	require.Error(t, err)
+
+	err = s.EachFileRow(context.Background(), uuid.Must(uuid.NewV4()), "", func(row store.ResultRow) error {
+		return errors.New("unknown files have no numbers")
+	})
+	require.NoError(t, err)
+}
+
+func testInputRows(t *testing.T, s store.Storage) {
+	ref := uuid.Must(uuid.NewV4())
+	inputs := []store.InputRow{
+		{FileRef: ref, RowNumber: 1, Cells: pq.StringArray{"1", "27831234567", "Ann"}},
+		{FileRef: ref, RowNumber: 2, Cells: pq.StringArray{"2", "831234568", ""}},
+		{FileRef: ref, RowNumber: 3, Cells: pq.StringArray{"3", "123", "Cy"}},
+		{FileRef: ref, RowNumber: 4, Cells: pq.StringArray{"4", "61412345679 / 61412345678", "Di"}},
+	}
+	saveFile(t, s, store.File{Ref: ref, SourceColumns: pq.StringArray{"id", "phone", "name"}}, func(w store.FileWriter) error {
+		if err := writeNumbers(ref)(w); err != nil {
+			return err
+		}
+		// rows may be saved in several batches, in any order
+		if err := w.SaveInputRows(inputs[2:]); err != nil {
+			return err
+		}
+		return w.SaveInputRows(inputs[:2])
+	})
+	file, err := s.GetFile(ref)
+	require.NoError(t, err)
+	require.Equal(t, pq.StringArray{"id", "phone", "name"}, file.SourceColumns)
+
+	all, err := s.GetFileRowsPage(ref, store.RowPage{})
+	require.NoError(t, err)
+	var rows []store.InputRow
+	var numbers [][]store.ResultRow
+	err = s.EachInputRow(context.Background(), ref, func(row store.InputRow, rowNumbers []store.ResultRow) error {
+		rows = append(rows, row)
+		numbers = append(numbers, rowNumbers)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, inputs, rows)
+	require.Equal(t, [][]store.ResultRow{all[:1], all[1:2], all[2:3], all[3:]}, numbers)
+
+	// the first error stops reading
+	calls := 0
+	stop := errors.New("stop")
+	err = s.EachInputRow(context.Background(), ref, func(row store.InputRow, numbers []store.ResultRow) error {
+		calls++
+		return stop
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, 1, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.EachInputRow(ctx, ref, func(row store.InputRow, numbers []store.ResultRow) error { return nil })
+	require.Error(t, err)
+
+	// files saved without their rows, and unknown files, have none
+	other := uuid.Must(uuid.NewV4())
+	saveFile(t, s, store.File{Ref: other}, writeNumbers(other))
+	for _, ref := range []uuid.UUID{other, uuid.Must(uuid.NewV4())} {
+		err = s.EachInputRow(context.Background(), ref, func(row store.InputRow, numbers []store.ResultRow) error {
+			return errors.New("no rows were saved")
+		})
+		require.NoError(t, err)
+	}
+}
+
+func testEmptyFile(t *testing.T, s store.Storage) {
+	ref := saveFile(t, s, store.File{}, func(w store.FileWriter) error {
+		if err := w.SaveNumbers(nil); err != nil {
+			return err
+		}
+		return w.SaveRejectedNumbers([]store.RejectedNumber{})
+	})
+	file, err := s.GetFile(ref)
+	require.NoError(t, err)
+	require.Equal(t, store.FileCompleted, file.Status)
+	require.Empty(t, file.PassthroughColumns)
+
+	results, err := s.GetFileResults(ref)
+	require.NoError(t, err)
+	requireNoResults(t, results)
+	rows, err := s.GetFileRows(ref)
+	require.NoError(t, err)
+	require.Empty(t, rows)
+	stats, err := s.GetFileStats(ref)
+	require.NoError(t, err)
+	require.Equal(t, &store.Stats{}, stats)
+}
+
+func requireNoResults(t *testing.T, results *store.FileResults) {
+	require.Empty(t, results.ValidNumbers)
+	require.Empty(t, results.FixedNumbers)
+	require.Empty(t, results.RejectedNumbers)
+	require.Empty(t, results.DuplicateNumbers)
+	require.Empty(t, results.Rows)
+}
+
+func testUnknownRef(t *testing.T, s store.Storage) {
+	ref := uuid.Must(uuid.NewV4())
+	_, err := s.GetFile(ref)
+	require.Equal(t, sql.ErrNoRows, err)
+	_, err = s.GetFileStats(ref)
+	require.Equal(t, sql.ErrNoRows, err)
+	_, err = s.GetFileResults(ref)
+	require.Equal(t, sql.ErrNoRows, err)
+	rows, err := s.GetFileRows(ref)
+	require.NoError(t, err)
+	require.Empty(t, rows)
+
+	require.Error(t, s.SaveProcessedFile(ref, writeNumbers(ref)))
+	_, err = s.GetFileResults(ref)
+	require.Equal(t, sql.ErrNoRows, err)
+	require.NoError(t, s.FailFile(ref, "unknown"))
+	_, err = s.GetFile(ref)
+	require.Equal(t, sql.ErrNoRows, err)
+}
+
+func testFailedWrite(t *testing.T, s store.Storage) {
+	ref := uuid.Must(uuid.NewV4())
+	require.NoError(t, s.CreateFile(store.File{Ref: ref, UploadedAt: now(), Fingerprint: "abc123"}))
+	err := s.SaveProcessedFile(ref, func(w store.FileWriter) error {
+		if err := writeNumbers(ref)(w); err != nil {
+			return err
+		}
+		return errors.New("validation failed")
+	})
+	require.EqualError(t, err, "validation failed")
+
+	// none of the numbers saved before the failure are kept
+	results, err := s.GetFileResults(ref)
+	require.NoError(t, err)
+	requireNoResults(t, results)
+	file, err := s.GetFile(ref)
+	require.NoError(t, err)
+	require.Equal(t, store.FileProcessing, file.Status)
+
+	require.NoError(t, s.FailFile(ref, "validation failed"))
+	file, err = s.GetFile(ref)
+	require.NoError(t, err)
+	require.Equal(t, store.FileFailed, file.Status)
+	require.Equal(t, "validation failed", file.Error)
+	require.NotNil(t, file.CompletedAt)
+	_, err = s.FindFileByFingerprint("abc123")
+	require.Equal(t, sql.ErrNoRows, err)
+	require.Error(t, s.SaveProcessedFile(ref, writeNumbers(ref)), "a failed file cannot be completed")
+}
+
+func testConcurrentWrites(t *testing.T, s store.Storage) {
+	const files, batches, batchSize = 8, 5, 20
+	refs := make([]uuid.UUID, files)
+	var wg sync.WaitGroup
+	errs := make(chan error, files)
+	for i := range refs {
+		refs[i] = uuid.Must(uuid.NewV4())
+		wg.Add(1)
+		go func(ref uuid.UUID) {
+			defer wg.Done()
+			if err := s.CreateFile(store.File{Ref: ref, UploadedAt: now()}); err != nil {
+				errs <- err
+				return
+			}
+			errs <- s.SaveProcessedFile(ref, func(w store.FileWriter) error {
+				for b := 0; b < batches; b++ {
+					numbers := make([]store.Number, batchSize)
+					for n := range numbers {
+						row := b*batchSize + n + 1
+						numbers[n] = store.Number{Number: fmt.Sprintf("27%09d", row), CountryIOCCode: "rsa", FileRef: ref,
+							SourceRow: store.SourceRow{RowNumber: row}}
+					}
+					if err := w.SaveNumbers(numbers); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}(refs[i])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	for _, ref := range refs {
+		rows, err := s.GetFileRows(ref)
+		require.NoError(t, err)
+		require.Len(t, rows, batches*batchSize)
+		for i, row := range rows {
+			require.Equal(t, i+1, row.RowNumber)
+			require.Equal(t, fmt.Sprintf("27%09d", i+1), row.Number)
+		}
+		stats, err := s.GetFileStats(ref)
+		require.NoError(t, err)
+		require.Equal(t, batches*batchSize, stats.ValidNumbersCount)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, s store.Storage) {
+	ref := uuid.Must(uuid.NewV4())
+	before := time.Now().Add(-time.Minute)
+	_, err := s.GetIdempotencyKey("retry-1", before)
+	require.Equal(t, sql.ErrNoRows, err)
+
+	key := store.IdempotencyKey{Key: "retry-1", Fingerprint: "abc123", FileRef: ref, StatusCode: 200, Response: []byte(`{"ref":1}`)}
+	require.NoError(t, s.SaveIdempotencyKey(key))
+	got, err := s.GetIdempotencyKey("retry-1", before)
+	require.NoError(t, err)
+	require.Equal(t, key.Fingerprint, got.Fingerprint)
+	require.Equal(t, ref, got.FileRef)
+	require.Equal(t, 200, got.StatusCode)
+	require.Equal(t, key.Response, got.Response)
+	require.False(t, got.CreatedAt.IsZero())
+
+	// keys saved before since have expired
+	_, err = s.GetIdempotencyKey("retry-1", time.Now().Add(time.Minute))
+	require.Equal(t, sql.ErrNoRows, err)
+
+	key.Fingerprint, key.Response = "def456", []byte(`{"ref":2}`)
+	require.NoError(t, s.SaveIdempotencyKey(key))
+	got, err = s.GetIdempotencyKey("retry-1", before)
+	require.NoError(t, err)
+	require.Equal(t, "def456", got.Fingerprint)
+	require.Equal(t, key.Response, got.Response)
+
+	// a key is reserved by a single request, later requests find the pending record
+	pending := store.IdempotencyKey{Key: "retry-2", Fingerprint: "abc123"}
+	prior, err := s.ReserveIdempotencyKey(pending, before, before)
+	require.NoError(t, err)
+	require.Nil(t, prior)
+	prior, err = s.ReserveIdempotencyKey(pending, before, before)
+	require.NoError(t, err)
+	require.NotNil(t, prior)
+	require.Equal(t, "abc123", prior.Fingerprint)
+	require.Equal(t, 0, prior.StatusCode)
+
+	// a released key can be reserved again, a saved one is kept
+	require.NoError(t, s.ReleaseIdempotencyKey("retry-2"))
+	prior, err = s.ReserveIdempotencyKey(pending, before, before)
+	require.NoError(t, err)
+	require.Nil(t, prior)
+	saved := store.IdempotencyKey{Key: "retry-2", Fingerprint: "abc123", FileRef: ref, StatusCode: 200, Response: []byte(`{"ref":3}`)}
+	require.NoError(t, s.SaveIdempotencyKey(saved))
+	require.NoError(t, s.ReleaseIdempotencyKey("retry-2"))
+	prior, err = s.ReserveIdempotencyKey(pending, before, before)
+	require.NoError(t, err)
+	require.NotNil(t, prior)
+	require.Equal(t, 200, prior.StatusCode)
+	require.Equal(t, saved.Response, prior.Response)
+
+	// an expired key is reserved anew
+	prior, err = s.ReserveIdempotencyKey(pending, time.Now().Add(time.Minute), before)
+	require.NoError(t, err)
+	require.Nil(t, prior)
+
+	// a reservation abandoned by an upload that never finished expires sooner than a saved response
+	abandoned := store.IdempotencyKey{Key: "retry-3", Fingerprint: "abc123"}
+	prior, err = s.ReserveIdempotencyKey(abandoned, before, before)
+	require.NoError(t, err)
+	require.Nil(t, prior)
+	prior, err = s.ReserveIdempotencyKey(abandoned, before, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Nil(t, prior)
+	// while a saved response is still replayed
+	prior, err = s.ReserveIdempotencyKey(key, before, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.NotNil(t, prior)
+	require.Equal(t, 200, prior.StatusCode)
+}
+
+func testRowQuota(t *testing.T, s store.Storage) {
+	day := time.Now()
+	used, err := s.GetRowQuotaUsage("client", day)
+	require.NoError(t, err)
+	require.Equal(t, 0, used)
+
+	reserved, err := s.ReserveRowQuota("client", day, 101, 100)
+	require.NoError(t, err)
+	require.False(t, reserved)
+
+	var wg sync.WaitGroup
+	results := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reserved, err := s.ReserveRowQuota("client", day, 30, 100)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- reserved
+		}()
+	}
+	wg.Wait()
+	close(results)
+	count := 0
+	for reserved := range results {
+		if reserved {
+			count++
+		}
+	}
+	require.Equal(t, 3, count)
+	used, err = s.GetRowQuotaUsage("client", day)
+	require.NoError(t, err)
+	require.Equal(t, 90, used)
+
+	// quotas are counted per client and per day
+	used, err = s.GetRowQuotaUsage("other", day)
+	require.NoError(t, err)
+	require.Equal(t, 0, used)
+	reserved, err = s.ReserveRowQuota("client", day.AddDate(0, 0, 1), 100, 100)
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	// rows given back can be reserved again, and usage never drops below zero
+	require.NoError(t, s.ReleaseRowQuota("client", day, 30))
+	used, err = s.GetRowQuotaUsage("client", day)
+	require.NoError(t, err)
+	require.Equal(t, 60, used)
+	reserved, err = s.ReserveRowQuota("client", day, 40, 100)
+	require.NoError(t, err)
+	require.True(t, reserved)
+	require.NoError(t, s.ReleaseRowQuota("client", day.AddDate(0, 0, 1), 200))
+	used, err = s.GetRowQuotaUsage("client", day.AddDate(0, 0, 1))
+	require.NoError(t, err)
+	require.Equal(t, 0, used)
+}
@@ -1,7 +1,21 @@
 package store
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
 	"github.com/gofrs/uuid"
+	"github.com/lib/pq"
+)
+
+// categories a processed number can fall into
+const (
+	ValidCategory     = "valid"
+	FixedCategory     = "fixed"
+	RejectedCategory  = "rejected"
+	DuplicateCategory = "duplicate"
 )
 
 // Number is used in query to store valid numer in DB
@@ -9,6 +23,7 @@ type Number struct {
 	Number         string    `db:"number"`
 	CountryIOCCode string    `db:"country_ioc_code"`
 	FileRef        uuid.UUID `db:"file_ref"`
+	SourceRow
 }
 
 // FixedNumber is used in query to store fixed number in DB
@@ -16,11 +31,189 @@ type FixedNumber struct {
 	OriginalNumber string    `json:"original_number" db:"original_number"`
 	Changes        string    `json:"changes" db:"changes"`
 	FixedNumber    string    `json:"fixed_number" db:"fixed_number"`
+	CountryIOCCode string    `json:"-" db:"country_ioc_code"`
 	FileRef        uuid.UUID `json:"-" db:"file_ref"`
+	SourceRow      `json:"-"`
 }
 
 // RejectedNumber is used in query to store rejected number in DB
 type RejectedNumber struct {
-	Number  string    `db:"number"`
+	Number         string    `db:"number"`
+	CountryIOCCode string    `db:"country_ioc_code"`
+	FileRef        uuid.UUID `db:"file_ref"`
+	// why the number was rejected
+	Reason string `db:"reason"`
+	SourceRow
+}
+
+// DuplicateNumber is used in query to store a number that repeats an earlier number in the same file
+type DuplicateNumber struct {
+	Number string `json:"number" db:"number"`
+	// number after fixing, empty if the number was rejected
+	NormalizedNumber string `json:"normalized_number" db:"normalized_number"`
+	// position of the duplicate in the file, and of the first occurrence that was kept
+	RowNumber      int `json:"row" db:"row_number"`
+	FirstRowNumber int `json:"first_row" db:"first_row_number"`
+	// numbers the numbers of a cell holding several, 0 for a cell holding one
+	Part           int       `json:"part,omitempty" db:"part"`
+	CountryIOCCode string    `json:"-" db:"country_ioc_code"`
+	FileRef        uuid.UUID `json:"-" db:"file_ref"`
+	// values of the columns of the row kept with the number
+	Passthrough Passthrough `json:"passthrough,omitempty" db:"passthrough"`
+}
+
+// SourceRow locates a number in the uploaded file
+type SourceRow struct {
+	// row of the file, starting from 1
+	RowNumber int `json:"row" db:"row_number"`
+	// numbers the numbers of a cell holding several, 0 for a cell holding one
+	Part int `json:"part,omitempty" db:"part"`
+	// values of the columns of the row kept with the number
+	Passthrough Passthrough `json:"passthrough,omitempty" db:"passthrough"`
+}
+
+// Passthrough holds the values of the extra columns of an upload row, by column
+// it is stored as a JSON object, or NULL when empty
+type Passthrough map[string]string
+
+// Value implements driver.Valuer
+// the JSON is returned as a string, as pq.CopyIn would encode bytes as bytea
+func (p Passthrough) Value() (driver.Value, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan implements sql.Scanner
+func (p *Passthrough) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	}
+	return fmt.Errorf("cannot scan %T into Passthrough", src)
+}
+
+// ResultRow is a processed number along with its position in the uploaded file
+type ResultRow struct {
+	SourceRow
+	// one of the number categories
+	Category    string `json:"category" db:"category"`
+	Number      string `json:"number" db:"number"`
+	FixedNumber string `json:"fixed_number,omitempty" db:"fixed_number"`
+	Changes     string `json:"changes,omitempty" db:"changes"`
+	Reason      string `json:"reason,omitempty" db:"reason"`
+	// row the number first occurred at, for duplicates
+	FirstRowNumber int `json:"first_row,omitempty" db:"first_row_number"`
+}
+
+// Cursor returns the position of the row, from which the page after it starts
+func (r ResultRow) Cursor() RowCursor {
+	return RowCursor{RowNumber: r.RowNumber, Part: r.Part, Category: r.Category, Number: r.Number}
+}
+
+// RowCursor is the position of a number within a file
+// numbers are ordered by row, part, category and then number, so that every number has a position of its own
+type RowCursor struct {
+	RowNumber int    `json:"row"`
+	Part      int    `json:"part"`
+	Category  string `json:"category"`
+	Number    string `json:"number"`
+}
+
+// before reports whether c comes before other in a file
+func (c RowCursor) before(other RowCursor) bool {
+	if c.RowNumber != other.RowNumber {
+		return c.RowNumber < other.RowNumber
+	}
+	if c.Part != other.Part {
+		return c.Part < other.Part
+	}
+	if c.Category != other.Category {
+		return c.Category < other.Category
+	}
+	return c.Number < other.Number
+}
+
+// RowPage selects a page of the numbers of a file
+type RowPage struct {
+	// only numbers of this category are returned, unless empty
+	Category string
+	// only numbers after this position are returned, unless nil
+	After *RowCursor
+	// maximum number of numbers returned, 0 for every number
+	Limit int
+}
+
+// File is used in query to store the upload metadata of a processed file
+type File struct {
+	Ref        uuid.UUID `db:"ref"`
+	Filename   string    `db:"filename"`
+	Label      string    `db:"label"`
+	UploadedAt time.Time `db:"uploaded_at"`
+	// deterministic hash of the normalised file content, used to detect duplicate uploads
+	Fingerprint string `db:"fingerprint"`
+	// number of cells holding several numbers, which were split into one number each
+	SplitCells int `db:"split_cells"`
+	// columns of the upload kept with each number
+	PassthroughColumns pq.StringArray `db:"passthrough_columns"`
+	// country the file was uploaded for, rows may name countries of their own
+	Country string `db:"country"`
+	// number of rows read from the upload, before cells holding several numbers were split
+	RowCount int `db:"row_count"`
+	// rules the numbers of the file were fixed with
+	FixPolicy    string `db:"fix_policy"`
+	RulesVersion int    `db:"rules_version"`
+	// one of FileProcessing, FileCompleted or FileFailed
+	Status string `db:"status"`
+	// why processing failed, for failed files
+	Error       string     `db:"error"`
+	CompletedAt *time.Time `db:"completed_at"`
+	// columns of the upload, naming the cells of its InputRows, empty for files processed before input rows were kept
+	SourceColumns pq.StringArray `db:"source_columns"`
+}
+
+// InputRow is used in query to store the cells of a row of an uploaded file, in the order of its SourceColumns
+type InputRow struct {
 	FileRef uuid.UUID `db:"file_ref"`
+	// row of the file, starting from 1, as in SourceRow
+	RowNumber int            `db:"row_number"`
+	Cells     pq.StringArray `db:"cells"`
+}
+
+// statuses of a file
+const (
+	FileProcessing = "processing"
+	FileCompleted  = "completed"
+	FileFailed     = "failed"
+)
+
+// IdempotencyKey is used in query to store the response to an upload made with an Idempotency-Key header
+type IdempotencyKey struct {
+	Key string `db:"key"`
+	// fingerprint of the payload the key was first used with
+	Fingerprint string    `db:"fingerprint"`
+	FileRef     uuid.UUID `db:"file_ref"`
+	// status of the response, 0 while the upload is still being processed
+	StatusCode int       `db:"status_code"`
+	Response   []byte    `db:"response"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// reports whether the key holds off a new reservation: a saved response recorded after since, or a reservation made
+// after pendingSince, older reservations being taken as abandoned
+func (k IdempotencyKey) heldAfter(since time.Time, pendingSince time.Time) bool {
+	if k.StatusCode == 0 && !k.CreatedAt.After(pendingSince) {
+		return false
+	}
+	return k.CreatedAt.After(since)
 }